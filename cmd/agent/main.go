@@ -1,11 +1,14 @@
 package main
 
 import (
+	"calc-service/pkg/mathops"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"math"
 	"net/http"
 	"os"
 	"strconv"
@@ -15,18 +18,21 @@ import (
 )
 
 type Task struct {
-	ID            string  `json:"id"`
-	ExpressionID  string  `json:"expression_id"`
-	Arg1          string  `json:"arg1"`
-	Arg2          string  `json:"arg2"`
-	Operator      string  `json:"operation"`
-	OperationTime int     `json:"operation_time"`
-	Result        float64 `json:"result,omitempty"`
-	UserID        string  `json:"user_id"`
+	ID            string   `json:"id"`
+	ExpressionID  string   `json:"expression_id"`
+	Arg1          string   `json:"arg1"`
+	Arg2          string   `json:"arg2"`
+	Args          []string `json:"args,omitempty"`
+	Operator      string   `json:"operation"`
+	OperationTime int      `json:"operation_time"`
+	Mode          string   `json:"mode"`
+	Result        float64  `json:"result,omitempty"`
+	UserID        string   `json:"user_id"`
 }
 
 type TaskResponse struct {
-	Task *Task `json:"task"`
+	Task  *Task `json:"task"`
+	Lease int64 `json:"lease_ms"`
 }
 
 const (
@@ -39,6 +45,7 @@ var (
 	activeWorkers    int
 	maxWorkers       int
 	agentToken       string
+	agentID          string
 	orchestratorHost string
 )
 
@@ -51,6 +58,8 @@ func main() {
 	agentToken = fetchToken()
 
 	maxWorkers = getEnvAsInt("COMPUTING_POWER", 10)
+	hostname, _ := os.Hostname()
+	agentID = fmt.Sprintf("%s-%d", hostname, os.Getpid())
 	log.Printf("Starting agent with %d workers", maxWorkers)
 
 	for i := 0; i < maxWorkers; i++ {
@@ -96,7 +105,7 @@ func fetchToken() string {
 
 func worker(id int) {
 	for {
-		task, ok := fetchTask()
+		task, lease, ok := fetchTask()
 		if !ok {
 			time.Sleep(1 * time.Second)
 			continue
@@ -104,17 +113,36 @@ func worker(id int) {
 
 		log.Printf("Worker %d: Processing task %s (%s %s %s)", id, task.ID, task.Arg1, task.Operator, task.Arg2)
 
+		// пока задача вычисляется, продлеваем ее аренду, иначе оркестратор отдаст ее другому агенту
+		stopHeartbeat := startHeartbeat(task.ID, lease)
 		result, err := processTask(task)
+		stopHeartbeat()
+		var calcErr calculationError
+		if errors.As(err, &calcErr) {
+			// повторное вычисление даст ту же ошибку — сообщаем о ней оркестратору
+			log.Printf("Worker %d: Task %s failed: %v", id, task.ID, err)
+			if err := sendResultWithRetry(taskResult{ID: task.ID, Error: calcErr.Error()}); err != nil {
+				log.Printf("Worker %d: Failed to send error: %v", id, err)
+			}
+			updateWorkerCount(-1)
+			continue
+		}
+		if errors.Is(err, errDependencyCancelled) {
+			// задача невыбранной ветви: она отменена вместе с зависимостью, результат не нужен
+			log.Printf("Worker %d: Task %s skipped: %v", id, task.ID, err)
+			updateWorkerCount(-1)
+			continue
+		}
 		if err != nil {
 			log.Printf("Worker %d: Task %s failed: %v", id, task.ID, err)
 			updateWorkerCount(-1)
 			continue
 		}
 
-		if err := sendResultWithRetry(task.ID, result); err != nil {
+		if err := sendResultWithRetry(newTaskResult(task.ID, result)); err != nil {
 			log.Printf("Worker %d: Failed to send result: %v", id, err)
 		} else {
-			log.Printf("Worker %d: Result %.2f for task %s sent", id, result, task.ID)
+			log.Printf("Worker %d: Result %s for task %s sent", id, result, task.ID)
 		}
 
 		updateWorkerCount(-1)
@@ -129,12 +157,13 @@ func updateWorkerCount(delta int) {
 
 // TASK FETCH
 
-func fetchTask() (*Task, bool) {
+// fetchTask gets a task leased to the agent and the duration of the lease
+func fetchTask() (*Task, time.Duration, bool) {
 	taskMutex.Lock()
 	defer taskMutex.Unlock()
 
 	if activeWorkers >= maxWorkers {
-		return nil, false
+		return nil, 0, false
 	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
@@ -144,137 +173,268 @@ func fetchTask() (*Task, bool) {
 	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
 		log.Printf("Request creation error: %v", err)
-		return nil, false
+		return nil, 0, false
 	}
 	addAuthHeader(req)
+	// оркестратор учитывает мощность агентов при оценке времени вычисления
+	req.Header.Set("X-Agent-ID", agentID)
+	req.Header.Set("X-Agent-Workers", strconv.Itoa(maxWorkers))
 
 	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		log.Printf("Fetch error: %v", err)
-		return nil, false
+		return nil, 0, false
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode == http.StatusNotFound {
-		return nil, false
+		return nil, 0, false
 	}
 	if resp.StatusCode != http.StatusOK {
 		body, _ := io.ReadAll(resp.Body)
 		log.Printf("Server error: %d - %s", resp.StatusCode, string(body))
-		return nil, false
+		return nil, 0, false
 	}
 
 	var response TaskResponse
 	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
 		log.Printf("Decode error: %v", err)
-		return nil, false
+		return nil, 0, false
 	}
 	if response.Task == nil {
-		return nil, false
+		return nil, 0, false
 	}
 
 	activeWorkers++
-	return response.Task, true
+	return response.Task, time.Duration(response.Lease) * time.Millisecond, true
+}
+
+// HEARTBEAT
+
+// startHeartbeat extends the lease of the task three times per lease period
+// until the returned function is called; orchestrators without leases report
+// none, then nothing is sent
+func startHeartbeat(taskID string, lease time.Duration) func() {
+	if lease <= 0 {
+		return func() {}
+	}
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(lease / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				err := sendHeartbeat(taskID)
+				select {
+				case <-done:
+					// задача уже вычислена, и результат мог прийти раньше продления
+					return
+				default:
+				}
+				if err != nil {
+					log.Printf("Heartbeat for task %s failed: %v", taskID, err)
+					if errors.Is(err, errLeaseLost) {
+						return
+					}
+				}
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+// errLeaseLost means the task is completed or leased to another agent: the
+// orchestrator accepts neither heartbeats nor the result of the task from us
+var errLeaseLost = errors.New("lease lost")
+
+func sendHeartbeat(taskID string) error {
+	data, err := json.Marshal(map[string]string{"id": taskID})
+	if err != nil {
+		return fmt.Errorf("encode error: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	url := fmt.Sprintf("http://%s:8080/internal/task/heartbeat", orchestratorHost)
+	req, err := http.NewRequestWithContext(ctx, "POST", url, strings.NewReader(string(data)))
+	if err != nil {
+		return fmt.Errorf("request error: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Agent-ID", agentID)
+	addAuthHeader(req)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("send error: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusConflict {
+		return errLeaseLost
+	}
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("status %d: %s", resp.StatusCode, string(body))
+	}
+	return nil
 }
 
 // PROCESSING
 
-func processTask(task *Task) (float64, error) {
+// calculationError is a permanent failure of a task (overflow, division by zero,
+// failed dependency), unlike network errors it is not fixed by retrying
+type calculationError struct {
+	err error
+}
+
+func (e calculationError) Error() string { return e.err.Error() }
+
+// evaluate computes the operation, wrapping its errors as permanent
+func evaluate(task *Task, args ...string) (string, error) {
+	time.Sleep(time.Duration(task.OperationTime) * time.Millisecond)
+	res, err := mathops.Evaluate(task.Mode, task.Operator, args...)
+	if err != nil {
+		return "", calculationError{err}
+	}
+	return res, nil
+}
+
+// processTask computes the task in its numeric mode; arguments and the result
+// are canonical number strings, so decimal results stay exact
+func processTask(task *Task) (string, error) {
+	// у вызова функции все аргументы лежат в Args
+	if len(task.Args) > 0 {
+		args := make([]string, 0, len(task.Args))
+		for i, arg := range task.Args {
+			val, err := resolveArgument(arg)
+			if err != nil {
+				return "", fmt.Errorf("arg %d: %w", i+1, err)
+			}
+			args = append(args, val)
+		}
+		return evaluate(task, args...)
+	}
+
 	arg1, err := resolveArgument(task.Arg1)
 	if err != nil {
-		return 0, fmt.Errorf("arg1: %w", err)
+		return "", fmt.Errorf("arg1: %w", err)
+	}
+	// у унарных операций (neg) второго аргумента нет
+	if task.Arg2 == "" {
+		return evaluate(task, arg1)
 	}
 	arg2, err := resolveArgument(task.Arg2)
 	if err != nil {
-		return 0, fmt.Errorf("arg2: %w", err)
+		return "", fmt.Errorf("arg2: %w", err)
 	}
-	time.Sleep(time.Duration(task.OperationTime) * time.Millisecond)
-	return calculate(task.Operator, arg1, arg2)
+	return evaluate(task, arg1, arg2)
 }
 
-func resolveArgument(arg string) (float64, error) {
+func resolveArgument(arg string) (string, error) {
 	if strings.HasPrefix(arg, "task:") {
 		id := strings.TrimPrefix(arg, "task:")
 		return fetchTaskResultWithRetry(id)
 	}
-	return strconv.ParseFloat(arg, 64)
-}
-
-func calculate(op string, a, b float64) (float64, error) {
-	switch op {
-	case "+":
-		return a + b, nil
-	case "-":
-		return a - b, nil
-	case "*":
-		return a * b, nil
-	case "/":
-		if b == 0 {
-			return 0, fmt.Errorf("division by zero")
-		}
-		return a / b, nil
-	default:
-		return 0, fmt.Errorf("unknown operator: %s", op)
-	}
+	return arg, nil
 }
 
 // TASK RESULT FETCH
 
-func fetchTaskResult(id string) (float64, error) {
+// errDependencyCancelled means the task depends on a task of a branch not
+// taken: the task is cancelled too, so it is dropped without a result
+var errDependencyCancelled = errors.New("dependency cancelled")
+
+func fetchTaskResult(id string) (string, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
 	url := fmt.Sprintf("http://%s:8080/internal/task/result/%s", orchestratorHost, id)
 	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
-		return 0, fmt.Errorf("request error: %w", err)
+		return "", fmt.Errorf("request error: %w", err)
 	}
 	addAuthHeader(req)
 
 	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
-		return 0, fmt.Errorf("network error: %w", err)
+		return "", fmt.Errorf("network error: %w", err)
 	}
 	defer resp.Body.Close()
 
 	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode == http.StatusConflict {
+		return "", fmt.Errorf("%w: %s", errDependencyCancelled, id)
+	}
 	if resp.StatusCode != http.StatusOK {
-		return 0, fmt.Errorf("status %d: %s", resp.StatusCode, string(body))
+		return "", fmt.Errorf("status %d: %s", resp.StatusCode, string(body))
 	}
 
 	var result struct {
-		Result float64 `json:"result"`
+		Result      float64 `json:"result"`
+		ResultExact string  `json:"result_exact"`
+		Error       string  `json:"error"`
 	}
 	if err := json.Unmarshal(body, &result); err != nil {
-		return 0, fmt.Errorf("decode error: %w", err)
+		return "", fmt.Errorf("decode error: %w", err)
+	}
+	if result.Error != "" {
+		return "", calculationError{fmt.Errorf("dependency %s failed: %s", id, result.Error)}
+	}
+	if result.ResultExact == "" {
+		return strconv.FormatFloat(result.Result, 'g', -1, 64), nil
 	}
-	return result.Result, nil
+	return result.ResultExact, nil
 }
 
-func fetchTaskResultWithRetry(id string) (float64, error) {
+func fetchTaskResultWithRetry(id string) (string, error) {
 	var lastErr error
 	for i := 0; i < maxRetries; i++ {
 		res, err := fetchTaskResult(id)
-		if err == nil {
-			return res, nil
+		if err == nil || errors.As(err, new(calculationError)) || errors.Is(err, errDependencyCancelled) {
+			return res, err
 		}
 		lastErr = err
 		delay := time.Duration(1<<uint(i)) * baseRetryDelay
 		log.Printf("Retry %d/%d task %s: %v", i+1, maxRetries, id, err)
 		time.Sleep(delay)
 	}
-	return 0, fmt.Errorf("max retries for task %s: %v", id, lastErr)
+	return "", fmt.Errorf("max retries for task %s: %v", id, lastErr)
 }
 
 // TASK RESULT SEND
 
-func sendResult(taskID string, result float64) error {
-	payload := struct {
-		ID     string  `json:"id"`
-		Result float64 `json:"result"`
-	}{taskID, result}
+// taskResult is the payload reporting either a result or a calculation error
+type taskResult struct {
+	ID          string  `json:"id"`
+	Result      float64 `json:"result"`
+	ResultExact string  `json:"result_exact,omitempty"`
+	Error       string  `json:"error,omitempty"`
+}
+
+// newTaskResult reports a result; the float approximation is left out when
+// the exact result (of decimal mode) is beyond the float range, JSON has no
+// infinity
+func newTaskResult(taskID string, result string) taskResult {
+	approx := mathops.ToFloat(result)
+	if math.IsInf(approx, 0) {
+		approx = 0
+	}
+	return taskResult{ID: taskID, Result: approx, ResultExact: result}
+}
 
-	data, _ := json.Marshal(payload)
+// errUnencodable means the payload can't be sent at all; retrying won't help
+var errUnencodable = errors.New("unencodable result")
+
+func sendResult(payload taskResult) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errUnencodable, err)
+	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
@@ -285,6 +445,8 @@ func sendResult(taskID string, result float64) error {
 		return fmt.Errorf("request error: %w", err)
 	}
 	req.Header.Set("Content-Type", "application/json")
+	// результат принимается только от агента, которому выдана задача
+	req.Header.Set("X-Agent-ID", agentID)
 	addAuthHeader(req)
 
 	resp, err := http.DefaultClient.Do(req)
@@ -293,6 +455,9 @@ func sendResult(taskID string, result float64) error {
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode == http.StatusConflict {
+		return errLeaseLost
+	}
 	if resp.StatusCode != http.StatusOK {
 		body, _ := io.ReadAll(resp.Body)
 		return fmt.Errorf("status %d: %s", resp.StatusCode, string(body))
@@ -300,19 +465,29 @@ func sendResult(taskID string, result float64) error {
 	return nil
 }
 
-func sendResultWithRetry(taskID string, result float64) error {
+func sendResultWithRetry(payload taskResult) error {
 	var lastErr error
 	for i := 0; i < maxRetries; i++ {
-		if err := sendResult(taskID, result); err == nil {
-			return nil
-		} else {
-			lastErr = err
+		err := sendResult(payload)
+		if err == nil || errors.Is(err, errLeaseLost) {
+			// повтор не поможет: задача уже не наша
+			return err
+		}
+		if errors.Is(err, errUnencodable) {
+			if payload.Error != "" {
+				return err
+			}
+			// результат не передать — сообщаем об этом как об ошибке вычисления,
+			// иначе задача ждала бы истечения аренды
+			payload = taskResult{ID: payload.ID, Error: err.Error()}
+			continue
 		}
+		lastErr = err
 		delay := time.Duration(1<<uint(i)) * baseRetryDelay
-		log.Printf("Retry %d/%d sending result for task %s: %v", i+1, maxRetries, taskID, lastErr)
+		log.Printf("Retry %d/%d sending result for task %s: %v", i+1, maxRetries, payload.ID, lastErr)
 		time.Sleep(delay)
 	}
-	return fmt.Errorf("max retries for sending result %s: %v", taskID, lastErr)
+	return fmt.Errorf("max retries for sending result %s: %v", payload.ID, lastErr)
 }
 
 // UTILS
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"calc-service/internal/cache"
 	"calc-service/internal/handler"
 	"calc-service/pkg/database"
 	"calc-service/pkg/logger"
@@ -36,6 +37,9 @@ func main() {
 	}
 	defer database.CloseDB()
 
+	// Result cache shared by all expressions
+	cache.Init()
+
 	// Set up router with middleware
 	mux := http.NewServeMux()
 
@@ -52,10 +56,28 @@ func main() {
 			handler.HandleCalculate(w, r)
 		case r.URL.Path == "/api/v1/expressions" && r.Method == http.MethodGet:
 			handler.HandleExpressions(w, r)
+		case r.URL.Path == "/api/v1/expressions/plan":
+			handler.HandlePlan(w, r)
+		case strings.HasPrefix(r.URL.Path, "/api/v1/expressions/") && strings.HasSuffix(r.URL.Path, "/tree"):
+			handler.HandleExpressionTree(w, r)
 		case len(r.URL.Path) > len("/api/v1/expressions/") && r.URL.Path[:len("/api/v1/expressions/")] == "/api/v1/expressions/":
 			handler.HandleExpressionByID(w, r)
 		case len(r.URL.Path) > len("/api/v1/tasks/") && r.URL.Path[:len("/api/v1/tasks/")] == "/api/v1/tasks/":
 			handler.HandleTaskByID(w, r)
+		case r.URL.Path == "/api/v1/cache":
+			handler.HandleCacheStats(w, r)
+		case r.URL.Path == "/api/v1/variables":
+			handler.HandleVariables(w, r)
+		case len(r.URL.Path) > len("/api/v1/variables/") && r.URL.Path[:len("/api/v1/variables/")] == "/api/v1/variables/":
+			handler.HandleVariableByName(w, r)
+		case r.URL.Path == "/api/v1/functions":
+			handler.HandleFunctions(w, r)
+		case strings.HasPrefix(r.URL.Path, "/api/v1/functions/"):
+			handler.HandleFunctionByName(w, r)
+		case r.URL.Path == "/api/v1/symbolic/derive":
+			handler.HandleDerive(w, r)
+		case r.URL.Path == "/api/v1/symbolic/simplify":
+			handler.HandleSimplify(w, r)
 		default:
 			http.NotFound(w, r)
 		}
@@ -66,10 +88,17 @@ func main() {
 	mux.Handle("/api/v1/expressions", handler.AuthMiddleware(apiHandler))
 	mux.Handle("/api/v1/expressions/", handler.AuthMiddleware(apiHandler))
 	mux.Handle("/api/v1/tasks/", handler.AuthMiddleware(apiHandler))
+	mux.Handle("/api/v1/cache", handler.AuthMiddleware(apiHandler))
+	mux.Handle("/api/v1/variables", handler.AuthMiddleware(apiHandler))
+	mux.Handle("/api/v1/variables/", handler.AuthMiddleware(apiHandler))
+	mux.Handle("/api/v1/functions", handler.AuthMiddleware(apiHandler))
+	mux.Handle("/api/v1/functions/", handler.AuthMiddleware(apiHandler))
+	mux.Handle("/api/v1/symbolic/", handler.AuthMiddleware(apiHandler))
 
 	// Internal API for agents (should be protected differently or only accessible internally)
 	mux.Handle("/internal/task", handler.AgentAuthMiddleware(http.HandlerFunc(handler.TaskHandler)))
 	mux.Handle("/internal/task/result/", handler.AgentAuthMiddleware(http.HandlerFunc(handler.HandleInternalTaskByID)))
+	mux.Handle("/internal/task/heartbeat", handler.AgentAuthMiddleware(http.HandlerFunc(handler.HandleTaskHeartbeat)))
 	mux.HandleFunc("/internal/agent/token", handleAgentToken)
 
 	// Frontend
@@ -129,6 +158,8 @@ func startTaskProcessor() {
 		case <-ticker.C:
 			// Process tasks for all users
 			handler.ProcessPendingTasks()
+			// Return the tasks of silent agents to the queue
+			handler.ReapExpiredLeases()
 		}
 	}
 }
@@ -0,0 +1,205 @@
+// Package cache запоминает результаты операций по оператору, значениям
+// аргументов и числовому режиму, чтобы одинаковые задачи разных выражений
+// не вычислялись агентами повторно.
+package cache
+
+import (
+	"calc-service/pkg/database"
+	"calc-service/pkg/logger"
+	"container/list"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultSize        = 10000  // записей в памяти, если не задан CACHE_SIZE
+	defaultPersistSize = 100000 // записей в таблице, если не задан CACHE_PERSIST_SIZE
+	pruneEvery         = 100    // раз в столько записей таблица урезается до CACHE_PERSIST_SIZE
+)
+
+// Stats describes the state of the cache
+type Stats struct {
+	Enabled    bool  `json:"enabled"`
+	Persistent bool  `json:"persistent"`
+	Size       int   `json:"size"`
+	Capacity   int   `json:"capacity"`
+	Hits       int64 `json:"hits"`
+	Misses     int64 `json:"misses"`
+}
+
+type entry struct {
+	key   string
+	value string
+}
+
+var (
+	mu          sync.Mutex
+	enabled     bool
+	persistent  bool
+	capacity    int
+	persistSize int
+	items       map[string]*list.Element
+	order       *list.List // недавно использованные записи — в начале
+	puts        int
+
+	hits   atomic.Int64
+	misses atomic.Int64
+)
+
+// Init configures the cache from the environment: CACHE_ENABLED (true unless
+// "false"), CACHE_SIZE, and CACHE_PERSIST=true with CACHE_PERSIST_SIZE to keep
+// results in the result_cache table across restarts
+func Init() {
+	mu.Lock()
+	defer mu.Unlock()
+
+	enabled = os.Getenv("CACHE_ENABLED") != "false"
+	persistent = os.Getenv("CACHE_PERSIST") == "true"
+	capacity = getEnvAsInt("CACHE_SIZE", defaultSize)
+	persistSize = getEnvAsInt("CACHE_PERSIST_SIZE", defaultPersistSize)
+	items = make(map[string]*list.Element)
+	order = list.New()
+	puts = 0
+	hits.Store(0)
+	misses.Store(0)
+}
+
+// Enabled reports whether the cache is in use
+func Enabled() bool {
+	mu.Lock()
+	defer mu.Unlock()
+	return enabled
+}
+
+// Key addresses the result of op over the given argument values in a numeric mode
+func Key(mode, op string, args ...string) string {
+	h := sha256.New()
+	h.Write([]byte(mode))
+	h.Write([]byte{0})
+	h.Write([]byte(op))
+	for _, arg := range args {
+		h.Write([]byte{0})
+		h.Write([]byte(arg))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Get returns the cached result for key
+func Get(key string) (string, bool) {
+	mu.Lock()
+	if !enabled {
+		mu.Unlock()
+		return "", false
+	}
+	if el, ok := items[key]; ok {
+		order.MoveToFront(el)
+		value := el.Value.(*entry).value
+		mu.Unlock()
+		hits.Add(1)
+		return value, true
+	}
+	mu.Unlock()
+
+	if persistent {
+		db := database.GetDB()
+		var value string
+		err := db.QueryRow("SELECT result FROM result_cache WHERE key = ?", key).Scan(&value)
+		if err == nil {
+			if _, err := db.Exec("UPDATE result_cache SET used_at = ? WHERE key = ?", time.Now(), key); err != nil {
+				logger.Error("cache: failed to touch %s: %v", key, err)
+			}
+			mu.Lock()
+			add(key, value)
+			mu.Unlock()
+			hits.Add(1)
+			return value, true
+		}
+		if err != sql.ErrNoRows {
+			logger.Error("cache: failed to read %s: %v", key, err)
+		}
+	}
+
+	misses.Add(1)
+	return "", false
+}
+
+// Put remembers the result for key
+func Put(key, value string) {
+	mu.Lock()
+	if !enabled {
+		mu.Unlock()
+		return
+	}
+	add(key, value)
+	puts++
+	prune := puts%pruneEvery == 0
+	mu.Unlock()
+
+	if !persistent {
+		return
+	}
+	db := database.GetDB()
+	if _, err := db.Exec(
+		"INSERT OR REPLACE INTO result_cache (key, result, used_at) VALUES (?, ?, ?)",
+		key, value, time.Now(),
+	); err != nil {
+		logger.Error("cache: failed to store %s: %v", key, err)
+		return
+	}
+	if prune {
+		if _, err := db.Exec(
+			"DELETE FROM result_cache WHERE key NOT IN (SELECT key FROM result_cache ORDER BY used_at DESC LIMIT ?)",
+			persistSize,
+		); err != nil {
+			logger.Error("cache: failed to prune result_cache: %v", err)
+		}
+	}
+}
+
+// GetStats returns the size of the in-memory cache and the hit/miss counters
+func GetStats() Stats {
+	mu.Lock()
+	defer mu.Unlock()
+
+	stats := Stats{
+		Enabled:    enabled,
+		Persistent: persistent,
+		Capacity:   capacity,
+		Hits:       hits.Load(),
+		Misses:     misses.Load(),
+	}
+	if order != nil {
+		stats.Size = order.Len()
+	}
+	return stats
+}
+
+// add puts the entry in front of the LRU list, evicting the least recently
+// used one when the cache is full; mu must be held
+func add(key, value string) {
+	if el, ok := items[key]; ok {
+		el.Value.(*entry).value = value
+		order.MoveToFront(el)
+		return
+	}
+	items[key] = order.PushFront(&entry{key: key, value: value})
+	if order.Len() > capacity {
+		oldest := order.Back()
+		order.Remove(oldest)
+		delete(items, oldest.Value.(*entry).key)
+	}
+}
+
+func getEnvAsInt(key string, def int) int {
+	n, err := strconv.Atoi(os.Getenv(key))
+	if err != nil || n <= 0 {
+		return def
+	}
+	return n
+}
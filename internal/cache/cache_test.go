@@ -0,0 +1,128 @@
+package cache
+
+import (
+	"calc-service/pkg/database"
+	"calc-service/pkg/logger"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "calc-cache-test")
+	if err != nil {
+		panic(err)
+	}
+	os.Setenv("DB_PATH", filepath.Join(dir, "test.db"))
+	logger.Init("fatal")
+	if err := database.InitDB(); err != nil {
+		panic(err)
+	}
+
+	code := m.Run()
+	database.CloseDB()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+func TestEvictLeastRecentlyUsed(t *testing.T) {
+	t.Setenv("CACHE_SIZE", "2")
+	Init()
+
+	Put("a", "1")
+	Put("b", "2")
+	// чтение делает запись недавно использованной: вытесняется b, а не a
+	if value, ok := Get("a"); !ok || value != "1" {
+		t.Fatalf("got %q, %v, want 1", value, ok)
+	}
+	Put("c", "3")
+
+	if _, ok := Get("b"); ok {
+		t.Error("b should have been evicted")
+	}
+	for key, want := range map[string]string{"a": "1", "c": "3"} {
+		if value, ok := Get(key); !ok || value != want {
+			t.Errorf("%s: got %q, %v, want %s", key, value, ok, want)
+		}
+	}
+
+	stats := GetStats()
+	if stats.Size != 2 || stats.Capacity != 2 || stats.Hits != 3 || stats.Misses != 1 {
+		t.Errorf("got %+v, want size 2 of 2 with 3 hits and 1 miss", stats)
+	}
+}
+
+func TestPutExistingKey(t *testing.T) {
+	t.Setenv("CACHE_SIZE", "2")
+	Init()
+
+	Put("a", "1")
+	Put("b", "2")
+	Put("a", "10")
+	Put("c", "3")
+
+	// повторная запись обновляет значение и не занимает места
+	if value, ok := Get("a"); !ok || value != "10" {
+		t.Errorf("got %q, %v, want 10", value, ok)
+	}
+	if _, ok := Get("b"); ok {
+		t.Error("b should have been evicted")
+	}
+}
+
+func TestDisabled(t *testing.T) {
+	t.Setenv("CACHE_ENABLED", "false")
+	Init()
+
+	Put("a", "1")
+	if _, ok := Get("a"); ok || Enabled() {
+		t.Error("a disabled cache should not keep results")
+	}
+}
+
+func TestPersistent(t *testing.T) {
+	t.Setenv("CACHE_SIZE", "1")
+	t.Setenv("CACHE_PERSIST", "true")
+	t.Setenv("CACHE_PERSIST_SIZE", "10")
+	Init()
+
+	Put("persistent-a", "1")
+	Put("persistent-b", "2")
+	// в памяти осталась только b, a читается из таблицы
+	if value, ok := Get("persistent-a"); !ok || value != "1" {
+		t.Fatalf("got %q, %v, want 1 from result_cache", value, ok)
+	}
+
+	// на pruneEvery-й записи (считая две выше) таблица урезается до CACHE_PERSIST_SIZE
+	for i := 2; i < pruneEvery; i++ {
+		Put("persistent-"+strconv.Itoa(i), strconv.Itoa(i))
+	}
+	var count int
+	if err := database.GetDB().QueryRow("SELECT COUNT(*) FROM result_cache").Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 10 {
+		t.Errorf("got %d rows in result_cache, want 10", count)
+	}
+}
+
+func TestKey(t *testing.T) {
+	// аргументы разделены, режим и оператор входят в ключ
+	keys := []string{
+		Key("float", "+", "1", "23"),
+		Key("float", "+", "12", "3"),
+		Key("decimal", "+", "1", "23"),
+		Key("float", "*", "1", "23"),
+	}
+	seen := make(map[string]bool)
+	for _, key := range keys {
+		if seen[key] {
+			t.Errorf("duplicate key %s", key)
+		}
+		seen[key] = true
+	}
+	if Key("float", "+", "1", "2") != Key("float", "+", "1", "2") {
+		t.Error("the same operation should have the same key")
+	}
+}
@@ -2,90 +2,173 @@ package calculator
 
 import (
 	"calc-service/internal/store"
+	"calc-service/pkg/mathops"
 	"fmt"
-	"strconv"
 	"strings"
 )
 
-func AggregateResults(tasks []*store.Task) (float64, error) {
-	results := make(map[string]float64)
+// AggregateResults evaluates the expression tree from completed tasks and
+// returns the result in the numeric mode of the tasks
+func AggregateResults(tasks []*store.Task) (string, error) {
+	results := make(map[string]string)
 	for _, task := range tasks {
 		if !task.Completed {
-			return 0, fmt.Errorf("task %s is not completed yet", task.ID)
+			return "", fmt.Errorf("task %s is not completed yet", task.ID)
+		}
+		results[task.ID] = task.Exact()
+	}
+
+	// результаты выражений, на которые ссылается это ($expr-<id>)
+	for _, task := range tasks {
+		for _, arg := range append([]string{task.Arg1, task.Arg2}, task.Args...) {
+			if !strings.HasPrefix(arg, "task:") {
+				continue
+			}
+			id := strings.TrimPrefix(arg, "task:")
+			if _, ok := results[id]; ok {
+				continue
+			}
+			dep, found := store.GetTask(id)
+			if !found || !dep.Completed {
+				return "", fmt.Errorf("referenced task %s is not completed yet", id)
+			}
+			results[id] = dep.Exact()
 		}
-		results[task.ID] = task.Result
 	}
 
 	root, err := getRootNode(tasks)
 	if err != nil {
-		return 0, err
+		return "", err
+	}
+	return evaluateWithResults(root, results, tasks[0].Mode)
+}
+
+// MatrixValues returns the values of the elements of a vector or a matrix as
+// numbers of the mode; it fails while an element has no result
+func MatrixValues(m *store.Matrix, mode string) ([]string, error) {
+	values := make([]string, len(m.Elements))
+	for i, element := range m.Elements {
+		if id, ok := strings.CutPrefix(element, "task:"); ok {
+			task, found := store.GetTask(id)
+			if !found || task.Status() != store.TaskCompleted {
+				return nil, fmt.Errorf("element %d is not computed yet", i+1)
+			}
+			element = task.Exact()
+		}
+		value, err := mathops.Normalize(mode, element)
+		if err != nil {
+			return nil, fmt.Errorf("invalid element %d: %w", i+1, err)
+		}
+		values[i] = value
 	}
-	return evaluateWithResults(root, results)
+	return values, nil
+}
+
+// BuildTree restores the expression tree from the tasks of an expression;
+// operation nodes carry the IDs of their tasks
+func BuildTree(tasks []*store.Task) (*Node, error) {
+	return getRootNode(tasks)
+}
+
+// BuildMatrixTree restores the tree of an expression whose result is a vector
+// or a matrix: a list of the trees of its elements
+func BuildMatrixTree(tasks []*store.Task, m *store.Matrix) *Node {
+	_, argNode := taskNodes(tasks)
+	elements := make([]*Node, len(m.Elements))
+	for i, element := range m.Elements {
+		elements[i] = argNode(element)
+	}
+	if len(m.Shape) == 1 {
+		return &Node{Kind: ListNode, Args: elements}
+	}
+	matrix := &Node{Kind: ListNode}
+	for i := 0; i < m.Shape[0]; i++ {
+		matrix.Args = append(matrix.Args, &Node{Kind: ListNode, Args: elements[i*m.Shape[1] : (i+1)*m.Shape[1]]})
+	}
+	return matrix
 }
 
 func getRootNode(tasks []*store.Task) (*Node, error) {
+	if len(tasks) == 0 {
+		return nil, fmt.Errorf("no tasks to aggregate")
+	}
+	nodes, _ := taskNodes(tasks)
+	return nodes[tasks[len(tasks)-1].ID], nil
+}
+
+// taskNodes restores the nodes of the tasks linked through their arguments;
+// it also returns the conversion of a task argument into a node
+func taskNodes(tasks []*store.Task) (map[string]*Node, func(string) *Node) {
 	nodes := make(map[string]*Node)
 	for _, t := range tasks {
 		nodes[t.ID] = &Node{
+			Kind:   operationKind(t.Operator),
 			Value:  t.Operator,
 			TaskID: t.ID,
 		}
 	}
 
+	// argNode превращает аргумент задачи (ссылку "task:" или литерал) в узел дерева
+	argNode := func(arg string) *Node {
+		if strings.HasPrefix(arg, "task:") {
+			id := strings.TrimPrefix(arg, "task:")
+			if n, ok := nodes[id]; ok {
+				return n
+			}
+			// задача другого выражения, ее результат берется из results
+			return &Node{Kind: TaskRefNode, Value: arg, TaskID: id}
+		}
+		return &Node{Kind: NumberNode, Value: arg}
+	}
+
 	for _, t := range tasks {
 		n := nodes[t.ID]
-		if strings.HasPrefix(t.Arg1, "task:") {
-			childID := strings.TrimPrefix(t.Arg1, "task:")
-			n.Left = nodes[childID]
-		} else {
-			n.Left = &Node{Value: t.Arg1}
+		if len(t.Args) > 0 {
+			for _, arg := range t.Args {
+				n.Args = append(n.Args, argNode(arg))
+			}
+			continue
 		}
 
-		if strings.HasPrefix(t.Arg2, "task:") {
-			childID := strings.TrimPrefix(t.Arg2, "task:")
-			n.Right = nodes[childID]
-		} else {
-			n.Right = &Node{Value: t.Arg2}
+		n.Left = argNode(t.Arg1)
+		if n.Kind == BinaryNode {
+			n.Right = argNode(t.Arg2)
 		}
 	}
-
-	if len(tasks) == 0 {
-		return nil, fmt.Errorf("no tasks to aggregate")
-	}
-	return nodes[tasks[len(tasks)-1].ID], nil
+	return nodes, argNode
 }
 
-func evaluateWithResults(n *Node, results map[string]float64) (float64, error) {
+func evaluateWithResults(n *Node, results map[string]string, mode string) (string, error) {
 	if n == nil {
-		return 0, fmt.Errorf("empty node")
+		return "", fmt.Errorf("empty node")
 	}
-	if !isOperator(n.Value) {
-		if val, ok := results[n.TaskID]; ok {
-			return val, nil
+	switch n.Kind {
+	case NumberNode:
+		return mathops.Normalize(mode, n.Value)
+	case TaskRefNode:
+		val, ok := results[n.TaskID]
+		if !ok {
+			return "", fmt.Errorf("result of task %s is missing", n.TaskID)
 		}
-		return strconv.ParseFloat(n.Value, 64)
-	}
-	left, err := evaluateWithResults(n.Left, results)
-	if err != nil {
-		return 0, err
+		return val, nil
+	case IdentifierNode, ReferenceNode:
+		return "", fmt.Errorf("unresolved name %s", n.Value)
 	}
-	right, err := evaluateWithResults(n.Right, results)
-	if err != nil {
-		return 0, err
+
+	// результат операции уже посчитан ее задачей; так общие узлы (одинаковые
+	// подвыражения, привязки сценария) не вычисляются повторно
+	if val, ok := results[n.TaskID]; ok {
+		return val, nil
 	}
-	switch n.Value {
-	case "+":
-		return left + right, nil
-	case "-":
-		return left - right, nil
-	case "*":
-		return left * right, nil
-	case "/":
-		if right == 0 {
-			return 0, fmt.Errorf("division by zero")
+
+	children := n.Operands()
+	args := make([]string, 0, len(children))
+	for _, operand := range children {
+		val, err := evaluateWithResults(operand, results, mode)
+		if err != nil {
+			return "", err
 		}
-		return left / right, nil
-	default:
-		return 0, fmt.Errorf("unknown operator %s", n.Value)
+		args = append(args, val)
 	}
+	return mathops.Evaluate(mode, n.Value, args...)
 }
@@ -0,0 +1,52 @@
+package calculator
+
+import (
+	"calc-service/pkg/mathops"
+	"testing"
+)
+
+func TestAggregateResultsShared(t *testing.T) {
+	// (1+2)*(1+2)+(1+2): одна задача 1+2 и две задачи, ссылающиеся на нее
+	_, tasks := sharedTasks(t, "(1+2)*(1+2)+(1+2)")
+	if len(tasks) != 3 {
+		t.Fatalf("got %d tasks, want 3", len(tasks))
+	}
+	for i, result := range []string{"3", "9", "12"} {
+		tasks[i].Mode = mathops.ModeFloat
+		tasks[i].Completed = true
+		tasks[i].ResultExact = result
+		tasks[i].Result = mathops.ToFloat(result)
+	}
+
+	result, err := AggregateResults(tasks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != "12" {
+		t.Errorf("got %s, want 12", result)
+	}
+}
+
+func TestBuildTreeShared(t *testing.T) {
+	_, tasks := sharedTasks(t, "(1+2)*(1+2)+(1+2)")
+
+	root, err := BuildTree(tasks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if root.TaskID != tasks[len(tasks)-1].ID {
+		t.Fatalf("root is task %s, want the last task %s", root.TaskID, tasks[len(tasks)-1].ID)
+	}
+	if got := treeString(root); got != "(+ (* (+ 1 2) (+ 1 2)) (+ 1 2))" {
+		t.Errorf("got %s", got)
+	}
+
+	// общая задача восстанавливается одним узлом у всех родителей
+	product, sum := root.Left, root.Right
+	if product.Left != sum || product.Right != sum {
+		t.Error("the task of 1+2 should be a single node shared by * and +")
+	}
+	if sum.TaskID != tasks[0].ID {
+		t.Errorf("shared node has task %s, want %s", sum.TaskID, tasks[0].ID)
+	}
+}
@@ -3,44 +3,75 @@ package calculator
 import (
 	"calc-service/internal/store"
 	"calc-service/pkg/logger"
+	"calc-service/pkg/mathops"
 	"fmt"
-	"strings"
+	"os"
 )
 
-// ProcessExpression processes a mathematical expression and returns the expression object
-func ProcessExpression(exprStr string, userID string) (*store.Expression, error) {
-	//logger.Info("Processing expression: %s (user: %s)", exprStr, userID)
+// Division behaviours of "/" in integer mode
+const (
+	DivisionExact    = "exact"    // ошибка, если деление не нацело
+	DivisionTruncate = "truncate" // отбрасывание дробной части
+)
 
-	exprStr = strings.ReplaceAll(exprStr, " ", "")
-	if err := ValidateExpression(exprStr); err != nil {
-		logger.Error("ProcessExpression: Validation error: %v", err)
-		return nil, err
-	}
+// Options tune how an expression is calculated
+type Options struct {
+	// Mode is the numeric mode: mathops.ModeFloat (default), mathops.ModeDecimal or mathops.ModeInteger
+	Mode string
+	// Division selects how "/" behaves in integer mode: DivisionExact (default) or DivisionTruncate
+	Division string
+	// Fold is the folding policy: FoldNone, FoldCheap or FoldAll; FOLD_POLICY sets the default
+	Fold string
+	// Syntax is the notation of the input: SyntaxInfix (default), SyntaxRPN or SyntaxSExpr
+	Syntax string
+	// Rebalance regroups chains of "+" and "*" to shorten the longest chain of
+	// dependent tasks; only in decimal mode, where regrouping can't change the
+	// result: in float mode it changes rounding and overflows, in integer mode
+	// an intermediate sum may overflow
+	Rebalance bool
+}
 
-	tokens, err := tokenize(exprStr)
-	if err != nil {
-		logger.Error("ProcessExpression: Tokenization failed: %v", err)
-		return nil, err
-	}
+// compiled is an expression prepared for task generation
+type compiled struct {
+	canonical      string // каноническая запись выражения
+	tree           *Node
+	depth          int        // глубина дерева до оптимизаций
+	optimizedDepth int        // глубина дерева, по которому создаются задачи
+	bindings       []*binding // имена, связанные инструкциями сценария
+}
 
-	tree, err := buildExpressionTree(tokens)
+// ProcessExpression processes a mathematical expression and returns the expression object
+func ProcessExpression(exprStr string, userID string, opts Options) (*store.Expression, error) {
+	//logger.Info("Processing expression: %s (user: %s)", exprStr, userID)
+
+	c, err := compile(exprStr, userID, &opts)
 	if err != nil {
-		logger.Error("ProcessExpression: Expression tree build failed: %v", err)
 		return nil, err
 	}
+	tree := c.tree
 
-	expr, err := store.NewExpression(exprStr, userID)
+	expr, err := store.NewExpression(c.canonical, userID, opts.Mode, c.depth, c.optimizedDepth)
 	if err != nil {
 		logger.Error("ProcessExpression: Failed to create expression record: %v", err)
 		return nil, fmt.Errorf("failed to create expression record: %w", err)
 	}
 	logger.Info("ProcessExpression: Created expression: %s", expr.ID)
 
-	tasks, err := createTasksFromTree(expr.ID, tree)
+	tasks, bindings, err := createScriptTasks(expr.ID, c)
 	if err != nil {
 		logger.Error("Task generation failed: %v", err)
 		return nil, err
 	}
+	if len(bindings) > 0 {
+		if err := store.SetExpressionBindings(expr.ID, bindings); err != nil {
+			logger.Error("ProcessExpression: Failed to store bindings: %v", err)
+			return nil, fmt.Errorf("failed to store bindings: %w", err)
+		}
+		expr.Bindings = bindings
+	}
+	for _, task := range tasks {
+		task.Mode = opts.Mode
+	}
 	logger.Info("ProcessExpression: Generated %d tasks for expression %s", len(tasks), expr.ID)
 
 	if err := store.RegisterTasks(expr.ID, userID, tasks); err != nil {
@@ -48,6 +79,43 @@ func ProcessExpression(exprStr string, userID string) (*store.Expression, error)
 		return nil, fmt.Errorf("failed to register tasks: %w", err)
 	}
 
+	// вектор или матрица: оркестратор соберет результат из значений элементов
+	if tree.Kind == ListNode {
+		expr.Matrix = newMatrix(tree)
+		if len(tasks) == 0 {
+			if expr.Matrix.Result, err = MatrixValues(expr.Matrix, opts.Mode); err != nil {
+				return nil, err
+			}
+			expr.Status = "completed"
+			if err := store.CompleteMatrixExpression(expr.ID, expr.Matrix); err != nil {
+				logger.Error("ProcessExpression: Failed to complete literal matrix: %v", err)
+				return nil, err
+			}
+			return expr, nil
+		}
+		if err := store.SetExpressionMatrix(expr.ID, expr.Matrix); err != nil {
+			logger.Error("ProcessExpression: Failed to store matrix: %v", err)
+			return nil, fmt.Errorf("failed to store matrix: %w", err)
+		}
+	}
+
+	// Выражение без операций (например, "-3") вычислять агентам нечего
+	if len(tasks) == 0 {
+		value, err := mathops.Normalize(opts.Mode, tree.Value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid operand: %s", tree.Value)
+		}
+		if err := store.UpdateExpressionStatus(expr.ID, "completed", mathops.ToFloat(value), value); err != nil {
+			logger.Error("ProcessExpression: Failed to complete literal expression: %v", err)
+			return nil, err
+		}
+		expr.Status = "completed"
+		expr.Result = mathops.ToFloat(value)
+		expr.ResultExact = value
+		logger.Info("ProcessExpression: Expression %s is a literal, completed immediately", expr.ID)
+		return expr, nil
+	}
+
 	// Проверяем наличие выполнимых задач (задач без зависимостей)
 	executableTasks, err := store.GetExecutableTasks(expr.ID, userID)
 	if err != nil {
@@ -65,3 +133,150 @@ func ProcessExpression(exprStr string, userID string) (*store.Expression, error)
 	logger.Info("ProcessExpression: Expression %s processed successfully", expr.ID)
 	return expr, nil
 }
+
+// normalize fills in the defaults and validates the options
+func (opts *Options) normalize() error {
+	if opts.Mode == "" {
+		opts.Mode = mathops.ModeFloat
+	}
+	if !mathops.IsMode(opts.Mode) {
+		return fmt.Errorf("unknown mode %q", opts.Mode)
+	}
+	switch opts.Division {
+	case "":
+		opts.Division = DivisionExact
+	case DivisionExact, DivisionTruncate:
+		if opts.Mode != mathops.ModeInteger {
+			return fmt.Errorf("division option is only supported in integer mode")
+		}
+	default:
+		return fmt.Errorf("unknown division %q", opts.Division)
+	}
+	if opts.Rebalance && opts.Mode != mathops.ModeDecimal {
+		return fmt.Errorf("rebalance option is only supported in decimal mode")
+	}
+	if opts.Syntax == "" {
+		opts.Syntax = SyntaxInfix
+	}
+	if !isSyntax(opts.Syntax) {
+		return fmt.Errorf("unknown syntax %q", opts.Syntax)
+	}
+	if opts.Fold == "" {
+		opts.Fold = os.Getenv("FOLD_POLICY")
+	}
+	if opts.Fold == "" {
+		opts.Fold = FoldNone
+	}
+	if !isFoldPolicy(opts.Fold) {
+		return fmt.Errorf("unknown fold policy %q", opts.Fold)
+	}
+	return nil
+}
+
+// compile turns the expression (or a script of statements) into its canonical
+// text and a tree ready for task generation; nothing is written to the store
+func compile(exprStr string, userID string, opts *Options) (*compiled, error) {
+	if err := opts.normalize(); err != nil {
+		return nil, err
+	}
+
+	statements, canonical, err := parseSource(exprStr, opts.Syntax)
+	if err != nil {
+		logger.Error("Parsing failed: %v", err)
+		return nil, annotate(exprStr, err)
+	}
+
+	// инструкции сценария обрабатываются по порядку; имена, связанные раньше, видны следующим
+	c := &compiled{canonical: canonical}
+	bound := newScope()
+	functions := newExpander(userID)
+	for i, st := range statements {
+		last := i == len(statements)-1
+		if st.Name != "" {
+			if err := bound.define(st); err != nil {
+				logger.Error("Binding failed: %v", err)
+				return nil, annotate(exprStr, err)
+			}
+		}
+
+		tree := st.Tree
+		var d, od int
+		if value, ok := bound.operation(tree); ok {
+			// инструкция — только имя уже вычисляемой привязки
+			tree, d, od = value, bound.depth[tree.Value], bound.optimizedDepth[tree.Value]
+		} else if tree, d, od, err = prepare(tree, userID, opts, bound, functions, last); err != nil {
+			return nil, annotate(exprStr, err)
+		}
+
+		if st.Name != "" {
+			bound.bind(st.Name, tree, d, od)
+		}
+		// вычисляются все инструкции, поэтому глубина сценария — наибольшая из них
+		c.depth = max(c.depth, d)
+		c.optimizedDepth = max(c.optimizedDepth, od)
+		if last {
+			c.tree = tree
+		}
+	}
+	c.bindings = bound.bindings
+
+	// одинаковые подвыражения вычисляются одной задачей, в том числе в разных инструкциях
+	roots := []**Node{&c.tree}
+	for _, b := range c.bindings {
+		roots = append(roots, &b.node)
+	}
+	eliminateCommonSubexpressions(roots...)
+	return c, nil
+}
+
+// prepare inlines the user functions of a statement, expands its vector and
+// matrix arithmetic into scalar operations, splits its aggregates into
+// reductions, resolves its names and references, checks it against the
+// mode and optimizes it; it returns the tree with the depths before and after
+// optimization
+func prepare(tree *Node, userID string, opts *Options, bound *scope, functions *expander, last bool) (*Node, int, int, error) {
+	tree, err := functions.expand(tree)
+	if err != nil {
+		logger.Error("Function expansion failed: %v", err)
+		return nil, 0, 0, err
+	}
+	if tree, err = expandMatrices(tree, bound); err != nil {
+		logger.Error("Matrix expansion failed: %v", err)
+		return nil, 0, 0, err
+	}
+	tree = planReductions(tree)
+
+	d := depth(tree, bound.depth)
+	tree = bound.substitute(tree)
+
+	if err := resolveIdentifiers(tree, userID, bound.nodes); err != nil {
+		logger.Error("Identifier resolution failed: %v", err)
+		return nil, 0, 0, err
+	}
+
+	if err := resolveReferences(tree, userID); err != nil {
+		logger.Error("Reference resolution failed: %v", err)
+		return nil, 0, 0, err
+	}
+
+	if err := applyMode(tree, *opts); err != nil {
+		logger.Error("Mode check failed: %v", err)
+		return nil, 0, 0, err
+	}
+
+	// Выражение из одной ссылки на еще не вычисленное выражение: нужна задача, которая дождется его результата
+	if last && tree.Kind == TaskRefNode {
+		tree = identity(tree)
+		d = 1
+	}
+
+	// простые операции над числами вычисляем сразу, не создавая задач
+	foldConstants(tree, *opts)
+	tree = selectBranches(tree)
+	if opts.Rebalance {
+		tree, _ = rebalance(tree, bound.optimizedDepth)
+	}
+	od := depth(tree, bound.optimizedDepth)
+
+	return bound.link(tree), d, od, nil
+}
@@ -0,0 +1,104 @@
+package calculator
+
+import (
+	"calc-service/internal/store"
+	"calc-service/pkg/mathops"
+	"slices"
+)
+
+// isConditional reports whether n is a call of if(cond, a, b)
+func isConditional(n *Node) bool {
+	return n.Kind == CallNode && n.Value == "if"
+}
+
+// selectBranches replaces conditionals whose condition is already a number
+// with the branch it selects; the other branch is dropped without creating
+// its tasks. It runs regardless of the folding policy, since a conditional
+// never evaluates the branch it does not take
+func selectBranches(n *Node) *Node {
+	for _, slot := range n.operandSlots() {
+		*slot = selectBranches(*slot)
+	}
+	if !isConditional(n) || !isLiteral(n.Args[0]) {
+		return n
+	}
+	if mathops.IsTrue(n.Args[0].Value) {
+		return n.Args[1]
+	}
+	return n.Args[2]
+}
+
+// guard is a branch of a conditional: the task computing the condition and
+// the truth value selecting the branch
+type guard struct {
+	cond  string
+	value bool
+}
+
+// assignGuards marks the tasks needed only by one branch of a conditional:
+// such a task waits for the condition and is cancelled if the other branch is
+// taken. A task needed in several places is guarded by the innermost branch
+// enclosing all of them; a task needed outside any conditional is not guarded.
+// Nested conditionals need only the innermost guard: the tasks of a cancelled
+// condition cancel the tasks guarded by it in turn
+func assignGuards(roots []*Node, tasks []*store.Task) {
+	// узлы в топологическом порядке: родители раньше детей
+	var order []*Node
+	visited := make(map[*Node]bool)
+	var visit func(n *Node)
+	visit = func(n *Node) {
+		if visited[n] || !isOperation(n) {
+			return
+		}
+		visited[n] = true
+		for _, child := range n.Operands() {
+			visit(child)
+		}
+		order = append(order, n)
+	}
+	for _, root := range roots {
+		visit(root)
+	}
+	slices.Reverse(order)
+
+	// путь ветвей от корня до узла; у общего узла — общее начало путей всех его родителей
+	paths := make(map[*Node][]guard)
+	for _, root := range roots {
+		paths[root] = []guard{}
+	}
+	for _, n := range order {
+		path := paths[n]
+		for i, child := range n.Operands() {
+			if !isOperation(child) {
+				continue
+			}
+			childPath := path
+			if isConditional(n) && i > 0 {
+				childPath = append(slices.Clip(path), guard{cond: n.Args[0].TaskID, value: i == 1})
+			}
+			if prev, ok := paths[child]; ok {
+				childPath = commonPrefix(prev, childPath)
+			}
+			paths[child] = childPath
+		}
+	}
+
+	byID := make(map[string]*store.Task, len(tasks))
+	for _, task := range tasks {
+		byID[task.ID] = task
+	}
+	for n, path := range paths {
+		if task, ok := byID[n.TaskID]; ok && len(path) > 0 {
+			task.Guard = path[len(path)-1].cond
+			task.GuardValue = path[len(path)-1].value
+		}
+	}
+}
+
+func commonPrefix(a, b []guard) []guard {
+	n := 0
+	for n < len(a) && n < len(b) && a[n] == b[n] {
+		n++
+	}
+	return a[:n]
+}
@@ -0,0 +1,59 @@
+package calculator
+
+import "testing"
+
+func TestSelectBranches(t *testing.T) {
+	tests := []struct {
+		expr string
+		want string
+	}{
+		// условие уже известно: вторая ветвь отбрасывается без задач
+		{"if(1, 2*3, 4*4)", "(* 2 3)"},
+		{"if(0, 2*3, 4*4)", "(* 4 4)"},
+		{"if(0, 1, if(2, 3, 4)) + 1", "(+ 3 1)"},
+		// условие вычисляется задачей: выбирать пока нечего
+		{"if(1 < 2, 3, 4)", "(if (< 1 2) 3 4)"},
+	}
+
+	for _, tt := range tests {
+		statements, err := parseExpression(tt.expr)
+		if err != nil {
+			t.Fatalf("%q: %v", tt.expr, err)
+		}
+		if got := treeString(selectBranches(statements[0].Tree)); got != tt.want {
+			t.Errorf("%q: got %s, want %s", tt.expr, got, tt.want)
+		}
+	}
+}
+
+func TestAssignGuards(t *testing.T) {
+	tasks, _ := scriptTasks(t, "if(1 < 2, if(3 < 4, 1*2, 3*3), 4*4) + 1")
+
+	byOperator := make(map[string][]int)
+	for i, task := range tasks {
+		byOperator[task.Operator] = append(byOperator[task.Operator], i)
+	}
+	outer, inner := tasks[byOperator["<"][0]], tasks[byOperator["<"][1]]
+	guards := []struct {
+		task  int
+		guard string
+		value bool
+	}{
+		// внутреннее условие нужно только в ветви «истина» внешнего
+		{byOperator["<"][1], outer.ID, true},
+		{byOperator["if"][0], outer.ID, true},
+		{byOperator["*"][0], inner.ID, true},
+		{byOperator["*"][1], inner.ID, false},
+		{byOperator["*"][2], outer.ID, false},
+		// внешнее условие и то, что вне условного выражения, нужны всегда
+		{byOperator["<"][0], "", false},
+		{byOperator["if"][1], "", false},
+		{byOperator["+"][0], "", false},
+	}
+	for _, g := range guards {
+		task := tasks[g.task]
+		if task.Guard != g.guard || task.GuardValue != g.value {
+			t.Errorf("task %d (%s): got guard %q=%v, want %q=%v", g.task, task.Operator, task.Guard, task.GuardValue, g.guard, g.value)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package calculator
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// Syntax error codes reported to API clients
+const (
+	CodeEmptyExpression       = "empty_expression"
+	CodeInvalidCharacter      = "invalid_character"
+	CodeInvalidNumber         = "invalid_number"
+	CodeInvalidOperand        = "invalid_operand"
+	CodeInvalidReference      = "invalid_reference"
+	CodeUnknownFunction       = "unknown_function"
+	CodeUnknownIdentifier     = "unknown_identifier"
+	CodeUnknownReference      = "unknown_reference"
+	CodeUnbalancedParentheses = "unbalanced_parentheses"
+	CodeUnexpectedToken       = "unexpected_token"
+	CodeUnexpectedEnd         = "unexpected_end"
+	CodeInvalidArguments      = "invalid_arguments"
+	CodeUnsupportedOperation  = "unsupported_operation"
+	CodeInvalidBinding        = "invalid_binding"
+	CodeInvalidFunction       = "invalid_function"
+	CodeRecursiveFunction     = "recursive_function"
+	CodeExpansionTooLarge     = "expansion_too_large"
+	CodeInvalidList           = "invalid_list"
+	CodeShapeMismatch         = "shape_mismatch"
+)
+
+// snippetRadius is how many characters around the error are kept in the snippet
+const snippetRadius = 30
+
+// SyntaxError describes an invalid expression and points at the offending token
+type SyntaxError struct {
+	Code    string // один из Code*
+	Message string
+	Offset  int    // смещение в байтах в исходном выражении
+	Token   string // токен, на котором обнаружена ошибка (пустой в конце выражения)
+	Snippet string // фрагмент выражения и строка с "^" под токеном
+
+	end int // конец токена; Token и Snippet заполняет annotate
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("%s at position %d", e.Message, e.Offset)
+}
+
+// syntaxError creates a SyntaxError for the source range span; the token and
+// the snippet are filled in by annotate once the error reaches the code that
+// knows the whole expression
+func syntaxError(code string, span Span, format string, args ...any) *SyntaxError {
+	return &SyntaxError{Code: code, Message: fmt.Sprintf(format, args...), Offset: span.Start, end: span.End}
+}
+
+// annotate adds the offending token and the caret snippet to a SyntaxError raised while processing expr
+func annotate(expr string, err error) error {
+	var syntaxErr *SyntaxError
+	if errors.As(err, &syntaxErr) && syntaxErr.Snippet == "" {
+		start := min(syntaxErr.Offset, len(expr))
+		end := min(max(syntaxErr.end, start), len(expr))
+		syntaxErr.Token = expr[start:end]
+		syntaxErr.Snippet = caretSnippet(expr, start, end)
+	}
+	return err
+}
+
+// caretSnippet renders the part of expr around [start, end) with carets under it:
+//
+//	2 + * 3
+//	    ^
+func caretSnippet(expr string, start, end int) string {
+
+	// обрезаем длинные выражения по границам символов
+	from := start
+	for n := 0; from > 0 && n < snippetRadius; n++ {
+		_, size := utf8.DecodeLastRuneInString(expr[:from])
+		from -= size
+	}
+	to := end
+	for n := 0; to < len(expr) && n < snippetRadius; n++ {
+		_, size := utf8.DecodeRuneInString(expr[to:])
+		to += size
+	}
+
+	prefix, suffix := "", ""
+	if from > 0 {
+		prefix = "..."
+	}
+	if to < len(expr) {
+		suffix = "..."
+	}
+
+	width := utf8.RuneCountInString(expr[start:end])
+	if width == 0 {
+		width = 1
+	}
+	line := prefix + expr[from:to] + suffix
+	caret := strings.Repeat(" ", len(prefix)+utf8.RuneCountInString(expr[from:start])) + strings.Repeat("^", width)
+	return line + "\n" + caret
+}
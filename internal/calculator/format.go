@@ -0,0 +1,140 @@
+package calculator
+
+import "strings"
+
+// atomPrecedence is the precedence of nodes that never need parentheses
+const atomPrecedence = 100
+
+// nodePrecedence returns how tight the node binds when printed: negative
+// numbers print like a unary minus and fractions ("1/3") like a division
+func nodePrecedence(n *Node) int {
+	switch n.Kind {
+	case NumberNode:
+		switch {
+		case strings.HasPrefix(n.Value, "-"):
+			return precedence("neg")
+		case strings.Contains(n.Value, "/"):
+			return precedence("/")
+		}
+	case UnaryNode, BinaryNode:
+		if p := precedence(n.Value); p > 0 {
+			return p
+		}
+	}
+	return atomPrecedence
+}
+
+// isSigned reports whether the node is a prefix operation: a unary operator or
+// a negative number
+func isSigned(n *Node) bool {
+	return n.Kind == UnaryNode || (n.Kind == NumberNode && strings.HasPrefix(n.Value, "-"))
+}
+
+// leadingSign returns the sign the node prints with, "-" or "!", looking down
+// the left operands to the leftmost one unless it is in parentheses
+func leadingSign(n *Node) string {
+	switch {
+	case n.Kind == UnaryNode:
+		return unarySymbols[n.Value]
+	case isSigned(n):
+		return "-"
+	case n.Kind == BinaryNode && precedence(n.Value) > 0 && !operandParens(n, n.Left, false):
+		return leadingSign(n.Left)
+	}
+	return ""
+}
+
+// operandParens reports whether an operand of n needs parentheses to keep
+// the tree when printed; right tells the right operand of a binary operator.
+// A prefix operation is parsed as an operand in any position, so it needs
+// them only not to put a minus next to a plus or a minus: "3-(-2)", "-(-x)",
+// but "2^-1" and "1<2&&!0"
+func operandParens(n, operand *Node, right bool) bool {
+	p, q := precedence(n.Value), nodePrecedence(operand)
+	if n.Kind == UnaryNode || right {
+		clash := leadingSign(operand) == "-" && (n.Value == "neg" || n.Value == "+" || n.Value == "-")
+		if isSigned(operand) {
+			return clash
+		}
+		if n.Kind == UnaryNode {
+			return q < p || clash
+		}
+		return q < p || (q == p && !isRightAssociative(n.Value)) || clash
+	}
+	return q < p || (q == p && isRightAssociative(n.Value))
+}
+
+// formatScript renders the statements of a script as "name=expression;expression"
+func formatScript(statements []*statement) string {
+	var sb strings.Builder
+	for i, st := range statements {
+		if i > 0 {
+			sb.WriteString(";")
+		}
+		if st.Name != "" {
+			sb.WriteString(st.Name + "=")
+		}
+		writeNode(&sb, st.Tree)
+	}
+	return sb.String()
+}
+
+// formatNode renders the tree as a canonical expression: without spaces, with
+// canonical literals and only the parentheses the parser needs to restore the
+// same tree. Internal operators without a symbol ("quo", "mean") print as calls
+func formatNode(n *Node) string {
+	var sb strings.Builder
+	writeNode(&sb, n)
+	return sb.String()
+}
+
+func writeNode(sb *strings.Builder, n *Node) {
+	switch n.Kind {
+	case ReferenceNode:
+		sb.WriteString("$" + n.Value)
+	case UnaryNode:
+		sb.WriteString(unarySymbols[n.Value])
+		writeOperand(sb, n.Left, operandParens(n, n.Left, false))
+	case BinaryNode:
+		if precedence(n.Value) == 0 {
+			writeCall(sb, n.Value, n.Operands())
+			return
+		}
+		writeOperand(sb, n.Left, operandParens(n, n.Left, false))
+		sb.WriteString(n.Value)
+		writeOperand(sb, n.Right, operandParens(n, n.Right, true))
+	case CallNode:
+		writeCall(sb, n.Value, n.Args)
+	case ListNode:
+		sb.WriteString("[")
+		writeList(sb, n.Args)
+		sb.WriteString("]")
+	default:
+		sb.WriteString(n.Value)
+	}
+}
+
+func writeOperand(sb *strings.Builder, n *Node, parens bool) {
+	if parens {
+		sb.WriteString("(")
+	}
+	writeNode(sb, n)
+	if parens {
+		sb.WriteString(")")
+	}
+}
+
+func writeCall(sb *strings.Builder, name string, args []*Node) {
+	sb.WriteString(name + "(")
+	writeList(sb, args)
+	sb.WriteString(")")
+}
+
+func writeList(sb *strings.Builder, values []*Node) {
+	for i, value := range values {
+		if i > 0 {
+			sb.WriteString(",")
+		}
+		writeNode(sb, value)
+	}
+}
@@ -0,0 +1,92 @@
+package calculator
+
+import "testing"
+
+func TestFormatCanonical(t *testing.T) {
+	tests := []struct {
+		expr string
+		want string
+	}{
+		{"1 + 2 * 3", "1+2*3"},
+		{"(1 + 2) * 3", "(1+2)*3"},
+		{"1 - (2 - 3)", "1-(2-3)"},
+		{"(1 - 2) - 3", "1-2-3"},
+		{"2 ^ 3 ^ 2", "2^3^2"},
+		{"(2 ^ 3) ^ 2", "(2^3)^2"},
+		{"-2 ^ 2", "-2^2"},
+		{"(-2) ^ 2", "(-2)^2"},
+		{"-(a * b)", "-(a*b)"},
+		{"-a * b", "-a*b"},
+		// знак после плюса или минуса — в скобках, после остальных операторов — без них
+		{"3 - -2", "3-(-2)"},
+		{"3 + -2", "3+(-2)"},
+		{"3 - -3*x", "3-(-3*x)"},
+		{"a - (-b)^2", "a-(-b)^2"},
+		{"--x", "-(-x)"},
+		{"2 ^ (-1)", "2^-1"},
+		{"2 ^ -x ^ 2", "2^-x^2"},
+		{"(2 ^ -x) * y", "2^-x*y"},
+		{"2 ^ (-3*x)", "2^(-3*x)"},
+		{"2 * -x", "2*-x"},
+		{"a / -b", "a/-b"},
+		{"+a * +(b + 1)", "a*(b+1)"},
+		{"1 < 2 && (!0)", "1<2&&!0"},
+		{"!!x", "!!x"},
+		{"!(1 < 2)", "!(1<2)"},
+		{"a < -1", "a<-1"},
+		{"max(1, -2) + [1, 2]", "max(1,-2)+[1,2]"},
+		{"x = -1; 3 - -x", "x=-1;3-(-x)"},
+	}
+
+	for _, tt := range tests {
+		statements, err := parseExpression(tt.expr)
+		if err != nil {
+			t.Errorf("%q: %v", tt.expr, err)
+			continue
+		}
+		got := formatScript(statements)
+		if got != tt.want {
+			t.Errorf("%q: got %q, want %q", tt.expr, got, tt.want)
+			continue
+		}
+
+		// каноническая запись разбирается в то же дерево
+		again, err := parseExpression(got)
+		if err != nil {
+			t.Errorf("%q: canonical form %q does not parse: %v", tt.expr, got, err)
+			continue
+		}
+		for i := range statements {
+			if treeString(again[i].Tree) != treeString(statements[i].Tree) {
+				t.Errorf("%q: canonical form %q parses into %s, want %s",
+					tt.expr, got, treeString(again[i].Tree), treeString(statements[i].Tree))
+			}
+		}
+	}
+}
+
+func TestRender(t *testing.T) {
+	tests := []struct {
+		expr   string
+		format string
+		want   string
+	}{
+		{"1 + 2*3", FormatText, "1+2*3"},
+		{"(1 + 2) * 3", FormatLaTeX, `\left(1+2\right) \cdot 3`},
+		{"3 - -3*x", FormatLaTeX, `3-\left(-3 \cdot x\right)`},
+		{"2 ^ (-1)", FormatLaTeX, `{2}^{-1}`},
+		{"1 < 2 && !0", FormatLaTeX, `1 < 2 \land \lnot 0`},
+		{"sqrt(x) / 2", FormatLaTeX, `\frac{\sqrt{x}}{2}`},
+		{"x + 1", FormatMathML, `<math xmlns="http://www.w3.org/1998/Math/MathML" display="block"><mrow><mrow><mi>x</mi><mo>+</mo><mn>1</mn></mrow></mrow></math>`},
+	}
+	for _, tt := range tests {
+		got, err := Render(tt.expr, tt.format)
+		if err != nil {
+			t.Errorf("%q: %v", tt.expr, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%q: got %q, want %q", tt.expr, got, tt.want)
+		}
+	}
+}
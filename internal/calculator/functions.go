@@ -0,0 +1,300 @@
+package calculator
+
+import (
+	"calc-service/internal/store"
+	"calc-service/pkg/mathops"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// defaultMaxExpansion is how many nodes inlining of user functions may add to
+// an expression unless FUNCTION_MAX_EXPANSION is set; it keeps definitions
+// like g(x) = f(x)+f(x), h(x) = g(x)+g(x), ... from producing huge task trees
+const defaultMaxExpansion = 1000
+
+func maxExpansion() int {
+	n, err := strconv.Atoi(os.Getenv("FUNCTION_MAX_EXPANSION"))
+	if err != nil || n < 1 {
+		return defaultMaxExpansion
+	}
+	return n
+}
+
+// FunctionDefinition is a parsed definition of a user function
+type FunctionDefinition struct {
+	Name   string
+	Params []string
+	Body   string // каноническая запись тела
+
+	tree *Node
+}
+
+// ParseFunction parses a definition like "f(x, y) = x*x + y" with the
+// expression parser. The body may use the parameters, constants, built-in
+// functions and other functions of the user; every function it calls must
+// exist, and the definition must not make any function recursive.
+// Invalid definitions are reported as *SyntaxError
+func ParseFunction(definition string, userID string) (*FunctionDefinition, error) {
+	fn, err := parseDefinition(definition)
+	if err != nil {
+		return nil, annotate(definition, err)
+	}
+
+	// новое определение заменяет прежнее с тем же именем, в том числе для функций, которые его вызывают
+	e := newExpander(userID)
+	if err := e.load(); err != nil {
+		return nil, err
+	}
+	e.functions[fn.Name] = &store.Function{Name: fn.Name, Params: fn.Params, Body: fn.Body}
+	e.stack = []string{fn.Name}
+	if _, err := e.expand(fn.tree); err != nil {
+		return nil, annotate(definition, err)
+	}
+	return fn, nil
+}
+
+// parseDefinition splits a definition into the name, the parameters and the body
+func parseDefinition(definition string) (*FunctionDefinition, error) {
+	tokens, err := tokenize(definition)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, syntaxError(CodeEmptyExpression, Span{0, 0}, "function definition cannot be empty")
+	}
+	if tokens[0].type_ != function {
+		return nil, syntaxError(CodeInvalidFunction, tokens[0].span(), "definition must start with the function name and its parameters, e.g. f(x) = x*x")
+	}
+	fn := &FunctionDefinition{Name: tokens[0].value}
+	if mathops.IsFunction(fn.Name) {
+		return nil, syntaxError(CodeInvalidFunction, tokens[0].span(), "%s is a built-in function", fn.Name)
+	}
+	if _, ok := constants[fn.Name]; ok {
+		return nil, syntaxError(CodeInvalidFunction, tokens[0].span(), "%s is a built-in constant", fn.Name)
+	}
+
+	// tokenize гарантирует, что за именем функции следует "("
+	i := 2
+	for {
+		if i >= len(tokens) {
+			return nil, syntaxError(CodeUnexpectedEnd, Span{len(definition), len(definition)}, "unexpected end of definition")
+		}
+		t := tokens[i]
+		if t.type_ == rightParen && len(fn.Params) == 0 {
+			return nil, syntaxError(CodeInvalidFunction, t.span(), "function must have at least one parameter")
+		}
+		if t.type_ != identifier {
+			return nil, syntaxError(CodeInvalidFunction, t.span(), "expected parameter name")
+		}
+		if _, ok := constants[t.value]; ok {
+			return nil, syntaxError(CodeInvalidFunction, t.span(), "cannot use constant %s as a parameter", t.value)
+		}
+		if slices.Contains(fn.Params, t.value) {
+			return nil, syntaxError(CodeInvalidFunction, t.span(), "duplicate parameter %s", t.value)
+		}
+		fn.Params = append(fn.Params, t.value)
+
+		i++
+		if i < len(tokens) && tokens[i].type_ == comma {
+			i++
+			continue
+		}
+		if i < len(tokens) && tokens[i].type_ == rightParen {
+			i++
+			break
+		}
+		if i < len(tokens) {
+			return nil, syntaxError(CodeUnexpectedToken, tokens[i].span(), "expected , or ) after parameter %s", t.value)
+		}
+	}
+	if i >= len(tokens) || tokens[i].type_ != assign {
+		span := Span{len(definition), len(definition)}
+		if i < len(tokens) {
+			span = tokens[i].span()
+		}
+		return nil, syntaxError(CodeInvalidFunction, span, "expected = after the parameters")
+	}
+
+	body := tokens[i+1:]
+	if len(body) == 0 {
+		return nil, syntaxError(CodeEmptyExpression, Span{len(definition), len(definition)}, "function body cannot be empty")
+	}
+	for _, t := range body {
+		if t.type_ == semicolon {
+			return nil, syntaxError(CodeInvalidFunction, t.span(), "function body must be a single expression")
+		}
+	}
+	statements, err := parse(body, len(definition))
+	if err != nil {
+		return nil, err
+	}
+	st := statements[0]
+	if st.Name != "" {
+		return nil, syntaxError(CodeInvalidFunction, st.NameSpan, "function body cannot bind names")
+	}
+
+	err = walk(st.Tree, func(n *Node) error {
+		switch n.Kind {
+		case IdentifierNode:
+			if _, ok := constants[n.Value]; !ok && !slices.Contains(fn.Params, n.Value) {
+				return syntaxError(CodeUnknownIdentifier, n.Span, "unknown parameter %s", n.Value)
+			}
+		case ReferenceNode:
+			return syntaxError(CodeInvalidReference, n.Span, "function body cannot refer to other expressions")
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	fn.Body = formatNode(st.Tree)
+	fn.tree = st.Tree
+	return fn, nil
+}
+
+// expander inlines calls of user functions: a call is replaced with a copy of
+// the body of the function where the parameters are replaced with copies of
+// the arguments. One expander serves a whole script, so the expansion limit
+// applies to the expression as a whole
+type expander struct {
+	userID    string
+	functions map[string]*store.Function // загружаются при первом вызове функции пользователя
+	bodies    map[string]*Node           // тела с уже подставленными вызовами других функций
+	stack     []string                   // функции, тела которых сейчас раскрываются
+	added     int
+	limit     int
+}
+
+func newExpander(userID string) *expander {
+	return &expander{userID: userID, bodies: make(map[string]*Node), limit: maxExpansion()}
+}
+
+// load reads the functions of the user once
+func (e *expander) load() error {
+	if e.functions != nil {
+		return nil
+	}
+	list, err := store.ListFunctions(e.userID)
+	if err != nil {
+		return fmt.Errorf("failed to load functions: %w", err)
+	}
+	e.functions = make(map[string]*store.Function, len(list))
+	for _, fn := range list {
+		e.functions[fn.Name] = fn
+	}
+	return nil
+}
+
+// expand replaces the calls of user functions in the tree, innermost first
+func (e *expander) expand(n *Node) (*Node, error) {
+	for _, slot := range n.operandSlots() {
+		child, err := e.expand(*slot)
+		if err != nil {
+			return nil, err
+		}
+		*slot = child
+	}
+	if n.Kind != CallNode || mathops.IsFunction(n.Value) {
+		return n, nil
+	}
+
+	if err := e.load(); err != nil {
+		return nil, err
+	}
+	fn, ok := e.functions[n.Value]
+	if !ok {
+		return nil, syntaxError(CodeUnknownFunction, Span{n.Span.Start, n.Span.Start + len(n.Value)}, "unknown function %s", n.Value)
+	}
+	if len(n.Args) != len(fn.Params) {
+		return nil, syntaxError(CodeInvalidArguments, Span{n.Span.Start, n.Span.Start + len(n.Value)},
+			"%s expects %d argument(s), got %d", fn.Name, len(fn.Params), len(n.Args))
+	}
+
+	body, err := e.body(fn)
+	if err != nil {
+		// позиция ошибки в теле другой функции ничего не скажет: указываем на вызов
+		var syntaxErr *SyntaxError
+		if errors.As(err, &syntaxErr) {
+			syntaxErr.Offset, syntaxErr.end = n.Span.Start, n.Span.End
+		}
+		return nil, err
+	}
+	args := make(map[string]*Node, len(fn.Params))
+	for i, param := range fn.Params {
+		args[param] = n.Args[i]
+	}
+	return e.instantiate(body, args, n.Span)
+}
+
+// body returns the body of fn with the calls of other functions already
+// inlined and the parameters left as names
+func (e *expander) body(fn *store.Function) (*Node, error) {
+	if body, ok := e.bodies[fn.Name]; ok {
+		return body, nil
+	}
+	if i := slices.Index(e.stack, fn.Name); i >= 0 {
+		cycle := append(slices.Clone(e.stack[i:]), fn.Name)
+		return nil, syntaxError(CodeRecursiveFunction, Span{}, "recursive function %s: %s", fn.Name, strings.Join(cycle, " -> "))
+	}
+
+	statements, err := parseExpression(fn.Body)
+	if err != nil {
+		return nil, fmt.Errorf("invalid body of function %s: %w", fn.Name, err)
+	}
+
+	e.stack = append(e.stack, fn.Name)
+	body, err := e.expand(statements[0].Tree)
+	e.stack = e.stack[:len(e.stack)-1]
+	if err != nil {
+		return nil, err
+	}
+	e.bodies[fn.Name] = body
+	return body, nil
+}
+
+// instantiate copies the body of a function for a call at span, replacing the
+// parameters with copies of the arguments, which keep their own position
+func (e *expander) instantiate(n *Node, args map[string]*Node, span Span) (*Node, error) {
+	return e.copy(n, args, span, false)
+}
+
+// copy copies the tree n counting the new nodes; the copies get the position
+// of the call unless keep is set
+func (e *expander) copy(n *Node, args map[string]*Node, span Span, keep bool) (*Node, error) {
+	if arg, ok := args[n.Value]; ok && n.Kind == IdentifierNode {
+		return e.copy(arg, nil, span, true)
+	}
+
+	e.added++
+	if e.added > e.limit {
+		return nil, syntaxError(CodeExpansionTooLarge, span, "expansion of user functions exceeds %d nodes", e.limit)
+	}
+	c := &Node{Kind: n.Kind, Value: n.Value, Span: span}
+	if keep {
+		c.Span = n.Span
+	}
+	var err error
+	if n.Left != nil {
+		if c.Left, err = e.copy(n.Left, args, span, keep); err != nil {
+			return nil, err
+		}
+	}
+	if n.Right != nil {
+		if c.Right, err = e.copy(n.Right, args, span, keep); err != nil {
+			return nil, err
+		}
+	}
+	for _, arg := range n.Args {
+		copied, err := e.copy(arg, args, span, keep)
+		if err != nil {
+			return nil, err
+		}
+		c.Args = append(c.Args, copied)
+	}
+	return c, nil
+}
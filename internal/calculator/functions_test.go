@@ -0,0 +1,120 @@
+package calculator
+
+import (
+	"calc-service/internal/store"
+	"calc-service/pkg/mathops"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestParseFunction(t *testing.T) {
+	fn, err := ParseFunction("f(x, y) = x * x + y", "user-functions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fn.Name != "f" || !reflect.DeepEqual(fn.Params, []string{"x", "y"}) || fn.Body != "x*x+y" {
+		t.Errorf("got %s(%v) = %s, want f([x y]) = x*x+y", fn.Name, fn.Params, fn.Body)
+	}
+}
+
+func TestParseFunctionErrors(t *testing.T) {
+	tests := []struct {
+		definition string
+		code       string
+	}{
+		{"", CodeEmptyExpression},
+		{"x = 1", CodeInvalidFunction},
+		{"sqrt(x) = x", CodeInvalidFunction},
+		{"pi(x) = x", CodeInvalidFunction},
+		{"f() = 1", CodeInvalidFunction},
+		{"f(x, x) = x", CodeInvalidFunction},
+		{"f(pi) = pi", CodeInvalidFunction},
+		{"f(x)", CodeInvalidFunction},
+		{"f(x) =", CodeEmptyExpression},
+		{"f(x) = y", CodeUnknownIdentifier},
+		{"f(x) = x; 1", CodeInvalidFunction},
+		{"f(x) = $1", CodeInvalidReference},
+		{"f(x) = g(x)", CodeUnknownFunction},
+		{"f(x) = f(x - 1)", CodeRecursiveFunction},
+	}
+
+	for _, tt := range tests {
+		_, err := ParseFunction(tt.definition, "user-functions")
+		var syntaxErr *SyntaxError
+		if !errors.As(err, &syntaxErr) {
+			t.Errorf("%q: got %v, want a syntax error", tt.definition, err)
+			continue
+		}
+		if syntaxErr.Code != tt.code {
+			t.Errorf("%q: got %s (%s), want %s", tt.definition, syntaxErr.Code, syntaxErr.Message, tt.code)
+		}
+	}
+}
+
+func TestFunctionRecursion(t *testing.T) {
+	const userID = "user-functions-recursion"
+	if _, err := store.SetFunction(userID, "f", []string{"x"}, "g(x)+1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.SetFunction(userID, "g", []string{"x"}, "x*2"); err != nil {
+		t.Fatal(err)
+	}
+
+	// g -> f -> g: новое определение g замыкает цикл через уже сохраненную f
+	_, err := ParseFunction("g(x) = f(x) * 2", userID)
+	var syntaxErr *SyntaxError
+	if !errors.As(err, &syntaxErr) || syntaxErr.Code != CodeRecursiveFunction {
+		t.Fatalf("got %v, want %s", err, CodeRecursiveFunction)
+	}
+	if syntaxErr.Message != "recursive function g: g -> f -> g" {
+		t.Errorf("got %q", syntaxErr.Message)
+	}
+
+	// определение, не замыкающее цикла, заменяет прежнее
+	if _, err := ParseFunction("g(x) = x^2", userID); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestFunctionExpansion(t *testing.T) {
+	const userID = "user-functions-expansion"
+	definitions := []struct {
+		name string
+		body string
+	}{
+		{"sq", "x*x"},
+		{"f1", "x+x"},
+		{"f2", "f1(x)+f1(x)"},
+		{"f3", "f2(x)+f2(x)"},
+		{"f4", "f3(x)+f3(x)"},
+	}
+	for _, d := range definitions {
+		if _, err := store.SetFunction(userID, d.name, []string{"x"}, d.body); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c, err := compile("sq(1+2)*2", userID, &Options{Mode: mathops.ModeFloat})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// аргумент подставляется копией, одинаковые копии снова общие
+	if got := treeString(c.tree); got != "(* (* (+ 1 2) (+ 1 2)) 2)" {
+		t.Errorf("got %s", got)
+	}
+	if c.tree.Left.Left != c.tree.Left.Right {
+		t.Error("both copies of the argument should share one task")
+	}
+
+	// раскрытие f4 превышает ограничение, f3 — нет
+	t.Setenv("FUNCTION_MAX_EXPANSION", "40")
+	_, err = compile("f4(1)", userID, &Options{Mode: mathops.ModeFloat})
+	var syntaxErr *SyntaxError
+	if !errors.As(err, &syntaxErr) || syntaxErr.Code != CodeExpansionTooLarge {
+		t.Errorf("got %v, want %s", err, CodeExpansionTooLarge)
+	}
+	if _, err := compile("f3(1)", userID, &Options{Mode: mathops.ModeFloat}); err != nil {
+		t.Errorf("f3(1): %v", err)
+	}
+}
@@ -0,0 +1,110 @@
+package calculator
+
+import (
+	"calc-service/pkg/mathops"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// maxLiteralExponent bounds the exponent of scientific literals, so that 1e999999999
+// can't make the exact conversion exhaust memory
+const maxLiteralExponent = 1000
+
+func isDigitByte(b byte) bool {
+	return b >= '0' && b <= '9'
+}
+
+func isHexDigitByte(b byte) bool {
+	return isDigitByte(b) || (b >= 'a' && b <= 'f') || (b >= 'A' && b <= 'F')
+}
+
+// hasRadixPrefix reports whether the literal is hexadecimal (0xFF) or binary (0b1010)
+func hasRadixPrefix(lit string) bool {
+	return len(lit) > 1 && lit[0] == '0' && strings.ContainsRune("xXbB", rune(lit[1]))
+}
+
+// scanNumber returns the end of the number literal starting at start: a decimal
+// with optional fraction and exponent (1.5e-3), hexadecimal (0xFF) or binary (0b1010);
+// "_" may separate digits (1_000_000)
+func scanNumber(s string, start int) int {
+	i := start
+	if hasRadixPrefix(s[start:]) {
+		i += 2
+		for i < len(s) && (isHexDigitByte(s[i]) || s[i] == '_') {
+			i++
+		}
+		return i
+	}
+
+	digits := func() {
+		for i < len(s) && (isDigitByte(s[i]) || s[i] == '_') {
+			i++
+		}
+	}
+	digits()
+	if i < len(s) && s[i] == '.' {
+		i++
+		digits()
+	}
+	if i < len(s) && (s[i] == 'e' || s[i] == 'E') {
+		j := i + 1
+		if j < len(s) && (s[j] == '+' || s[j] == '-') {
+			j++
+		}
+		if j < len(s) && isDigitByte(s[j]) {
+			i = j
+			digits()
+		}
+	}
+	return i
+}
+
+// readNumber scans the literal at start and returns it in canonical form with its end.
+// A literal directly followed by a letter or another dot ("2e", "1.2.3", "0x1g") is invalid.
+func readNumber(s string, start int) (string, int, error) {
+	end := scanNumber(s, start)
+	if end < len(s) && (isIdentifierByte(s[end]) || s[end] == '.') {
+		for end < len(s) && (isIdentifierByte(s[end]) || s[end] == '.') {
+			end++
+		}
+		return "", end, fmt.Errorf("invalid number literal: %s", s[start:end])
+	}
+	value, err := normalizeNumber(s[start:end])
+	return value, end, err
+}
+
+// normalizeNumber converts a literal into the canonical numeric string stored in tasks:
+// plain decimal notation without separators, e.g. 1e6 -> 1000000, 0xFF -> 255, 1_000.50 -> 1000.5
+func normalizeNumber(lit string) (string, error) {
+	if hasRadixPrefix(lit) {
+		// base 0 понимает префиксы 0x/0b и проверяет расстановку "_"
+		v, ok := new(big.Int).SetString(lit, 0)
+		if !ok {
+			return "", fmt.Errorf("invalid number literal: %s", lit)
+		}
+		return v.String(), nil
+	}
+
+	// "_" допустим только между цифрами
+	for k := 0; k < len(lit); k++ {
+		if lit[k] == '_' && (k == 0 || k == len(lit)-1 || !isDigitByte(lit[k-1]) || !isDigitByte(lit[k+1])) {
+			return "", fmt.Errorf("invalid digit separator in number literal: %s", lit)
+		}
+	}
+	plain := strings.ReplaceAll(lit, "_", "")
+
+	if k := strings.IndexAny(plain, "eE"); k >= 0 {
+		exp, err := strconv.Atoi(plain[k+1:])
+		if err != nil || exp > maxLiteralExponent || exp < -maxLiteralExponent {
+			return "", fmt.Errorf("number literal out of range: %s", lit)
+		}
+	}
+
+	r, ok := new(big.Rat).SetString(plain)
+	if !ok {
+		return "", fmt.Errorf("invalid number literal: %s", lit)
+	}
+	return mathops.FormatDecimal(r), nil
+}
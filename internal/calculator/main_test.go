@@ -0,0 +1,27 @@
+package calculator
+
+import (
+	"calc-service/pkg/database"
+	"calc-service/pkg/logger"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestMain поднимает временную базу: ссылки на выражения и переменные читаются из нее
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "calc-calculator-test")
+	if err != nil {
+		panic(err)
+	}
+	os.Setenv("DB_PATH", filepath.Join(dir, "test.db"))
+	logger.Init("fatal")
+	if err := database.InitDB(); err != nil {
+		panic(err)
+	}
+
+	code := m.Run()
+	database.CloseDB()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
@@ -0,0 +1,291 @@
+package calculator
+
+import (
+	"calc-service/internal/store"
+	"calc-service/pkg/mathops"
+	"slices"
+	"strconv"
+)
+
+// isList reports whether the node is a vector or a matrix
+func isList(n *Node) bool {
+	return n.Kind == ListNode
+}
+
+// isMatrix reports whether the node is a matrix, i.e. a list of rows
+func isMatrix(n *Node) bool {
+	return isList(n) && isList(n.Args[0])
+}
+
+// shapeOf returns the dimensions of a value: none for a number, the length of
+// a vector, the rows and the columns of a matrix
+func shapeOf(n *Node) []int {
+	switch {
+	case isMatrix(n):
+		return []int{len(n.Args), len(n.Args[0].Args)}
+	case isList(n):
+		return []int{len(n.Args)}
+	}
+	return nil
+}
+
+// shapeName describes the shape of a value in messages
+func shapeName(n *Node) string {
+	shape := shapeOf(n)
+	switch len(shape) {
+	case 1:
+		return "a vector of " + strconv.Itoa(shape[0])
+	case 2:
+		return "a " + strconv.Itoa(shape[0]) + "x" + strconv.Itoa(shape[1]) + " matrix"
+	}
+	return "a number"
+}
+
+// elements returns the scalar elements of a value in row-major order; a
+// number is its only element
+func elements(n *Node) []*Node {
+	if !isList(n) {
+		return []*Node{n}
+	}
+	var values []*Node
+	for _, arg := range n.Args {
+		values = append(values, elements(arg)...)
+	}
+	return values
+}
+
+// elementName is the name under which an element of a bound matrix is kept
+// in the scope: "A[2]" or "A[1,2]", counting from 1; such names can't be
+// written in an expression, so they never clash with the names of the user
+func elementName(name string, index ...int) string {
+	name += "["
+	for i, k := range index {
+		if i > 0 {
+			name += ","
+		}
+		name += strconv.Itoa(k + 1)
+	}
+	return name + "]"
+}
+
+// expandMatrices computes the vector and matrix arithmetic of the tree on the
+// trees of the elements, so that only scalar operations are left: the product
+// [[1,2],[3,4]]*[5,6] becomes the vector [1*5+2*6, 3*5+4*6], whose elements
+// are computed by independent tasks. The result is a number tree or a list of
+// such trees (a list of rows for a matrix). Vectors and matrices may be added,
+// subtracted, negated, multiplied and divided by a number; "*" of two vectors
+// is their dot product, of a matrix and a vector or of two matrices the matrix
+// product. The elements of vectors and matrices passed to aggregates, min and
+// max become their arguments. Names bound to matrices by earlier statements of
+// a script become lists of the names of their elements
+func expandMatrices(n *Node, bound *scope) (*Node, error) {
+	for _, slot := range n.operandSlots() {
+		child, err := expandMatrices(*slot, bound)
+		if err != nil {
+			return nil, err
+		}
+		*slot = child
+	}
+
+	switch n.Kind {
+	case IdentifierNode:
+		if v, ok := bound.nodes[n.Value]; ok && isList(v) {
+			return elementNames(n.Value, v, n.Span, nil), nil
+		}
+	case ListNode:
+		return n, checkList(n)
+	case UnaryNode:
+		if !isList(n.Left) {
+			return n, nil
+		}
+		if n.Value != "neg" {
+			return nil, syntaxError(CodeUnsupportedOperation, n.Span, "%s is not defined for %s", operatorName(n.Value), shapeName(n.Left))
+		}
+		return mapElements(n.Left, func(e *Node) *Node {
+			if isLiteral(e) {
+				return &Node{Kind: NumberNode, Value: negateLiteral(e.Value), Span: n.Span}
+			}
+			return &Node{Kind: UnaryNode, Value: "neg", Left: e, Span: n.Span}
+		}), nil
+	case BinaryNode:
+		if isList(n.Left) || isList(n.Right) {
+			return combine(n)
+		}
+	case CallNode:
+		var args []*Node
+		for _, arg := range n.Args {
+			if !isList(arg) {
+				args = append(args, arg)
+				continue
+			}
+			if !mathops.IsAggregate(n.Value) && n.Value != "min" && n.Value != "max" {
+				return nil, syntaxError(CodeUnsupportedOperation, n.Span, "%s() is not defined for %s", n.Value, shapeName(arg))
+			}
+			// элементы вектора или матрицы становятся аргументами: sum([1, 2], 3) = sum(1, 2, 3)
+			args = append(args, elements(arg)...)
+		}
+		n.Args = args
+	}
+	return n, nil
+}
+
+// checkList checks that a list is a vector of numbers or a matrix of rows of
+// the same length; the lists inside are already checked
+func checkList(n *Node) error {
+	rows := isList(n.Args[0])
+	for _, arg := range n.Args {
+		switch {
+		case isList(arg) != rows:
+			return syntaxError(CodeInvalidList, arg.Span, "a list must hold either numbers or rows of a matrix")
+		case isMatrix(arg):
+			return syntaxError(CodeInvalidList, arg.Span, "a row of a matrix must be a vector of numbers")
+		case rows && len(arg.Args) != len(n.Args[0].Args):
+			return syntaxError(CodeShapeMismatch, arg.Span, "rows of a matrix must have the same length: %d and %d", len(n.Args[0].Args), len(arg.Args))
+		}
+	}
+	return nil
+}
+
+// elementNames builds the list of the names of the elements of a bound matrix
+func elementNames(name string, v *Node, span Span, index []int) *Node {
+	if !isList(v) {
+		return &Node{Kind: IdentifierNode, Value: elementName(name, index...), Span: span}
+	}
+	list := &Node{Kind: ListNode, Span: span}
+	for i, arg := range v.Args {
+		list.Args = append(list.Args, elementNames(name, arg, span, append(slices.Clip(index), i)))
+	}
+	return list
+}
+
+// mapElements applies fn to every element of a vector or a matrix
+func mapElements(n *Node, fn func(*Node) *Node) *Node {
+	if !isList(n) {
+		return fn(n)
+	}
+	list := &Node{Kind: ListNode, Span: n.Span}
+	for _, arg := range n.Args {
+		list.Args = append(list.Args, mapElements(arg, fn))
+	}
+	return list
+}
+
+// zipElements applies fn to the pairs of elements of two values of the same shape
+func zipElements(a, b *Node, fn func(x, y *Node) *Node) *Node {
+	if !isList(a) {
+		return fn(a, b)
+	}
+	list := &Node{Kind: ListNode, Span: a.Span}
+	for i := range a.Args {
+		list.Args = append(list.Args, zipElements(a.Args[i], b.Args[i], fn))
+	}
+	return list
+}
+
+// combine expands a binary operator with a vector or a matrix operand
+func combine(n *Node) (*Node, error) {
+	a, b := n.Left, n.Right
+	scalar := func(x, y *Node) *Node {
+		return &Node{Kind: BinaryNode, Value: n.Value, Left: x, Right: y, Span: n.Span}
+	}
+	mismatch := func() error {
+		return syntaxError(CodeShapeMismatch, n.Span, "%s is not defined for %s and %s", n.Value, shapeName(a), shapeName(b))
+	}
+
+	switch n.Value {
+	case "+", "-":
+		if !slices.Equal(shapeOf(a), shapeOf(b)) {
+			return nil, mismatch()
+		}
+		return zipElements(a, b, scalar), nil
+	case "/":
+		if isList(b) {
+			return nil, mismatch()
+		}
+		return mapElements(a, func(e *Node) *Node { return scalar(e, b) }), nil
+	case "*":
+		switch {
+		case !isList(a):
+			return mapElements(b, func(e *Node) *Node { return scalar(a, e) }), nil
+		case !isList(b):
+			return mapElements(a, func(e *Node) *Node { return scalar(e, b) }), nil
+		}
+		// строки левого операнда и столбцы правого; вектор слева — строка, справа — столбец
+		rows, inner := [][]*Node{a.Args}, len(a.Args)
+		if isMatrix(a) {
+			rows = nil
+			for _, row := range a.Args {
+				rows = append(rows, row.Args)
+			}
+			inner = len(a.Args[0].Args)
+		}
+		var columns [][]*Node
+		if isMatrix(b) {
+			if len(b.Args) != inner {
+				return nil, mismatch()
+			}
+			for j := range b.Args[0].Args {
+				var column []*Node
+				for _, row := range b.Args {
+					column = append(column, row.Args[j])
+				}
+				columns = append(columns, column)
+			}
+		} else {
+			if len(b.Args) != inner {
+				return nil, mismatch()
+			}
+			columns = [][]*Node{b.Args}
+		}
+
+		// каждый элемент — сумма независимых произведений, сложенных сбалансированным деревом
+		dot := func(row, column []*Node) *Node {
+			products := make([]*Node, len(row))
+			for k := range row {
+				products[k] = scalar(row[k], column[k])
+			}
+			return reduce("+", products, n.Span)
+		}
+		result := &Node{Kind: ListNode, Span: n.Span}
+		for _, row := range rows {
+			line := &Node{Kind: ListNode, Span: n.Span}
+			for _, column := range columns {
+				line.Args = append(line.Args, dot(row, column))
+			}
+			result.Args = append(result.Args, line)
+		}
+
+		switch {
+		case isMatrix(a) && isMatrix(b):
+			return result, nil
+		case isMatrix(a):
+			// матрица на вектор — вектор: по элементу на строку
+			return columnVector(result), nil
+		case isMatrix(b):
+			// вектор на матрицу — вектор: по элементу на столбец
+			return result.Args[0], nil
+		}
+		// скалярное произведение векторов
+		return result.Args[0].Args[0], nil
+	}
+	return nil, syntaxError(CodeUnsupportedOperation, n.Span, "%s is not defined for %s and %s", n.Value, shapeName(a), shapeName(b))
+}
+
+// columnVector turns a matrix of one column into a vector
+func columnVector(m *Node) *Node {
+	vector := &Node{Kind: ListNode, Span: m.Span}
+	for _, row := range m.Args {
+		vector.Args = append(vector.Args, row.Args[0])
+	}
+	return vector
+}
+
+// newMatrix describes a computed vector or matrix for the store: its shape and
+// its elements as task arguments, "task:<id>" or a number
+func newMatrix(n *Node) *store.Matrix {
+	m := &store.Matrix{Shape: shapeOf(n)}
+	for _, e := range elements(n) {
+		m.Elements = append(m.Elements, getNodeReference(e))
+	}
+	return m
+}
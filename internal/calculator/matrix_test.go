@@ -0,0 +1,99 @@
+package calculator
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestExpandMatrices(t *testing.T) {
+	tests := []struct {
+		expr string
+		want string
+	}{
+		{"[1,2]+[3,4]", "(list (+ 1 3) (+ 2 4))"},
+		{"-[1,2]", "(list -1 -2)"},
+		{"2*[1,2]/4", "(list (/ (* 2 1) 4) (/ (* 2 2) 4))"},
+		// скалярное произведение векторов
+		{"[1,2]*[3,4]", "(+ (* 1 3) (* 2 4))"},
+		// матрица на вектор и вектор на матрицу — векторы
+		{"[[1,2],[3,4]]*[5,6]", "(list (+ (* 1 5) (* 2 6)) (+ (* 3 5) (* 4 6)))"},
+		{"[1,2]*[[1,2],[3,4]]", "(list (+ (* 1 1) (* 2 3)) (+ (* 1 2) (* 2 4)))"},
+		{"[[1,2],[3,4]]*[[5,6],[7,8]]", "(list (list (+ (* 1 5) (* 2 7)) (+ (* 1 6) (* 2 8))) (list (+ (* 3 5) (* 4 7)) (+ (* 3 6) (* 4 8))))"},
+		// произведения строки на столбец складываются сбалансированным деревом
+		{"[1,2,3,4]*[1,1,1,1]", "(+ (+ (* 1 1) (* 2 1)) (+ (* 3 1) (* 4 1)))"},
+		{"max([1,5],3)", "(max 1 5 3)"},
+	}
+
+	for _, tt := range tests {
+		statements, err := parseExpression(tt.expr)
+		if err != nil {
+			t.Errorf("%q: %v", tt.expr, err)
+			continue
+		}
+		tree, err := expandMatrices(statements[0].Tree, newScope())
+		if err != nil {
+			t.Errorf("%q: %v", tt.expr, err)
+			continue
+		}
+		if got := treeString(tree); got != tt.want {
+			t.Errorf("%q: got %s, want %s", tt.expr, got, tt.want)
+		}
+	}
+}
+
+func TestExpandBoundMatrix(t *testing.T) {
+	// имя матрицы из прошлой инструкции сценария заменяется именами ее элементов
+	bound := newScope()
+	matrix, err := parseExpression("[[1,2],[3,4]]")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bound.bind("A", matrix[0].Tree, 0, 0)
+
+	statements, err := parseExpression("A*[1,0]")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree, err := expandMatrices(statements[0].Tree, bound)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "(list (+ (* A[1,1] 1) (* A[1,2] 0)) (+ (* A[2,1] 1) (* A[2,2] 0)))"
+	if got := treeString(tree); got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+func TestExpandMatricesErrors(t *testing.T) {
+	tests := []struct {
+		expr   string
+		code   string
+		offset int
+	}{
+		{"[[1,2],[3]]", CodeShapeMismatch, 7},
+		{"[1,[2]]", CodeInvalidList, 3},
+		{"[1,2]+[1,2,3]", CodeShapeMismatch, 0},
+		{"[1,2]/[1,2]", CodeShapeMismatch, 0},
+		{"[[1,2]]*[1,2,3]", CodeShapeMismatch, 0},
+		{"[1,2]^2", CodeUnsupportedOperation, 0},
+		{"sqrt([1,2])", CodeUnsupportedOperation, 0},
+		{"![1]", CodeUnsupportedOperation, 0},
+	}
+
+	for _, tt := range tests {
+		statements, err := parseExpression(tt.expr)
+		if err != nil {
+			t.Errorf("%q: %v", tt.expr, err)
+			continue
+		}
+		_, err = expandMatrices(statements[0].Tree, newScope())
+		var syntaxErr *SyntaxError
+		if !errors.As(err, &syntaxErr) {
+			t.Errorf("%q: got %v, want a syntax error", tt.expr, err)
+			continue
+		}
+		if syntaxErr.Code != tt.code || syntaxErr.Offset != tt.offset {
+			t.Errorf("%q: got %s at %d, want %s at %d", tt.expr, syntaxErr.Code, syntaxErr.Offset, tt.code, tt.offset)
+		}
+	}
+}
@@ -0,0 +1,29 @@
+package calculator
+
+import (
+	"calc-service/pkg/mathops"
+)
+
+// applyMode adapts the tree to the numeric mode before tasks are created:
+// every literal (including substituted variables and referenced results) must be
+// representable in the mode, functions must be supported by it, and in integer mode
+// with truncating division "/" becomes the internal "quo" operator.
+func applyMode(tree *Node, opts Options) error {
+	return walk(tree, func(n *Node) error {
+		switch {
+		case isOperation(n):
+			if err := mathops.CheckModeSupport(opts.Mode, n.Value); err != nil {
+				return syntaxError(CodeUnsupportedOperation, n.Span, "%v", err)
+			}
+			if n.Value == "/" && opts.Mode == mathops.ModeInteger && opts.Division == DivisionTruncate {
+				n.Value = "quo"
+			}
+		case isLiteral(n):
+			if _, err := mathops.Normalize(opts.Mode, n.Value); err != nil {
+				return syntaxError(CodeInvalidOperand, n.Span, "%v", err)
+			}
+		}
+		// имена, ссылки и задачи других выражений проверяются при подстановке и агентом
+		return nil
+	})
+}
@@ -0,0 +1,379 @@
+package calculator
+
+import (
+	"calc-service/pkg/mathops"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Input syntaxes of an expression
+const (
+	SyntaxInfix = "infix" // обычная запись: 2+3*4
+	SyntaxRPN   = "rpn"   // обратная польская запись: 2 3 4 * +
+	SyntaxSExpr = "sexpr" // S-выражения: (+ 2 (* 3 4))
+)
+
+func isSyntax(syntax string) bool {
+	return syntax == SyntaxInfix || syntax == SyntaxRPN || syntax == SyntaxSExpr
+}
+
+// parseSource parses an expression written in the syntax into its statements
+// and returns them with the canonical text of the expression: the infix form
+// with canonical literals (1e3 -> 1000, 0xFF -> 255) and only the necessary
+// parentheses, so that the expression reads the same way whatever its input.
+// RPN and S-expressions describe a single expression
+func parseSource(exprStr, syntax string) ([]*statement, string, error) {
+	var statements []*statement
+	switch syntax {
+	case SyntaxRPN, SyntaxSExpr:
+		var tree *Node
+		var err error
+		if syntax == SyntaxRPN {
+			tree, err = parseRPN(exprStr)
+		} else {
+			tree, err = parseSExpr(exprStr)
+		}
+		if err != nil {
+			return nil, "", err
+		}
+		statements = []*statement{{Tree: tree}}
+	default:
+		var err error
+		if statements, err = parseExpression(exprStr); err != nil {
+			return nil, "", err
+		}
+	}
+	return statements, formatScript(statements), nil
+}
+
+// word is an element of RPN or of an S-expression: a number, a name, an
+// operator, a reference or a parenthesis
+type word struct {
+	text string
+	pos  int
+}
+
+func (w word) span() Span {
+	return Span{w.pos, w.pos + len(w.text)}
+}
+
+// splitWords splits the expression at spaces; parentheses are words of their own
+func splitWords(s string) []word {
+	var words []word
+	start := -1
+	flush := func(end int) {
+		if start >= 0 {
+			words = append(words, word{s[start:end], start})
+			start = -1
+		}
+	}
+	for i := 0; i < len(s); {
+		r, size := utf8.DecodeRuneInString(s[i:])
+		switch {
+		case unicode.IsSpace(r):
+			flush(i)
+		case r == '(' || r == ')':
+			flush(i)
+			words = append(words, word{s[i : i+size], i})
+		case start < 0:
+			start = i
+		}
+		i += size
+	}
+	flush(len(s))
+	return words
+}
+
+// binaryOperators are the operators with two operands in RPN and S-expressions
+var binaryOperators = map[string]bool{
+	"+": true, "-": true, "*": true, "/": true, "^": true, "%": true, "//": true,
+	"<": true, "<=": true, ">": true, ">=": true, "==": true, "!=": true, "&&": true, "||": true,
+}
+
+// unaryOperators maps the spellings of prefix operators to their names
+var unaryOperators = map[string]string{
+	"neg": "neg",
+	"not": "not",
+	"!":   "not",
+}
+
+// operandNode converts a word that is an operand: a number ("-3" included),
+// a reference or a name
+func operandNode(w word) (*Node, error) {
+	text := w.text
+	switch {
+	case text[0] == '$':
+		start := 1
+		if strings.HasPrefix(text[start:], "expr-") {
+			start += len("expr-")
+		}
+		id := text[start:]
+		if id == "" || strings.TrimLeft(id, "0123456789") != "" {
+			return nil, syntaxError(CodeInvalidReference, w.span(), "invalid expression reference")
+		}
+		return &Node{Kind: ReferenceNode, Value: "expr-" + id, Span: w.span()}, nil
+	case isDigitByte(text[0]) || text[0] == '.' || (len(text) > 1 && (text[0] == '-' || text[0] == '+') && (isDigitByte(text[1]) || text[1] == '.')):
+		start := 0
+		if text[0] == '-' || text[0] == '+' {
+			start = 1
+		}
+		value, end, err := readNumber(text, start)
+		if err == nil && end < len(text) {
+			err = fmt.Errorf("invalid number literal: %s", text)
+		}
+		if err != nil {
+			return nil, syntaxError(CodeInvalidNumber, w.span(), "%v", err)
+		}
+		if text[0] == '-' {
+			value = negateLiteral(value)
+		}
+		return &Node{Kind: NumberNode, Value: value, Span: w.span()}, nil
+	case isIdentifier(text):
+		return &Node{Kind: IdentifierNode, Value: text, Span: w.span()}, nil
+	default:
+		return nil, syntaxError(CodeUnexpectedToken, w.span(), "unexpected %s", text)
+	}
+}
+
+// operation builds the node of an operator or a function applied to operands
+// spanning from the first operand (or the operator) to the end
+func operation(op string, operands []*Node, span Span) *Node {
+	if name, ok := unaryOperators[op]; ok {
+		if name == "neg" && isLiteral(operands[0]) {
+			return &Node{Kind: NumberNode, Value: negateLiteral(operands[0].Value), Span: span}
+		}
+		return &Node{Kind: UnaryNode, Value: name, Left: operands[0], Span: span}
+	}
+	if binaryOperators[op] {
+		return &Node{Kind: BinaryNode, Value: op, Left: operands[0], Right: operands[1], Span: span}
+	}
+	return &Node{Kind: CallNode, Value: op, Args: operands, Span: span}
+}
+
+// parseRPN parses an expression in reverse Polish notation: operands are
+// pushed onto a stack, operators and functions replace their operands on top
+// of it with the result. Unary minus is "neg"; functions with a variable
+// number of arguments and user functions take the count after a colon: "max:3"
+func parseRPN(expr string) (*Node, error) {
+	words := splitWords(expr)
+	if len(words) == 0 {
+		return nil, syntaxError(CodeEmptyExpression, Span{0, 0}, "expression cannot be empty")
+	}
+
+	var stack []*Node
+	var depths []int // глубина вложенности каждого узла стека
+	for _, w := range words {
+		op, count := w.text, 0
+		switch {
+		case w.text == "(" || w.text == ")":
+			return nil, syntaxError(CodeUnexpectedToken, w.span(), "parentheses are not used in RPN")
+		case binaryOperators[op]:
+			count = 2
+		case unaryOperators[op] != "":
+			count = 1
+		default:
+			name, arity, hasArity := strings.Cut(w.text, ":")
+			if !hasArity && !mathops.IsFunction(name) {
+				n, err := operandNode(w)
+				if err != nil {
+					return nil, err
+				}
+				stack = append(stack, n)
+				depths = append(depths, 0)
+				continue
+			}
+			if !isIdentifier(name) {
+				return nil, syntaxError(CodeUnexpectedToken, w.span(), "unexpected %s", w.text)
+			}
+			op = name
+			if hasArity {
+				n, err := strconv.Atoi(arity)
+				if err != nil || n < 1 {
+					return nil, syntaxError(CodeInvalidArguments, w.span(), "invalid argument count %q", arity)
+				}
+				count = n
+			} else {
+				count = fixedArity(name)
+				if count == 0 {
+					return nil, syntaxError(CodeInvalidArguments, w.span(), "%s takes a variable number of arguments: give the count, e.g. %s:2", name, name)
+				}
+			}
+		}
+
+		if len(stack) < count {
+			return nil, syntaxError(CodeInvalidArguments, w.span(), "%s expects %d operand(s), the stack has %d", w.text, count, len(stack))
+		}
+		if err := checkArity(op, count, w.span()); err != nil {
+			return nil, err
+		}
+		operands := append([]*Node(nil), stack[len(stack)-count:]...)
+		d := 0
+		for _, operandDepth := range depths[len(depths)-count:] {
+			d = max(d, operandDepth+1)
+		}
+		// глубокое дерево переполнило бы стек при рекурсивном обходе
+		if d > maxNestingDepth {
+			return nil, syntaxError(CodeUnexpectedToken, w.span(), "expression is nested too deeply")
+		}
+		stack = stack[:len(stack)-count]
+		depths = depths[:len(depths)-count]
+		n := operation(op, operands, Span{operands[0].Span.Start, w.span().End})
+		if isLiteral(n) {
+			d = 0
+		}
+		stack = append(stack, n)
+		depths = append(depths, d)
+	}
+
+	if len(stack) != 1 {
+		return nil, syntaxError(CodeUnexpectedEnd, Span{len(expr), len(expr)}, "RPN expression leaves %d values on the stack instead of one", len(stack))
+	}
+	return stack[0], nil
+}
+
+// fixedArity returns the number of arguments of a built-in function that
+// takes a fixed number of them, 0 otherwise
+func fixedArity(name string) int {
+	for n := 1; n <= 3; n++ {
+		if mathops.CheckArity(name, n) == nil {
+			if mathops.CheckArity(name, n+1) == nil {
+				return 0
+			}
+			return n
+		}
+	}
+	return 0
+}
+
+// parseSExpr parses a Lisp-style expression: "(op arg ...)" applies an
+// operator or a function to its arguments. "+", "*", "-", "/", "&&" and "||"
+// take any number of arguments and group from the left; "(- x)" is negation
+func parseSExpr(expr string) (*Node, error) {
+	words := splitWords(expr)
+	if len(words) == 0 {
+		return nil, syntaxError(CodeEmptyExpression, Span{0, 0}, "expression cannot be empty")
+	}
+	p := &sexprParser{words: words, end: len(expr)}
+	tree, err := p.parseDatum()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(words) {
+		w := words[p.pos]
+		if w.text == ")" {
+			return nil, syntaxError(CodeUnbalancedParentheses, w.span(), "unmatched closing parenthesis")
+		}
+		return nil, syntaxError(CodeUnexpectedToken, w.span(), "unexpected %s after the expression", w.text)
+	}
+	return tree, nil
+}
+
+type sexprParser struct {
+	words []word
+	pos   int
+	end   int // длина выражения, позиция ошибки "неожиданный конец"
+	depth int
+}
+
+// parseDatum parses an operand or a parenthesized application
+func (p *sexprParser) parseDatum() (*Node, error) {
+	if p.pos >= len(p.words) {
+		return nil, syntaxError(CodeUnexpectedEnd, Span{p.end, p.end}, "unexpected end of expression")
+	}
+	w := p.words[p.pos]
+	p.pos++
+	switch w.text {
+	case ")":
+		return nil, syntaxError(CodeUnbalancedParentheses, w.span(), "unmatched closing parenthesis")
+	case "(":
+		return p.parseApplication(w)
+	}
+	return operandNode(w)
+}
+
+// parseApplication parses "(op arg ...)" after its opening parenthesis
+func (p *sexprParser) parseApplication(open word) (*Node, error) {
+	p.depth++
+	defer func() { p.depth-- }()
+	if p.depth > maxNestingDepth {
+		return nil, syntaxError(CodeUnexpectedToken, open.span(), "expression is nested too deeply")
+	}
+
+	if p.pos >= len(p.words) {
+		return nil, syntaxError(CodeUnbalancedParentheses, open.span(), "unclosed parenthesis")
+	}
+	head := p.words[p.pos]
+	op := head.text
+	if op == ")" {
+		return nil, syntaxError(CodeUnexpectedToken, Span{open.pos, head.span().End}, "empty parentheses")
+	}
+	if !binaryOperators[op] && unaryOperators[op] == "" && !isIdentifier(op) {
+		return nil, syntaxError(CodeUnexpectedToken, head.span(), "expected an operator or a function name, got %s", op)
+	}
+	p.pos++
+
+	var args []*Node
+	for {
+		if p.pos >= len(p.words) {
+			return nil, syntaxError(CodeUnbalancedParentheses, open.span(), "unclosed parenthesis")
+		}
+		if p.words[p.pos].text == ")" {
+			break
+		}
+		arg, err := p.parseDatum()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+	}
+	span := Span{open.pos, p.words[p.pos].span().End}
+	p.pos++
+
+	// у операторов S-выражения своя арность: (- x) — унарный минус, (+ a b c) — сумма
+	var minArgs, maxArgs int
+	switch {
+	case op == "+" || op == "*" || op == "-":
+		minArgs, maxArgs = 1, -1
+	case op == "/" || op == "&&" || op == "||":
+		minArgs, maxArgs = 2, -1
+	case binaryOperators[op]:
+		minArgs, maxArgs = 2, 2
+	case unaryOperators[op] != "":
+		minArgs, maxArgs = 1, 1
+	default:
+		if err := checkArity(op, len(args), head.span()); err != nil {
+			return nil, err
+		}
+		return operation(op, args, span), nil
+	}
+	if len(args) < minArgs || (maxArgs >= 0 && len(args) > maxArgs) {
+		return nil, syntaxError(CodeInvalidArguments, head.span(), "%s expects %s, got %d", op, arityText(minArgs, maxArgs), len(args))
+	}
+
+	switch {
+	case op == "-" && len(args) == 1:
+		return operation("neg", args, span), nil
+	case len(args) == 1:
+		// (+ x) и (* x) — просто x
+		return args[0], nil
+	}
+	// (- a b c) = (a-b)-c
+	acc := args[0]
+	for _, arg := range args[1:] {
+		acc = operation(op, []*Node{acc, arg}, span)
+	}
+	return acc, nil
+}
+
+func arityText(minArgs, maxArgs int) string {
+	switch {
+	case maxArgs < 0:
+		return fmt.Sprintf("at least %d argument(s)", minArgs)
+	case minArgs == maxArgs:
+		return fmt.Sprintf("%d argument(s)", minArgs)
+	}
+	return fmt.Sprintf("%d to %d arguments", minArgs, maxArgs)
+}
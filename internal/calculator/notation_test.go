@@ -0,0 +1,103 @@
+package calculator
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestParseRPN(t *testing.T) {
+	tests := []struct {
+		expr string
+		want string
+	}{
+		{"2 3 4 * +", "(+ 2 (* 3 4))"},
+		{"2 3 + 4 *", "(* (+ 2 3) 4)"},
+		{"1 2 - 3 -", "(- (- 1 2) 3)"},
+		{"x neg 2 ^", "(^ (neg x) 2)"},
+		{"3 neg", "-3"},
+		{"-3 2 *", "(* -3 2)"},
+		{"2 sqrt 1 2 3 max:3 +", "(+ (sqrt 2) (max 1 2 3))"},
+		{"1 2 < 3 4 if", "(if (< 1 2) 3 4)"},
+		{"x !", "(not x)"},
+	}
+
+	for _, tt := range tests {
+		tree, err := parseRPN(tt.expr)
+		if err != nil {
+			t.Errorf("%q: %v", tt.expr, err)
+			continue
+		}
+		if got := treeString(tree); got != tt.want {
+			t.Errorf("%q: got %s, want %s", tt.expr, got, tt.want)
+		}
+	}
+}
+
+func TestParseSExpr(t *testing.T) {
+	tests := []struct {
+		expr string
+		want string
+	}{
+		{"(+ 2 (* 3 4))", "(+ 2 (* 3 4))"},
+		// операторы с любым числом аргументов группируются слева
+		{"(- 10 2 3)", "(- (- 10 2) 3)"},
+		{"(* 1 2 3 4)", "(* (* (* 1 2) 3) 4)"},
+		{"(- x)", "(neg x)"},
+		{"(- 3)", "-3"},
+		{"(+ x)", "x"},
+		{"(max 1 (sqrt 4) 3)", "(max 1 (sqrt 4) 3)"},
+		{"(if (< x 0) (- x) x)", "(if (< x 0) (neg x) x)"},
+		{"42", "42"},
+	}
+
+	for _, tt := range tests {
+		tree, err := parseSExpr(tt.expr)
+		if err != nil {
+			t.Errorf("%q: %v", tt.expr, err)
+			continue
+		}
+		if got := treeString(tree); got != tt.want {
+			t.Errorf("%q: got %s, want %s", tt.expr, got, tt.want)
+		}
+	}
+}
+
+func TestNotationErrors(t *testing.T) {
+	tests := []struct {
+		syntax string
+		expr   string
+		code   string
+		offset int
+	}{
+		{SyntaxRPN, "", CodeEmptyExpression, 0},
+		{SyntaxRPN, "1 +", CodeInvalidArguments, 2},
+		{SyntaxRPN, "1 2", CodeUnexpectedEnd, 3},
+		{SyntaxRPN, "1 2 max", CodeInvalidArguments, 4},
+		{SyntaxRPN, "1 sqrt:2", CodeInvalidArguments, 2},
+		{SyntaxRPN, "( 1 )", CodeUnexpectedToken, 0},
+		{SyntaxRPN, "1..2 3 +", CodeInvalidNumber, 0},
+		// 1001-й sqrt вкладывается глубже maxNestingDepth
+		{SyntaxRPN, "x " + strings.Repeat("sqrt ", maxNestingDepth+1), CodeUnexpectedToken, 2 + 5*maxNestingDepth},
+		{SyntaxSExpr, strings.Repeat("(neg ", maxNestingDepth+1) + "x", CodeUnexpectedToken, 5 * maxNestingDepth},
+		{SyntaxSExpr, "(+ 1 2", CodeUnbalancedParentheses, 0},
+		{SyntaxSExpr, "(+ 1 2))", CodeUnbalancedParentheses, 7},
+		{SyntaxSExpr, "()", CodeUnexpectedToken, 0},
+		{SyntaxSExpr, "(1 2)", CodeUnexpectedToken, 1},
+		{SyntaxSExpr, "(/ 1)", CodeInvalidArguments, 1},
+		{SyntaxSExpr, "(sqrt 1 2)", CodeInvalidArguments, 1},
+		{SyntaxSExpr, "(+ 1 2) 3", CodeUnexpectedToken, 8},
+	}
+
+	for _, tt := range tests {
+		_, _, err := parseSource(tt.expr, tt.syntax)
+		var syntaxErr *SyntaxError
+		if !errors.As(err, &syntaxErr) {
+			t.Errorf("%s %q: got %v, want a syntax error", tt.syntax, tt.expr, err)
+			continue
+		}
+		if syntaxErr.Code != tt.code || syntaxErr.Offset != tt.offset {
+			t.Errorf("%s %q: got %s at %d, want %s at %d", tt.syntax, tt.expr, syntaxErr.Code, syntaxErr.Offset, tt.code, tt.offset)
+		}
+	}
+}
@@ -0,0 +1,221 @@
+package calculator
+
+import (
+	"calc-service/pkg/mathops"
+	"container/heap"
+	"os"
+	"strconv"
+)
+
+// Folding policies: which operations the orchestrator evaluates itself
+// instead of sending them to the agents
+const (
+	FoldNone  = "none"  // каждая операция — задача для агента
+	FoldCheap = "cheap" // операции над числами не дольше FOLD_CHEAP_MAX_MS
+	FoldAll   = "all"   // все операции над числами
+)
+
+// defaultCheapFoldTime is the operation time limit of FoldCheap unless
+// FOLD_CHEAP_MAX_MS is set: additions, subtractions and negations by default
+const defaultCheapFoldTime = 100
+
+func isFoldPolicy(policy string) bool {
+	return policy == FoldNone || policy == FoldCheap || policy == FoldAll
+}
+
+func cheapFoldTime() int {
+	t, err := strconv.Atoi(os.Getenv("FOLD_CHEAP_MAX_MS"))
+	if err != nil {
+		return defaultCheapFoldTime
+	}
+	return t
+}
+
+// foldConstants evaluates the operations allowed by the policy whose operands
+// are all numbers, so that a subtree of such operations turns into a single
+// number. An operation that fails (e.g. division by zero) is left as a task so
+// that the error is reported the usual way
+func foldConstants(n *Node, opts Options) {
+	if opts.Fold == FoldNone {
+		return
+	}
+	if n.Kind == ListNode {
+		for _, element := range n.Args {
+			foldConstants(element, opts)
+		}
+		return
+	}
+	if !isOperation(n) {
+		return
+	}
+
+	operands := n.Operands()
+	args := make([]string, 0, len(operands))
+	for _, child := range operands {
+		foldConstants(child, opts)
+		if isLiteral(child) {
+			args = append(args, child.Value)
+		}
+	}
+	if len(args) != len(operands) {
+		return
+	}
+	if opts.Fold == FoldCheap && getOperationTime(n.Value) > cheapFoldTime() {
+		return
+	}
+
+	value, err := mathops.Evaluate(opts.Mode, n.Value, args...)
+	if err != nil {
+		return
+	}
+	*n = Node{Kind: NumberNode, Value: value, Span: n.Span}
+}
+
+// eliminateCommonSubexpressions makes structurally identical operations share
+// one node, so that e.g. both sides of (a+b)*(a+b) are computed by a single
+// task referenced twice. The roots (the result and the bindings of a script)
+// are replaced in place. After this pass the tree is a DAG: createTasksFromTree
+// creates a task only for the first visit of a shared node.
+// An operation inside a branch of a conditional is shared only with an earlier
+// one in the same branch or outside of it, which is computed anyway; the two
+// branches never share tasks, so each of them is computed only if taken
+func eliminateCommonSubexpressions(roots ...**Node) {
+	type numbered struct {
+		node *Node
+		id   int
+	}
+	ids := make(map[string]int)
+	shared := make(map[string]*Node)    // номер структуры и ветвь -> узел
+	visited := make(map[*Node]numbered) // узлы, общие для инструкций сценария, обходим один раз
+
+	// visit returns the node to use in place of n and the number of its
+	// structure; branch is the path of the conditional branches n is in
+	var visit func(n *Node, branch string) (*Node, int)
+	visit = func(n *Node, branch string) (*Node, int) {
+		if v, ok := visited[n]; ok {
+			return v.node, v.id
+		}
+
+		key := n.Kind.String() + "|" + n.Value
+		cond := 0
+		for i, slot := range n.operandSlots() {
+			// ветви if(cond, a, b) различаем по условию и номеру аргумента
+			childBranch := branch
+			if isConditional(n) && i > 0 {
+				childBranch = branch + "/" + strconv.Itoa(cond) + ":" + strconv.Itoa(i)
+			}
+			child, id := visit(*slot, childBranch)
+			*slot = child
+			key += "|" + strconv.Itoa(id)
+			if i == 0 {
+				cond = id
+			}
+		}
+
+		id, seen := ids[key]
+		if !seen {
+			id = len(ids)
+			ids[key] = id
+		}
+		result := numbered{n, id}
+		if isOperation(n) {
+			// тот же узел вне ветвей или во внешней ветви вычисляется и так: берем его
+			for i := 0; i <= len(branch); i++ {
+				if i < len(branch) && branch[i] != '/' {
+					continue
+				}
+				if node, ok := shared[strconv.Itoa(id)+"@"+branch[:i]]; ok {
+					result.node = node
+					break
+				}
+			}
+			if result.node == n {
+				shared[strconv.Itoa(id)+"@"+branch] = n
+			}
+		}
+		visited[n] = result
+		return result.node, result.id
+	}
+	for _, root := range roots {
+		*root, _ = visit(*root, "")
+	}
+}
+
+// depth is the number of operations on the longest path from n to a number,
+// i.e. how many tasks have to be computed one after another; names bound by
+// earlier statements of a script count with the depth of their values
+func depth(n *Node, bound map[string]int) int {
+	if n.Kind == IdentifierNode {
+		return bound[n.Value]
+	}
+	d := 0
+	for _, child := range n.Operands() {
+		d = max(d, depth(child, bound))
+	}
+	if isOperation(n) {
+		d++
+	}
+	return d
+}
+
+// isAssociative reports whether chains of op may be regrouped; both operators
+// are also commutative, so the operands may be reordered as well
+func isAssociative(op string) bool {
+	return op == "+" || op == "*"
+}
+
+// rebalance regroups chains of the same associative operator into trees of
+// minimum height, e.g. ((1+2)+3)+4 into (1+2)+(3+4), so that more tasks can
+// run in parallel. Names bound by earlier statements of a script count as
+// operands of the depth of their values. It returns the new subtree and its depth
+func rebalance(n *Node, bound map[string]int) (*Node, int) {
+	if !isOperation(n) && n.Kind != ListNode {
+		return n, depth(n, bound)
+	}
+	if n.Kind != BinaryNode || !isAssociative(n.Value) {
+		d := 0
+		for _, slot := range n.operandSlots() {
+			var child int
+			*slot, child = rebalance(*slot, bound)
+			d = max(d, child)
+		}
+		// элементы вектора вычисляются независимо, список сам задачей не является
+		if n.Kind == ListNode {
+			return n, d
+		}
+		return n, d + 1
+	}
+
+	// операнды цепочки одного оператора: 1+2+3+4 -> [1 2 3 4]
+	var operands []*Node
+	queue := &eventQueue{}
+	var collect func(c *Node)
+	collect = func(c *Node) {
+		if c.Kind == BinaryNode && c.Value == n.Value {
+			collect(c.Left)
+			collect(c.Right)
+			return
+		}
+		operand, d := rebalance(c, bound)
+		operands = append(operands, operand)
+		heap.Push(queue, event{at: d, index: len(operands) - 1})
+	}
+	collect(n)
+
+	// как в алгоритме Хаффмана, каждый раз объединяем два самых низких поддерева
+	for queue.Len() > 1 {
+		a := heap.Pop(queue).(event)
+		b := heap.Pop(queue).(event)
+		left, right := operands[a.index], operands[b.index]
+		operands = append(operands, &Node{
+			Kind:  BinaryNode,
+			Value: n.Value,
+			Left:  left,
+			Right: right,
+			Span:  Span{Start: min(left.Span.Start, right.Span.Start), End: max(left.Span.End, right.Span.End)},
+		})
+		heap.Push(queue, event{at: max(a.at, b.at) + 1, index: len(operands) - 1})
+	}
+	root := heap.Pop(queue).(event)
+	return operands[root.index], root.at
+}
@@ -0,0 +1,147 @@
+package calculator
+
+import (
+	"calc-service/internal/store"
+	"calc-service/pkg/mathops"
+	"testing"
+)
+
+// sharedTasks parses the expression, shares its common subexpressions and
+// creates the tasks of the resulting DAG
+func sharedTasks(t *testing.T, expr string) (*Node, []*store.Task) {
+	t.Helper()
+	statements, err := parseExpression(expr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree := statements[0].Tree
+	eliminateCommonSubexpressions(&tree)
+	tasks, err := createTasksFromTree("expr-test", tree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tree, tasks
+}
+
+func TestEliminateCommonSubexpressions(t *testing.T) {
+	tree, tasks := sharedTasks(t, "(a+b)*(a+b)")
+
+	if tree.Left != tree.Right {
+		t.Fatal("both operands of * should be the same node")
+	}
+	if len(tasks) != 2 {
+		t.Fatalf("got %d tasks, want 2: one for a+b and one for *", len(tasks))
+	}
+	sum, product := tasks[0], tasks[1]
+	if sum.Operator != "+" || product.Operator != "*" {
+		t.Fatalf("got tasks %s, %s, want +, *", sum.Operator, product.Operator)
+	}
+	if ref := "task:" + sum.ID; product.Arg1 != ref || product.Arg2 != ref {
+		t.Errorf("* should reference the task of a+b twice, got %s and %s", product.Arg1, product.Arg2)
+	}
+}
+
+func TestEliminateCommonSubexpressionsParents(t *testing.T) {
+	// a+b нужна двум разным родителям: * и -
+	_, tasks := sharedTasks(t, "(a+b)*2 - (a+b)")
+
+	if len(tasks) != 3 {
+		t.Fatalf("got %d tasks, want 3", len(tasks))
+	}
+	ref := "task:" + tasks[0].ID
+	product, difference := tasks[1], tasks[2]
+	if product.Arg1 != ref || difference.Arg2 != ref {
+		t.Errorf("* and - should both reference %s, got %s and %s", ref, product.Arg1, difference.Arg2)
+	}
+}
+
+func TestEliminateCommonSubexpressionsBranches(t *testing.T) {
+	// ветви условия не делят задачи: каждая вычисляется, только если выбрана
+	_, tasks := sharedTasks(t, "if(c, a+b, (a+b)*2)")
+
+	sums := 0
+	for _, task := range tasks {
+		if task.Operator == "+" {
+			sums++
+		}
+	}
+	if sums != 2 {
+		t.Errorf("got %d tasks for a+b, want one per branch", sums)
+	}
+}
+
+func TestRebalance(t *testing.T) {
+	tests := []struct {
+		expr  string
+		want  string
+		depth int
+	}{
+		{"1+2+3+4", "(+ (+ 1 2) (+ 3 4))", 2},
+		{"1*2*3*4*5", "(* (* 3 4) (* 5 (* 1 2)))", 3},
+		// цепочка перегруппировывается только внутри одного оператора
+		{"1+2+3*4*5*6", "(+ (+ 1 2) (* (* 3 4) (* 5 6)))", 3},
+		{"1-2-3-4", "(- (- (- 1 2) 3) 4)", 3},
+		{"sqrt(1+2+3+4)", "(sqrt (+ (+ 1 2) (+ 3 4)))", 3},
+	}
+
+	for _, tt := range tests {
+		statements, err := parseExpression(tt.expr)
+		if err != nil {
+			t.Fatalf("%q: %v", tt.expr, err)
+		}
+		tree, d := rebalance(statements[0].Tree, nil)
+		if got := treeString(tree); got != tt.want {
+			t.Errorf("%q: got %s, want %s", tt.expr, got, tt.want)
+		}
+		if d != tt.depth || depth(tree, nil) != tt.depth {
+			t.Errorf("%q: got depth %d (%d), want %d", tt.expr, d, depth(tree, nil), tt.depth)
+		}
+	}
+}
+
+func TestRebalanceModes(t *testing.T) {
+	// перегруппировка меняла бы результат: переполнение промежуточной суммы или произведения
+	for _, tt := range []struct{ expr, mode string }{
+		{"9223372036854775807+(0-1)+1", mathops.ModeInteger},
+		{"1e308*(1/10)*10", mathops.ModeFloat},
+	} {
+		if _, err := compile(tt.expr, "user-rebalance", &Options{Mode: tt.mode, Rebalance: true}); err == nil {
+			t.Errorf("%q: rebalanced in %s mode", tt.expr, tt.mode)
+		}
+	}
+
+	// в decimal сложение и умножение точны, и результат от группировки не зависит
+	c, err := compile("0.1+0.2+0.3+0.4", "user-rebalance", &Options{Mode: mathops.ModeDecimal, Rebalance: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.depth != 3 || c.optimizedDepth != 2 {
+		t.Errorf("got depth %d, optimized %d, want 3 and 2", c.depth, c.optimizedDepth)
+	}
+}
+
+func TestFoldCheap(t *testing.T) {
+	t.Setenv("FOLD_CHEAP_MAX_MS", "")
+	tests := []struct {
+		expr string
+		want string
+	}{
+		{"1+2*3", "(+ 1 (* 2 3))"},
+		{"if(1<2, 3, 4)", "3"},
+		// агрегаты и их завершения не дешевые: у них есть свое время выполнения
+		{"median(3, 1, 2)", "(median 3 1 2)"},
+		{"avg(1, 2)", "(mean 3 2)"},
+		{"product(2, 3)", "(* 2 3)"},
+	}
+	for _, tt := range tests {
+		statements, err := parseExpression(tt.expr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tree := planReductions(statements[0].Tree)
+		foldConstants(tree, Options{Mode: mathops.ModeFloat, Fold: FoldCheap})
+		if got := treeString(tree); got != tt.want {
+			t.Errorf("%q: got %s, want %s", tt.expr, got, tt.want)
+		}
+	}
+}
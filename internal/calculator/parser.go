@@ -1,15 +1,23 @@
 package calculator
 
 import (
-	"fmt"
+	"calc-service/pkg/mathops"
 	"strings"
 	"unicode"
+	"unicode/utf8"
 )
 
 // Лексический анализ: токенизация
 type token struct {
 	value string
 	type_ tokenType
+	pos   int    // смещение токена в исходном выражении
+	text  string // исходная запись токена (у чисел value уже канонический)
+}
+
+// span returns the source range of the token
+func (t token) span() Span {
+	return Span{t.pos, t.pos + len(t.text)}
 }
 
 type tokenType int
@@ -17,134 +25,503 @@ type tokenType int
 const (
 	number tokenType = iota
 	operator
+	unaryOperator
 	leftParen
 	rightParen
+	function
+	comma
+	identifier
+	reference
+	assign    // "=" в привязке name = expression
+	semicolon // разделитель инструкций сценария
+	leftBracket
+	rightBracket // список значений [a, b, ...] — аргумент агрегатной функции
 )
 
+// isUnaryPosition reports whether a sign at the current position is a prefix
+// operator: at the start of the expression or a statement, after an operator, "(", "[", "," or "=".
+func isUnaryPosition(tokens []token) bool {
+	if len(tokens) == 0 {
+		return true
+	}
+	switch tokens[len(tokens)-1].type_ {
+	case operator, unaryOperator, leftParen, leftBracket, comma, assign, semicolon:
+		return true
+	}
+	return false
+}
+
+func isIdentifierByte(b byte) bool {
+	return b == '_' || unicode.IsLetter(rune(b)) || unicode.IsDigit(rune(b))
+}
+
+// scanIdentifier returns the end of the name starting at start
+func scanIdentifier(s string, start int) int {
+	end := start
+	for end < len(s) {
+		r, size := utf8.DecodeRuneInString(s[end:])
+		if r != '_' && !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+			break
+		}
+		end += size
+	}
+	return end
+}
+
+// skipSpaces returns the position of the first non-space character at or after i
+func skipSpaces(s string, i int) int {
+	for i < len(s) {
+		r, size := utf8.DecodeRuneInString(s[i:])
+		if !unicode.IsSpace(r) {
+			break
+		}
+		i += size
+	}
+	return i
+}
+
 func tokenize(expression string) ([]token, error) {
 	var tokens []token
-	var current strings.Builder
-	parenCount := 0
+	emit := func(value string, type_ tokenType, start, end int) {
+		tokens = append(tokens, token{value, type_, start, expression[start:end]})
+	}
 
-	for i, ch := range expression {
+	for i := 0; i < len(expression); {
+		ch, size := utf8.DecodeRuneInString(expression[i:])
 		switch {
+		case unicode.IsSpace(ch):
+			i += size
+		case ch == '$':
+			// ссылка на результат другого выражения: $expr-<id> или короткая форма $<id>
+			start := i + 1
+			if strings.HasPrefix(expression[start:], "expr-") {
+				start += len("expr-")
+			}
+			end := start
+			for end < len(expression) && isDigitByte(expression[end]) {
+				end++
+			}
+			if end == start {
+				return nil, syntaxError(CodeInvalidReference, Span{i, end}, "invalid expression reference")
+			}
+			emit("expr-"+expression[start:end], reference, i, end)
+			i = end
+		case unicode.IsLetter(ch) || ch == '_':
+			end := scanIdentifier(expression, i)
+			name := expression[i:end]
+			if next := skipSpaces(expression, end); next < len(expression) && expression[next] == '(' {
+				// встроенная функция или функция пользователя, ее наличие проверяет expandFunctions
+				emit(name, function, i, end)
+			} else if mathops.IsFunction(name) {
+				return nil, syntaxError(CodeInvalidArguments, Span{i, end}, "function %s must be followed by an argument list", name)
+			} else {
+				// имя переменной или константы, значение подставляется в resolveIdentifiers
+				emit(name, identifier, i, end)
+			}
+			i = end
+		case ch == ',':
+			emit(",", comma, i, i+1)
+			i++
+		case ch == '=' && i+1 < len(expression) && expression[i+1] == '=':
+			emit("==", operator, i, i+2)
+			i += 2
+		case ch == '=':
+			emit("=", assign, i, i+1)
+			i++
+		case ch == '!' && i+1 < len(expression) && expression[i+1] == '=':
+			emit("!=", operator, i, i+2)
+			i += 2
+		case ch == '!':
+			emit("not", unaryOperator, i, i+1)
+			i++
+		case ch == '<' || ch == '>':
+			if i+1 < len(expression) && expression[i+1] == '=' {
+				emit(string(ch)+"=", operator, i, i+2)
+				i += 2
+			} else {
+				emit(string(ch), operator, i, i+1)
+				i++
+			}
+		case (ch == '&' || ch == '|') && i+1 < len(expression) && expression[i+1] == byte(ch):
+			emit(string(ch)+string(ch), operator, i, i+2)
+			i += 2
+		case ch == ';':
+			emit(";", semicolon, i, i+1)
+			i++
 		case unicode.IsDigit(ch) || ch == '.':
-			current.WriteRune(ch)
-			if i == len(expression)-1 || !(unicode.IsDigit(rune(expression[i+1])) || expression[i+1] == '.') {
-				tokens = append(tokens, token{current.String(), number})
-				current.Reset()
+			// литерал сразу приводится к каноническому виду: 1e6, 0xFF, 1_000 -> 1000000, 255, 1000
+			value, end, err := readNumber(expression, i)
+			if err != nil {
+				return nil, syntaxError(CodeInvalidNumber, Span{i, end}, "%v", err)
 			}
-		case ch == '+' || ch == '-' || ch == '*' || ch == '/':
-			if current.Len() > 0 {
-				tokens = append(tokens, token{current.String(), number})
-				current.Reset()
+			emit(value, number, i, end)
+			i = end
+		case ch == '+' || ch == '-' || ch == '*' || ch == '/' || ch == '^' || ch == '%':
+			switch {
+			case (ch == '+' || ch == '-') && isUnaryPosition(tokens):
+				// унарный минус становится neg, унарный плюс — pos, который parseUnary убирает из дерева
+				if ch == '-' {
+					emit("neg", unaryOperator, i, i+1)
+				} else {
+					emit("pos", unaryOperator, i, i+1)
+				}
+				i++
+			case ch == '/' && i+1 < len(expression) && expression[i+1] == '/':
+				emit("//", operator, i, i+2)
+				i += 2
+			default:
+				emit(string(ch), operator, i, i+1)
+				i++
 			}
-			tokens = append(tokens, token{string(ch), operator})
 		case ch == '(':
-			tokens = append(tokens, token{"(", leftParen})
-			parenCount++
+			emit("(", leftParen, i, i+1)
+			i++
 		case ch == ')':
-			if current.Len() > 0 {
-				tokens = append(tokens, token{current.String(), number})
-				current.Reset()
-			}
-			tokens = append(tokens, token{")", rightParen})
-			parenCount--
-			if parenCount < 0 {
-				return nil, fmt.Errorf("unbalanced parentheses")
-			}
+			emit(")", rightParen, i, i+1)
+			i++
+		case ch == '[':
+			emit("[", leftBracket, i, i+1)
+			i++
+		case ch == ']':
+			emit("]", rightBracket, i, i+1)
+			i++
+		default:
+			return nil, syntaxError(CodeInvalidCharacter, Span{i, i + size}, "invalid character %q", ch)
 		}
 	}
-	if parenCount != 0 {
-		return nil, fmt.Errorf("unbalanced parentheses")
-	}
 	return tokens, nil
 }
 
+// maxNestingDepth bounds the recursion of the parser, so that deeply nested
+// input like "((((...))))" is rejected instead of exhausting the stack
+const maxNestingDepth = 1000
+
+// unarySymbols maps prefix operators to their source form
+var unarySymbols = map[string]string{
+	"neg": "-",
+	"not": "!",
+}
+
 func precedence(op string) int {
 	switch op {
-	case "+", "-":
+	case "||":
 		return 1
-	case "*", "/":
+	case "&&":
 		return 2
+	case "<", "<=", ">", ">=", "==", "!=":
+		return 3
+	case "+", "-":
+		return 4
+	case "*", "/", "%", "//":
+		return 5
+	case "neg", "pos", "not":
+		return 6
+	case "^":
+		return 7
 	default:
 		return 0
 	}
 }
 
-func buildExpressionTree(tokens []token) (*Node, error) {
-	var outputQueue []*Node
-	var operatorStack []string
+// isRightAssociative reports whether a chain of op groups from the right: 2^3^2 = 2^(3^2)
+func isRightAssociative(op string) bool {
+	return op == "^"
+}
+
+// negateLiteral folds a unary minus into a numeric literal: "3" -> "-3", "-3" -> "3".
+func negateLiteral(value string) string {
+	if strings.HasPrefix(value, "-") {
+		return value[1:]
+	}
+	return "-" + value
+}
+
+// parser builds the expression tree from tokens by recursive descent:
+//
+//	script     := statement (";" statement)* [";"]
+//	statement  := [identifier "="] expression
+//	expression := unary (binary-operator unary)*   -- по приоритетам операторов
+//	unary      := ("-" | "+" | "!") unary | primary
+//	primary    := number | identifier | reference | function "(" arguments ")" | "(" expression ")" | list
+//	arguments  := expression ("," expression)*
+//	list       := "[" expression ("," expression)* "]"   -- вектор; вектор из векторов — матрица
+type parser struct {
+	tokens []token
+	pos    int
+	end    int // длина исходного выражения, позиция ошибки "неожиданный конец"
+	depth  int
+}
+
+// statement is a statement of a script: "name = expression" binds the value
+// to the name for the following statements; the value of the last statement
+// is the result of the script. A plain expression is a script of one statement
+type statement struct {
+	Name     string // пусто, если инструкция — просто выражение
+	NameSpan Span
+	Tree     *Node
+}
+
+// parse builds the statements of a script of length end from its tokens
+func parse(tokens []token, end int) ([]*statement, error) {
+	if len(tokens) == 0 {
+		return nil, syntaxError(CodeEmptyExpression, Span{0, 0}, "expression cannot be empty")
+	}
+	p := &parser{tokens: tokens, end: end}
+
+	var statements []*statement
+	for {
+		st, err := p.parseStatement()
+		if err != nil {
+			return nil, err
+		}
+		statements = append(statements, st)
 
-	for _, t := range tokens {
+		t, ok := p.peek()
+		if !ok {
+			return statements, nil
+		}
 		switch t.type_ {
-		case number:
-			outputQueue = append(outputQueue, &Node{Value: t.value})
-		case operator:
-			for len(operatorStack) > 0 &&
-				precedence(operatorStack[len(operatorStack)-1]) >= precedence(t.value) &&
-				operatorStack[len(operatorStack)-1] != "(" {
-				op := operatorStack[len(operatorStack)-1]
-				operatorStack = operatorStack[:len(operatorStack)-1]
-				if len(outputQueue) < 2 {
-					return nil, fmt.Errorf("invalid expression")
-				}
-				right := outputQueue[len(outputQueue)-1]
-				left := outputQueue[len(outputQueue)-2]
-				outputQueue = outputQueue[:len(outputQueue)-2]
-				outputQueue = append(outputQueue, &Node{
-					Value:    op,
-					Left:     left,
-					Right:    right,
-					Priority: precedence(op),
-				})
+		case semicolon:
+			p.pos++
+			// точка с запятой после последней инструкции допустима
+			if p.pos == len(p.tokens) {
+				return statements, nil
 			}
-			operatorStack = append(operatorStack, t.value)
-		case leftParen:
-			operatorStack = append(operatorStack, t.value)
 		case rightParen:
-			for len(operatorStack) > 0 && operatorStack[len(operatorStack)-1] != "(" {
-				op := operatorStack[len(operatorStack)-1]
-				operatorStack = operatorStack[:len(operatorStack)-1]
-				if len(outputQueue) < 2 {
-					return nil, fmt.Errorf("invalid expression")
-				}
-				right := outputQueue[len(outputQueue)-1]
-				left := outputQueue[len(outputQueue)-2]
-				outputQueue = outputQueue[:len(outputQueue)-2]
-				outputQueue = append(outputQueue, &Node{
-					Value:    op,
-					Left:     left,
-					Right:    right,
-					Priority: precedence(op),
-				})
-			}
-			if len(operatorStack) == 0 {
-				return nil, fmt.Errorf("unbalanced parentheses")
-			}
-			operatorStack = operatorStack[:len(operatorStack)-1]
+			return nil, syntaxError(CodeUnbalancedParentheses, t.span(), "unmatched closing parenthesis")
+		case rightBracket:
+			return nil, syntaxError(CodeUnbalancedParentheses, t.span(), "unmatched closing bracket")
+		case comma:
+			return nil, syntaxError(CodeUnexpectedToken, t.span(), "unexpected comma outside of a function call")
+		case assign:
+			return nil, syntaxError(CodeUnexpectedToken, t.span(), "only a name can be assigned")
+		default:
+			return nil, syntaxError(CodeUnexpectedToken, t.span(), "missing operator before %s", t.text)
+		}
+	}
+}
+
+// parseStatement parses an optional "name =" binding followed by an expression
+func (p *parser) parseStatement() (*statement, error) {
+	if t, ok := p.peek(); ok && t.type_ == semicolon {
+		return nil, syntaxError(CodeEmptyExpression, t.span(), "empty statement")
+	}
+
+	st := &statement{}
+	if p.pos+1 < len(p.tokens) && p.tokens[p.pos].type_ == identifier && p.tokens[p.pos+1].type_ == assign {
+		st.Name = p.tokens[p.pos].value
+		st.NameSpan = p.tokens[p.pos].span()
+		p.pos += 2
+	}
+
+	tree, err := p.parseExpression(0)
+	if err != nil {
+		return nil, err
+	}
+	st.Tree = tree
+	return st, nil
+}
+
+func (p *parser) peek() (token, bool) {
+	if p.pos >= len(p.tokens) {
+		return token{}, false
+	}
+	return p.tokens[p.pos], true
+}
+
+// parseExpression parses operands joined by binary operators binding at least as tight as minPrecedence
+func (p *parser) parseExpression(minPrecedence int) (*Node, error) {
+	p.depth++
+	defer func() { p.depth-- }()
+	if p.depth > maxNestingDepth {
+		t, _ := p.peek()
+		return nil, syntaxError(CodeUnexpectedToken, t.span(), "expression is nested too deeply")
+	}
+
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		t, ok := p.peek()
+		if !ok || t.type_ != operator || precedence(t.value) < minPrecedence {
+			return left, nil
+		}
+		p.pos++
+
+		// правоассоциативный оператор забирает справа цепочку того же приоритета
+		next := precedence(t.value) + 1
+		if isRightAssociative(t.value) {
+			next = precedence(t.value)
+		}
+		right, err := p.parseExpression(next)
+		if err != nil {
+			return nil, err
+		}
+		left = &Node{
+			Kind:  BinaryNode,
+			Value: t.value,
+			Left:  left,
+			Right: right,
+			Span:  Span{left.Span.Start, right.Span.End},
 		}
 	}
+}
 
-	for len(operatorStack) > 0 {
-		op := operatorStack[len(operatorStack)-1]
-		operatorStack = operatorStack[:len(operatorStack)-1]
-		if len(outputQueue) < 2 {
-			return nil, fmt.Errorf("invalid expression")
+// parseUnary parses a prefix minus, plus or "!"; they bind tighter than * and / but looser than ^, so -2^2 = -(2^2).
+// Unary plus is the identity and leaves no node of its own
+func (p *parser) parseUnary() (*Node, error) {
+	t, ok := p.peek()
+	if !ok || t.type_ != unaryOperator {
+		return p.parsePrimary()
+	}
+	p.pos++
+
+	operand, err := p.parseExpression(precedence(t.value))
+	if err != nil {
+		return nil, err
+	}
+	span := Span{t.pos, operand.Span.End}
+	if t.value == "pos" {
+		operand.Span = span
+		return operand, nil
+	}
+	if t.value == "neg" && isLiteral(operand) {
+		return &Node{Kind: NumberNode, Value: negateLiteral(operand.Value), Span: span}, nil
+	}
+	return &Node{Kind: UnaryNode, Value: t.value, Left: operand, Span: span}, nil
+}
+
+// parsePrimary parses an operand: a literal, a name, a reference, a call or a parenthesized expression
+func (p *parser) parsePrimary() (*Node, error) {
+	t, ok := p.peek()
+	if !ok {
+		return nil, syntaxError(CodeUnexpectedEnd, Span{p.end, p.end}, "unexpected end of expression")
+	}
+
+	switch t.type_ {
+	case number:
+		p.pos++
+		return &Node{Kind: NumberNode, Value: t.value, Span: t.span()}, nil
+	case identifier:
+		p.pos++
+		return &Node{Kind: IdentifierNode, Value: t.value, Span: t.span()}, nil
+	case reference:
+		p.pos++
+		return &Node{Kind: ReferenceNode, Value: t.value, Span: t.span()}, nil
+	case function:
+		return p.parseCall()
+	case leftParen:
+		p.pos++
+		inner, err := p.parseExpression(0)
+		if err != nil {
+			return nil, err
+		}
+		closing, err := p.expectClosing(t, false)
+		if err != nil {
+			return nil, err
 		}
-		right := outputQueue[len(outputQueue)-1]
-		left := outputQueue[len(outputQueue)-2]
-		outputQueue = outputQueue[:len(outputQueue)-2]
-		outputQueue = append(outputQueue, &Node{
-			Value:    op,
-			Left:     left,
-			Right:    right,
-			Priority: precedence(op),
-		})
+		// скобки входят в диапазон узла, чтобы ошибка указывала на всю группу
+		inner.Span = Span{t.pos, closing.span().End}
+		return inner, nil
+	case leftBracket:
+		return p.parseList()
+	case rightParen:
+		if p.pos > 0 && p.tokens[p.pos-1].type_ == leftParen {
+			return nil, syntaxError(CodeUnexpectedToken, t.span(), "empty parentheses")
+		}
+		return nil, syntaxError(CodeUnexpectedToken, t.span(), "missing operand before )")
+	default:
+		return nil, syntaxError(CodeUnexpectedToken, t.span(), "missing operand before %s", t.text)
+	}
+}
+
+// parseCall parses a function call; tokenize guarantees the name is followed by "("
+func (p *parser) parseCall() (*Node, error) {
+	name := p.tokens[p.pos]
+	open := p.tokens[p.pos+1]
+	p.pos += 2
+
+	var args []*Node
+	for {
+		arg, err := p.parseExpression(0)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+
+		if t, ok := p.peek(); ok && t.type_ == comma {
+			p.pos++
+			continue
+		}
+		closing, err := p.expectClosing(open, true)
+		if err != nil {
+			return nil, err
+		}
+		if err := checkArity(name.value, len(args), name.span()); err != nil {
+			return nil, err
+		}
+		return &Node{Kind: CallNode, Value: name.value, Args: args, Span: Span{name.pos, closing.span().End}}, nil
+	}
+}
+
+// checkArity checks the number of arguments of a call of a built-in function;
+// calls of user functions are checked when their bodies are substituted, since
+// the function may be defined or changed after the expression is parsed
+func checkArity(name string, count int, span Span) error {
+	if !mathops.IsFunction(name) {
+		return nil
+	}
+	if err := mathops.CheckArity(name, count); err != nil {
+		return syntaxError(CodeInvalidArguments, span, "%v", err)
 	}
+	return nil
+}
+
+// parseList parses a list of values "[a, b, ...]": a vector, or a matrix if
+// the values are vectors themselves; the shapes are checked by expandMatrices
+func (p *parser) parseList() (*Node, error) {
+	open := p.tokens[p.pos]
+	p.pos++
+	if t, ok := p.peek(); ok && t.type_ == rightBracket {
+		return nil, syntaxError(CodeInvalidList, Span{open.pos, t.span().End}, "list cannot be empty")
+	}
+
+	var values []*Node
+	for {
+		value, err := p.parseExpression(0)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
 
-	if len(outputQueue) != 1 {
-		return nil, fmt.Errorf("invalid expression")
+		t, ok := p.peek()
+		switch {
+		case !ok || t.type_ == rightParen:
+			return nil, syntaxError(CodeUnbalancedParentheses, open.span(), "unclosed bracket")
+		case t.type_ == comma:
+			p.pos++
+		case t.type_ == rightBracket:
+			p.pos++
+			return &Node{Kind: ListNode, Args: values, Span: Span{open.pos, t.span().End}}, nil
+		default:
+			return nil, syntaxError(CodeUnexpectedToken, t.span(), "missing operator before %s", t.text)
+		}
+	}
+}
+
+// expectClosing consumes the ")" matching open; inCall tells whether commas are allowed before it
+func (p *parser) expectClosing(open token, inCall bool) (token, error) {
+	t, ok := p.peek()
+	switch {
+	case !ok:
+		return token{}, syntaxError(CodeUnbalancedParentheses, open.span(), "unclosed parenthesis")
+	case t.type_ == rightParen:
+		p.pos++
+		return t, nil
+	case t.type_ == comma && !inCall:
+		return token{}, syntaxError(CodeUnexpectedToken, t.span(), "unexpected comma outside of a function call")
+	default:
+		return token{}, syntaxError(CodeUnexpectedToken, t.span(), "missing operator before %s", t.text)
 	}
-	return outputQueue[0], nil
 }
@@ -0,0 +1,201 @@
+package calculator
+
+import (
+	"calc-service/pkg/mathops"
+	"errors"
+	"testing"
+)
+
+func TestParsePrecedence(t *testing.T) {
+	tests := []struct {
+		expr string
+		want string
+	}{
+		// приоритеты
+		{"1 + 2 * 3", "(+ 1 (* 2 3))"},
+		{"1 * 2 + 3", "(+ (* 1 2) 3)"},
+		{"2 * 3 ^ 2", "(* 2 (^ 3 2))"},
+		{"6 // 4 % 3 * 2", "(* (% (// 6 4) 3) 2)"},
+		{"-2 ^ 2", "(neg (^ 2 2))"},
+		{"-x * y", "(* (neg x) y)"},
+		{"-(1 + 2)", "(neg (+ 1 2))"},
+		{"!x && y", "(&& (not x) y)"},
+		{"1 + 2 < 4 && 3 == 3 || 0", "(|| (&& (< (+ 1 2) 4) (== 3 3)) 0)"},
+		{"(1 + 2) * 3", "(* (+ 1 2) 3)"},
+		{"2 * -3", "(* 2 -3)"},
+		{"2 ^ -x", "(^ 2 (neg x))"},
+		// унарный плюс — тождество и узла не создает
+		{"2 * +-3", "(* 2 -3)"},
+		{"+x ^ 2", "(^ x 2)"},
+		{"-+x", "(neg x)"},
+		// ассоциативность
+		{"1 - 2 - 3", "(- (- 1 2) 3)"},
+		{"8 / 4 / 2", "(/ (/ 8 4) 2)"},
+		{"2 ^ 3 ^ 2", "(^ 2 (^ 3 2))"},
+		{"1 < 2 < 3", "(< (< 1 2) 3)"},
+		{"a || b || c", "(|| (|| a b) c)"},
+		{"--x", "(neg (neg x))"},
+		// вызовы и списки
+		{"max(1, 2 + 3) * 2", "(* (max 1 (+ 2 3)) 2)"},
+		{"sum([1, 2], 3)", "(sum (list 1 2) 3)"},
+		{"[[1, 2], [3, 4]] * [5, 6]", "(* (list (list 1 2) (list 3 4)) (list 5 6))"},
+		{"round(sqrt(2), 1)", "(round (sqrt 2) 1)"},
+		{"if(x > 0, 1, -1)", "(if (> x 0) 1 -1)"},
+	}
+
+	for _, tt := range tests {
+		statements, err := parseExpression(tt.expr)
+		if err != nil {
+			t.Errorf("%q: %v", tt.expr, err)
+			continue
+		}
+		if got := treeString(statements[0].Tree); got != tt.want {
+			t.Errorf("%q: got %s, want %s", tt.expr, got, tt.want)
+		}
+	}
+}
+
+func TestParseSpans(t *testing.T) {
+	statements, err := parseExpression("1 + (2 * 3)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := statements[0].Tree
+	if root.Span != (Span{0, 11}) {
+		t.Errorf("root span: got %v, want {0 11}", root.Span)
+	}
+	// скобки входят в диапазон группы
+	if root.Right.Span != (Span{4, 11}) {
+		t.Errorf("group span: got %v, want {4 11}", root.Right.Span)
+	}
+	if root.Left.Span != (Span{0, 1}) {
+		t.Errorf("literal span: got %v, want {0 1}", root.Left.Span)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		expr   string
+		code   string
+		offset int
+		token  string
+	}{
+		{"1..2", CodeInvalidNumber, 0, "1..2"},
+		{"0x", CodeInvalidNumber, 0, "0x"},
+		{"1__0", CodeInvalidNumber, 0, "1__0"},
+		{"(1+2", CodeUnbalancedParentheses, 0, "("},
+		{"1 + (2 * (3 - 4)", CodeUnbalancedParentheses, 4, "("},
+		{"1+2)", CodeUnbalancedParentheses, 3, ")"},
+		{"(1+2))*3", CodeUnbalancedParentheses, 5, ")"},
+		{"sum([1,2)", CodeUnbalancedParentheses, 4, "["},
+		{"1]", CodeUnbalancedParentheses, 1, "]"},
+		{"[1, 2", CodeUnbalancedParentheses, 0, "["},
+		{"sum([])", CodeInvalidList, 4, "[]"},
+		{"", CodeEmptyExpression, 0, ""},
+		{"1;;2", CodeEmptyExpression, 2, ";"},
+		{"x=", CodeUnexpectedEnd, 2, ""},
+		{"1=2", CodeUnexpectedToken, 1, "="},
+		{"1+", CodeUnexpectedEnd, 2, ""},
+		{"1 + +", CodeUnexpectedEnd, 5, ""},
+		{"*2", CodeUnexpectedToken, 0, "*"},
+		{"2 3", CodeUnexpectedToken, 2, "3"},
+		{"()", CodeUnexpectedToken, 1, ")"},
+		{"max(1,)", CodeUnexpectedToken, 6, ")"},
+		{"1 + @", CodeInvalidCharacter, 4, "@"},
+		{"sqrt(1,2)", CodeInvalidArguments, 0, "sqrt"},
+		{"$", CodeInvalidReference, 0, "$"},
+	}
+
+	for _, tt := range tests {
+		err := ValidateExpression(tt.expr, mathops.ModeFloat)
+		var syntaxErr *SyntaxError
+		if !errors.As(err, &syntaxErr) {
+			t.Errorf("%q: got %v, want a syntax error", tt.expr, err)
+			continue
+		}
+		if syntaxErr.Code != tt.code || syntaxErr.Offset != tt.offset || syntaxErr.Token != tt.token {
+			t.Errorf("%q: got %s at %d (%q), want %s at %d (%q)",
+				tt.expr, syntaxErr.Code, syntaxErr.Offset, syntaxErr.Token, tt.code, tt.offset, tt.token)
+		}
+	}
+}
+
+// FuzzParse checks that no input makes the parser panic, that errors are
+// syntax errors pointing inside the input, that every node of a parsed
+// expression spans a part of it and that the canonical form parses back
+func FuzzParse(f *testing.F) {
+	for _, seed := range []string{"1+2*3", "-(2^-x)", "max(1,2,3)/4", "x=1;y=x*2;y", "2 3 4 * +", "(+ 1 (* 2 3))", "[[1,2],[3,4]]*[5,6]", "2*+-3"} {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, expr string) {
+		for _, mode := range []string{mathops.ModeFloat, mathops.ModeDecimal, mathops.ModeInteger} {
+			checkSyntaxError(t, expr, ValidateExpression(expr, mode))
+		}
+		for _, syntax := range []string{SyntaxRPN, SyntaxSExpr} {
+			_, _, err := parseSource(expr, syntax)
+			checkSyntaxError(t, expr, annotate(expr, err))
+		}
+
+		tokens, err := tokenize(expr)
+		if err != nil {
+			checkSyntaxError(t, expr, annotate(expr, err))
+			return
+		}
+		statements, err := parse(tokens, len(expr))
+		if err != nil {
+			checkSyntaxError(t, expr, annotate(expr, err))
+			return
+		}
+		for _, st := range statements {
+			walk(st.Tree, func(n *Node) error {
+				if n.Span.Start < 0 || n.Span.Start > n.Span.End || n.Span.End > len(expr) {
+					t.Fatalf("%q: node %s spans %v outside the expression", expr, n.Value, n.Span)
+				}
+				return nil
+			})
+		}
+
+		// каноническая запись разбирается обратно и не меняется при повторном форматировании
+		canonical := formatScript(statements)
+		again, err := parseExpression(canonical)
+		if err != nil {
+			t.Fatalf("%q: canonical form %q does not parse: %v", expr, canonical, err)
+		}
+		if text := formatScript(again); text != canonical {
+			t.Fatalf("%q: canonical form %q is not stable: %q", expr, canonical, text)
+		}
+	})
+}
+
+func checkSyntaxError(t *testing.T, expr string, err error) {
+	t.Helper()
+	if err == nil {
+		return
+	}
+	var syntaxErr *SyntaxError
+	if !errors.As(err, &syntaxErr) {
+		t.Fatalf("%q: got %T %v, want a syntax error", expr, err, err)
+	}
+	if syntaxErr.Offset < 0 || syntaxErr.Offset > len(expr) {
+		t.Fatalf("%q: error offset %d is outside the expression", expr, syntaxErr.Offset)
+	}
+}
+
+// treeString prints the structure of a tree in prefix form, "(* (+ 1 2) 3)",
+// to compare trees in tests
+func treeString(n *Node) string {
+	children := n.Operands()
+	if len(children) == 0 {
+		return n.Value
+	}
+	name := n.Value
+	if n.Kind == ListNode {
+		name = "list"
+	}
+	s := "(" + name
+	for _, child := range children {
+		s += " " + treeString(child)
+	}
+	return s + ")"
+}
@@ -0,0 +1,255 @@
+package calculator
+
+import (
+	"calc-service/internal/store"
+	"calc-service/pkg/mathops"
+	"container/heap"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// Plan is the result of a dry run: the tasks an expression would be split into
+// and how long their calculation is expected to take
+type Plan struct {
+	Expression string      `json:"expression"` // каноническая запись
+	Mode       string      `json:"mode"`
+	Result     string      `json:"result,omitempty"` // выражение без операций вычисляется сразу
+	Tasks      []*PlanTask `json:"tasks"`
+	TaskCount  int         `json:"task_count"`
+
+	Depth          int `json:"depth"`           // глубина дерева выражения
+	OptimizedDepth int `json:"optimized_depth"` // глубина после свёртки констант и перебалансировки
+
+	Bindings []store.Binding `json:"bindings,omitempty"` // привязки сценария и задачи, вычисляющие их
+	Matrix   *store.Matrix   `json:"matrix,omitempty"`   // элементы результата-вектора или матрицы
+
+	// CriticalPath is the longest chain of dependent tasks; no number of agents
+	// computes the expression faster than CriticalPathMs
+	CriticalPath       []string `json:"critical_path"`
+	CriticalPathLength int      `json:"critical_path_length"`
+	CriticalPathMs     int      `json:"critical_path_ms"`
+
+	Workers     int `json:"workers"`      // число вычислителей, на которое рассчитана оценка
+	EstimatedMs int `json:"estimated_ms"` // оценка времени вычисления на Workers вычислителях
+}
+
+// PlanTask is a task of the plan; tasks are numbered t1, t2, ... in the order
+// they would be registered, so that dependencies come first
+type PlanTask struct {
+	ID            string   `json:"id"`
+	Operation     string   `json:"operation"`
+	Args          []string `json:"args"`
+	DependsOn     []string `json:"depends_on,omitempty"`
+	OperationTime int      `json:"operation_time"`
+	StartMs       int      `json:"start_ms"`
+	FinishMs      int      `json:"finish_ms"`
+	Guard         *Guard   `json:"guard,omitempty"`
+
+	deps []int // индексы задач, от которых зависит задача
+}
+
+// Guard tells that a task is needed only when the condition computed by Task
+// evaluates to Value; otherwise the task is cancelled
+type Guard struct {
+	Task  string `json:"task"`
+	Value bool   `json:"value"`
+}
+
+// PlanExpression does everything ProcessExpression does up to task
+// registration and estimates the calculation time on the given number of
+// workers; nothing is written to the store
+func PlanExpression(exprStr string, userID string, opts Options, workers int) (*Plan, error) {
+	c, err := compile(exprStr, userID, &opts)
+	if err != nil {
+		return nil, err
+	}
+	if workers < 1 {
+		workers = 1
+	}
+
+	plan := &Plan{Expression: c.canonical, Mode: opts.Mode, Depth: c.depth, OptimizedDepth: c.optimizedDepth, Tasks: []*PlanTask{}, CriticalPath: []string{}, Workers: workers}
+
+	tasks, bindings, err := createScriptTasks("", c)
+	if err != nil {
+		return nil, err
+	}
+	plan.Bindings = bindings
+	if isList(c.tree) {
+		plan.Matrix = newMatrix(c.tree)
+		if len(tasks) == 0 {
+			if plan.Matrix.Result, err = MatrixValues(plan.Matrix, opts.Mode); err != nil {
+				return nil, err
+			}
+			return plan, nil
+		}
+	}
+	if len(tasks) == 0 {
+		value, err := mathops.Normalize(opts.Mode, c.tree.Value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid operand: %s", c.tree.Value)
+		}
+		plan.Result = value
+		return plan, nil
+	}
+
+	// uuid задач ничего не говорят пользователю: нумеруем их по порядку
+	index := make(map[string]int, len(tasks))
+	for i, task := range tasks {
+		planTask := &PlanTask{ID: fmt.Sprintf("t%d", i+1), Operation: task.Operator, OperationTime: task.OperationTime}
+
+		for _, arg := range task.Operands() {
+			// ссылки на задачи других выражений остаются как есть
+			if id, ok := strings.CutPrefix(arg, "task:"); ok {
+				if dep, ok := index[id]; ok {
+					arg = "task:" + plan.Tasks[dep].ID
+					if !slices.Contains(planTask.deps, dep) {
+						planTask.deps = append(planTask.deps, dep)
+						planTask.DependsOn = append(planTask.DependsOn, plan.Tasks[dep].ID)
+					}
+				}
+			}
+			planTask.Args = append(planTask.Args, arg)
+		}
+		if dep, ok := index[task.Guard]; ok {
+			planTask.Guard = &Guard{Task: plan.Tasks[dep].ID, Value: task.GuardValue}
+			// задача ветви ждет условия, как и своих аргументов
+			if !slices.Contains(planTask.deps, dep) {
+				planTask.deps = append(planTask.deps, dep)
+			}
+		}
+		plan.Tasks = append(plan.Tasks, planTask)
+		index[task.ID] = i
+	}
+	plan.TaskCount = len(plan.Tasks)
+	for i, b := range plan.Bindings {
+		if dep, ok := index[b.TaskID]; ok {
+			plan.Bindings[i].TaskID = plan.Tasks[dep].ID
+		}
+		if b.Matrix != nil {
+			renameElements(b.Matrix, plan.Tasks, index)
+		}
+	}
+	if plan.Matrix != nil {
+		renameElements(plan.Matrix, plan.Tasks, index)
+	}
+
+	plan.CriticalPath, plan.CriticalPathMs = criticalPath(plan.Tasks)
+	plan.CriticalPathLength = len(plan.CriticalPath)
+	plan.EstimatedMs = schedule(plan.Tasks, workers)
+	return plan, nil
+}
+
+// renameElements refers to the tasks of the plan in the elements of a matrix
+func renameElements(m *store.Matrix, tasks []*PlanTask, index map[string]int) {
+	for i, element := range m.Elements {
+		if id, ok := strings.CutPrefix(element, "task:"); ok {
+			if dep, ok := index[id]; ok {
+				m.Elements[i] = "task:" + tasks[dep].ID
+			}
+		}
+	}
+}
+
+// criticalPath finds the chain of dependent tasks with the largest total
+// operation time; tasks must be ordered so that dependencies come first. Of
+// chains of the same time the one ending later wins, so the tasks computed
+// without time at the end of a chain, like the root if, stay on the path
+func criticalPath(tasks []*PlanTask) ([]string, int) {
+	length := make([]int, len(tasks))
+	prev := make([]int, len(tasks))
+	last := 0
+	for i, task := range tasks {
+		prev[i] = -1
+		for _, dep := range task.deps {
+			if prev[i] < 0 || length[dep] > length[prev[i]] {
+				prev[i] = dep
+			}
+		}
+		length[i] = task.OperationTime
+		if prev[i] >= 0 {
+			length[i] += length[prev[i]]
+		}
+		if length[i] >= length[last] {
+			last = i
+		}
+	}
+
+	var path []string
+	for i := last; i >= 0; i = prev[i] {
+		path = append(path, tasks[i].ID)
+	}
+	for l, r := 0, len(path)-1; l < r; l, r = l+1, r-1 {
+		path[l], path[r] = path[r], path[l]
+	}
+	return path, length[last]
+}
+
+// schedule simulates the calculation on the given number of workers: a free
+// worker always takes the task that became executable first. It fills in the
+// start and finish time of every task and returns the total time
+func schedule(tasks []*PlanTask, workers int) int {
+	waiting := make([]int, len(tasks))
+	readyAt := make([]int, len(tasks))
+	dependents := make([][]int, len(tasks))
+	ready := &eventQueue{}
+	for i, task := range tasks {
+		waiting[i] = len(task.deps)
+		for _, dep := range task.deps {
+			dependents[dep] = append(dependents[dep], i)
+		}
+		if waiting[i] == 0 {
+			heap.Push(ready, event{at: 0, index: i})
+		}
+	}
+
+	free := &eventQueue{}
+	for i := 0; i < workers; i++ {
+		heap.Push(free, event{at: 0, index: i})
+	}
+
+	total := 0
+	for ready.Len() > 0 {
+		next := heap.Pop(ready).(event)
+		worker := heap.Pop(free).(event)
+
+		task := tasks[next.index]
+		task.StartMs = max(next.at, worker.at)
+		task.FinishMs = task.StartMs + task.OperationTime
+		total = max(total, task.FinishMs)
+		heap.Push(free, event{at: task.FinishMs, index: worker.index})
+
+		for _, d := range dependents[next.index] {
+			readyAt[d] = max(readyAt[d], task.FinishMs)
+			if waiting[d]--; waiting[d] == 0 {
+				heap.Push(ready, event{at: readyAt[d], index: d})
+			}
+		}
+	}
+	return total
+}
+
+// event is a moment a task becomes executable or a worker becomes free
+type event struct {
+	at    int
+	index int
+}
+
+// eventQueue is a min-heap of events ordered by time, then by index
+type eventQueue []event
+
+func (q eventQueue) Len() int { return len(q) }
+func (q eventQueue) Less(i, j int) bool {
+	if q[i].at != q[j].at {
+		return q[i].at < q[j].at
+	}
+	return q[i].index < q[j].index
+}
+func (q eventQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+func (q *eventQueue) Push(x any)   { *q = append(*q, x.(event)) }
+func (q *eventQueue) Pop() any {
+	old := *q
+	e := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return e
+}
@@ -0,0 +1,81 @@
+package calculator
+
+import (
+	"calc-service/pkg/mathops"
+	"reflect"
+	"testing"
+)
+
+func TestPlanExpression(t *testing.T) {
+	t.Setenv("TIME_ADDITION_MS", "100")
+	t.Setenv("TIME_MULTIPLICATIONS_MS", "200")
+
+	tests := []struct {
+		expr      string
+		workers   int
+		path      []string
+		pathMs    int
+		estimated int
+	}{
+		// две суммы независимы: второй вычислитель сокращает время до критического пути
+		{"(1+2)*(3+4)", 1, []string{"t1", "t3"}, 300, 400},
+		{"(1+2)*(3+4)", 2, []string{"t1", "t3"}, 300, 300},
+		{"1+2+3+4", 4, []string{"t1", "t2", "t3"}, 300, 300},
+		{"1*2+3*4+5*6", 2, []string{"t1", "t3", "t5"}, 400, 500},
+		// ветви ждут условия, а выбор ветви if занимает TIME_CONDITIONAL_MS
+		{"if(1<2*1,3*3,4*4)", 2, []string{"t1", "t2", "t3", "t5"}, 600, 600},
+		{"if(1<2*1,3*3,4*4)", 1, []string{"t1", "t2", "t3", "t5"}, 600, 800},
+	}
+
+	for _, tt := range tests {
+		plan, err := PlanExpression(tt.expr, "user-plan", Options{Mode: mathops.ModeFloat}, tt.workers)
+		if err != nil {
+			t.Errorf("%q: %v", tt.expr, err)
+			continue
+		}
+		if !reflect.DeepEqual(plan.CriticalPath, tt.path) || plan.CriticalPathMs != tt.pathMs {
+			t.Errorf("%q: got critical path %v (%d ms), want %v (%d ms)",
+				tt.expr, plan.CriticalPath, plan.CriticalPathMs, tt.path, tt.pathMs)
+		}
+		if plan.EstimatedMs != tt.estimated {
+			t.Errorf("%q on %d workers: got %d ms, want %d ms", tt.expr, tt.workers, plan.EstimatedMs, tt.estimated)
+		}
+	}
+}
+
+func TestPlanExpressionWithoutTasks(t *testing.T) {
+	plan, err := PlanExpression("0x10", "user-plan", Options{Mode: mathops.ModeFloat}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plan.Result != "16" || plan.TaskCount != 0 || plan.EstimatedMs != 0 || plan.Workers != 1 {
+		t.Errorf("got result %q, %d tasks, %d ms on %d workers, want 16 without tasks",
+			plan.Result, plan.TaskCount, plan.EstimatedMs, plan.Workers)
+	}
+}
+
+func TestSchedule(t *testing.T) {
+	// t3 ждет t1 и t2, t4 независима
+	tasks := []*PlanTask{
+		{ID: "t1", OperationTime: 100},
+		{ID: "t2", OperationTime: 300},
+		{ID: "t3", OperationTime: 100, deps: []int{0, 1}},
+		{ID: "t4", OperationTime: 200},
+	}
+
+	if total := schedule(tasks, 2); total != 400 {
+		t.Errorf("got %d ms, want 400", total)
+	}
+	// свободный вычислитель берет задачу, которая стала готовой раньше
+	want := [][2]int{{0, 100}, {0, 300}, {300, 400}, {100, 300}}
+	for i, task := range tasks {
+		if got := [2]int{task.StartMs, task.FinishMs}; got != want[i] {
+			t.Errorf("%s: got %v, want %v", task.ID, got, want[i])
+		}
+	}
+
+	path, ms := criticalPath(tasks)
+	if !reflect.DeepEqual(path, []string{"t2", "t3"}) || ms != 400 {
+		t.Errorf("got critical path %v (%d ms), want [t2 t3] (400 ms)", path, ms)
+	}
+}
@@ -0,0 +1,47 @@
+package calculator
+
+import (
+	"calc-service/pkg/mathops"
+	"strconv"
+)
+
+// planReductions splits the aggregate functions into tasks the agents compute
+// in parallel: sum and product become balanced trees of "+" and "*", so that
+// n values take about log2(n) steps instead of n-1; avg becomes such a sum
+// followed by the internal "mean" (sum, count). median needs all the values
+// at once and stays a single task; like "mean" it is finished by the
+// orchestrator itself
+func planReductions(n *Node) *Node {
+	for _, slot := range n.operandSlots() {
+		*slot = planReductions(*slot)
+	}
+	if n.Kind != CallNode || !mathops.IsAggregate(n.Value) {
+		return n
+	}
+	if len(n.Args) == 1 {
+		// агрегат одного значения — само значение
+		return n.Args[0]
+	}
+
+	switch n.Value {
+	case "sum":
+		return reduce("+", n.Args, n.Span)
+	case "product":
+		return reduce("*", n.Args, n.Span)
+	case "avg":
+		count := &Node{Kind: NumberNode, Value: strconv.Itoa(len(n.Args)), Span: n.Span}
+		return &Node{Kind: BinaryNode, Value: "mean", Left: reduce("+", n.Args, n.Span), Right: count, Span: n.Span}
+	default:
+		return n
+	}
+}
+
+// reduce joins the values with op into a balanced tree: halves are reduced
+// independently, so the tasks of each level don't depend on each other
+func reduce(op string, values []*Node, span Span) *Node {
+	if len(values) == 1 {
+		return values[0]
+	}
+	mid := len(values) / 2
+	return &Node{Kind: BinaryNode, Value: op, Left: reduce(op, values[:mid], span), Right: reduce(op, values[mid:], span), Span: span}
+}
@@ -0,0 +1,37 @@
+package calculator
+
+import "testing"
+
+func TestPlanReductions(t *testing.T) {
+	tests := []struct {
+		expr string
+		want string
+	}{
+		// сумма и произведение — сбалансированные деревья: log2(n) шагов вместо n-1
+		{"sum(1, 2, 3, 4)", "(+ (+ 1 2) (+ 3 4))"},
+		{"sum(1, 2, 3)", "(+ 1 (+ 2 3))"},
+		{"product([1, 2], 3, 4)", "(* (* 1 2) (* 3 4))"},
+		// среднее — сумма и ее завершение mean(сумма, число значений)
+		{"avg(1, 2, 3)", "(mean (+ 1 (+ 2 3)) 3)"},
+		{"sum(1, avg([2, 4]))", "(+ 1 (mean (+ 2 4) 2))"},
+		// медиане нужны все значения сразу
+		{"median(3, 1, 2)", "(median 3 1 2)"},
+		// агрегат одного значения — само значение
+		{"sum(5) * 2", "(* 5 2)"},
+		{"max(sum(1, 2), 3)", "(max (+ 1 2) 3)"},
+	}
+
+	for _, tt := range tests {
+		statements, err := parseExpression(tt.expr)
+		if err != nil {
+			t.Fatalf("%q: %v", tt.expr, err)
+		}
+		tree, err := expandMatrices(statements[0].Tree, newScope())
+		if err != nil {
+			t.Fatalf("%q: %v", tt.expr, err)
+		}
+		if got := treeString(planReductions(tree)); got != tt.want {
+			t.Errorf("%q: got %s, want %s", tt.expr, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package calculator
+
+import (
+	"calc-service/internal/store"
+)
+
+// resolveReferences replaces references to other expressions of the same user
+// ($expr-<id>) with their results in the tree. A reference to an expression that is still
+// being calculated becomes a dependency on its root task, so the new tasks wait
+// for it through the usual "task:" mechanism.
+func resolveReferences(tree *Node, userID string) error {
+	return walk(tree, func(n *Node) error {
+		if n.Kind != ReferenceNode {
+			return nil
+		}
+
+		// чужие выражения не отличаем от несуществующих
+		expr, found := store.GetUserExpression(n.Value, userID)
+		if !found {
+			return syntaxError(CodeUnknownReference, n.Span, "referenced expression %s not found", n.Value)
+		}
+
+		if expr.Matrix != nil {
+			return syntaxError(CodeInvalidReference, n.Span, "referenced expression %s is a vector or a matrix", n.Value)
+		}
+
+		switch expr.Status {
+		case "completed":
+			n.Kind = NumberNode
+			n.Value = expr.Exact()
+		case "pending", "in_progress":
+			rootID, found := store.GetRootTaskID(expr.ID)
+			if !found {
+				return syntaxError(CodeInvalidReference, n.Span, "referenced expression %s has no tasks", n.Value)
+			}
+			n.Kind = TaskRefNode
+			n.Value = "task:" + rootID
+			n.TaskID = rootID
+		default:
+			return syntaxError(CodeInvalidReference, n.Span, "referenced expression %s has status %s", n.Value, expr.Status)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,89 @@
+package calculator
+
+import (
+	"calc-service/internal/store"
+	"calc-service/pkg/mathops"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// newReferencedExpression stores an expression of the user with the given
+// status and returns the reference to it, "$<id>"
+func newReferencedExpression(t *testing.T, userID, status, result string) (*store.Expression, string) {
+	t.Helper()
+	expr, err := store.NewExpression("1+1", userID, mathops.ModeDecimal, 1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != "pending" {
+		if err := store.UpdateExpressionStatus(expr.ID, status, mathops.ToFloat(result), result); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return expr, "$" + strings.TrimPrefix(expr.ID, "expr-")
+}
+
+func TestResolveReferences(t *testing.T) {
+	const userID = "user-references"
+	_, completed := newReferencedExpression(t, userID, "completed", "6")
+	_, exact := newReferencedExpression(t, userID, "completed", "1/3")
+	pending, running := newReferencedExpression(t, userID, "pending", "")
+	root := &store.Task{ID: "task-references-root", Arg1: "1", Arg2: "1", Operator: "+"}
+	if err := store.RegisterTasks(pending.ID, userID, []*store.Task{root}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		expr string
+		kind NodeKind
+		want string
+	}{
+		// вычисленное выражение подставляется точным результатом
+		{completed + " * 2", NumberNode, "6"},
+		{exact + " * 3", NumberNode, "1/3"},
+		// невычисленное — ссылкой на свою корневую задачу
+		{running + " * 2", TaskRefNode, "task:" + root.ID},
+	}
+	for _, tt := range tests {
+		statements, err := parseExpression(tt.expr)
+		if err != nil {
+			t.Fatalf("%q: %v", tt.expr, err)
+		}
+		tree := statements[0].Tree
+		if err := resolveReferences(tree, userID); err != nil {
+			t.Errorf("%q: %v", tt.expr, err)
+			continue
+		}
+		if ref := tree.Left; ref.Kind != tt.kind || ref.Value != tt.want {
+			t.Errorf("%q: got %s, want %s", tt.expr, ref.Value, tt.want)
+		}
+	}
+}
+
+func TestResolveReferencesErrors(t *testing.T) {
+	const userID = "user-references-errors"
+	_, failed := newReferencedExpression(t, userID, "error", "")
+	// чужое выражение не отличается от несуществующего
+	_, foreign := newReferencedExpression(t, "user-references-other", "completed", "1")
+
+	tests := []struct {
+		expr string
+		code string
+	}{
+		{failed, CodeInvalidReference},
+		{foreign, CodeUnknownReference},
+		{"$1", CodeUnknownReference},
+	}
+	for _, tt := range tests {
+		statements, err := parseExpression(tt.expr + " + 1")
+		if err != nil {
+			t.Fatalf("%q: %v", tt.expr, err)
+		}
+		err = resolveReferences(statements[0].Tree, userID)
+		var syntaxErr *SyntaxError
+		if !errors.As(err, &syntaxErr) || syntaxErr.Code != tt.code {
+			t.Errorf("%q: got %v, want %s", tt.expr, err, tt.code)
+		}
+	}
+}
@@ -0,0 +1,338 @@
+package calculator
+
+import (
+	"fmt"
+	"html"
+	"strings"
+)
+
+// Output formats of an expression
+const (
+	FormatText   = "text"   // каноническая запись: 2+3*4
+	FormatLaTeX  = "latex"  // 2+3 \cdot 4
+	FormatMathML = "mathml" // <math>...</math>
+)
+
+// IsFormat reports whether format is a known output format
+func IsFormat(format string) bool {
+	return format == FormatText || format == FormatLaTeX || format == FormatMathML
+}
+
+// Render parses the expression (a script included) and renders its tree in
+// the format. The text format is the canonical form stored for expressions;
+// LaTeX and MathML typeset the same tree: divisions become fractions, powers
+// superscripts, sqrt a radical, if a case distinction, vectors columns and
+// matrices tables in parentheses
+func Render(expression, format string) (string, error) {
+	statements, err := parseExpression(expression)
+	if err != nil {
+		return "", annotate(expression, err)
+	}
+	switch format {
+	case FormatText:
+		return formatScript(statements), nil
+	case FormatLaTeX:
+		return renderLaTeX(statements), nil
+	case FormatMathML:
+		return renderMathML(statements), nil
+	}
+	return "", fmt.Errorf("unknown format %q", format)
+}
+
+// typesetParens is operandParens for typeset output, where a division is a
+// fraction with bounds of its own and needs parentheses only as a base of a power
+func typesetParens(n, operand *Node, right bool) bool {
+	if operand.Kind == BinaryNode && operand.Value == "/" && n.Value != "^" {
+		return false
+	}
+	return operandParens(n, operand, right)
+}
+
+// latexOperators is the LaTeX form of the operators; "/" is a fraction
+var latexOperators = map[string]string{
+	"+": "+", "-": "-", "*": " \\cdot ", "%": " \\bmod ", "//": " \\operatorname{div} ",
+	"<": " < ", "<=": " \\le ", ">": " > ", ">=": " \\ge ", "==": " = ", "!=": " \\ne ",
+	"&&": " \\land ", "||": " \\lor ", "neg": "-", "not": "\\lnot ",
+}
+
+// latexFunctions are the functions with a LaTeX command of their own
+var latexFunctions = map[string]string{
+	"sin": "\\sin", "cos": "\\cos", "log": "\\ln", "min": "\\min", "max": "\\max",
+}
+
+func renderLaTeX(statements []*statement) string {
+	var sb strings.Builder
+	for i, st := range statements {
+		if i > 0 {
+			sb.WriteString(";\\quad ")
+		}
+		if st.Name != "" {
+			sb.WriteString(latexName(st.Name) + " = ")
+		}
+		writeLaTeX(&sb, st.Tree)
+	}
+	return sb.String()
+}
+
+// latexName renders a name: one letter stays a variable, pi is a Greek
+// letter, longer names are set upright
+func latexName(name string) string {
+	switch {
+	case name == "pi":
+		return "\\pi"
+	case len(name) == 1:
+		return name
+	}
+	return "\\mathrm{" + strings.ReplaceAll(name, "_", "\\_") + "}"
+}
+
+func writeLaTeX(sb *strings.Builder, n *Node) {
+	switch n.Kind {
+	case NumberNode:
+		if num, den, ok := strings.Cut(strings.TrimPrefix(n.Value, "-"), "/"); ok {
+			if strings.HasPrefix(n.Value, "-") {
+				sb.WriteString("-")
+			}
+			sb.WriteString("\\frac{" + num + "}{" + den + "}")
+			return
+		}
+		sb.WriteString(n.Value)
+	case IdentifierNode:
+		sb.WriteString(latexName(n.Value))
+	case ReferenceNode:
+		sb.WriteString("\\mathtt{\\$" + n.Value + "}")
+	case UnaryNode:
+		sb.WriteString(latexOperators[n.Value])
+		writeLaTeXOperand(sb, n.Left, typesetParens(n, n.Left, false))
+	case BinaryNode:
+		switch n.Value {
+		case "/":
+			// у дроби свои границы, скобки вокруг операндов не нужны
+			sb.WriteString("\\frac{")
+			writeLaTeX(sb, n.Left)
+			sb.WriteString("}{")
+			writeLaTeX(sb, n.Right)
+			sb.WriteString("}")
+		case "^":
+			sb.WriteString("{")
+			writeLaTeXOperand(sb, n.Left, typesetParens(n, n.Left, false))
+			sb.WriteString("}^{")
+			writeLaTeX(sb, n.Right)
+			sb.WriteString("}")
+		default:
+			if precedence(n.Value) == 0 {
+				writeLaTeXCall(sb, "\\operatorname{"+n.Value+"}", n.Operands())
+				return
+			}
+			writeLaTeXOperand(sb, n.Left, typesetParens(n, n.Left, false))
+			sb.WriteString(latexOperators[n.Value])
+			writeLaTeXOperand(sb, n.Right, typesetParens(n, n.Right, true))
+		}
+	case CallNode:
+		switch {
+		case n.Value == "sqrt":
+			sb.WriteString("\\sqrt{")
+			writeLaTeX(sb, n.Args[0])
+			sb.WriteString("}")
+		case n.Value == "abs":
+			sb.WriteString("\\left|")
+			writeLaTeX(sb, n.Args[0])
+			sb.WriteString("\\right|")
+		case n.Value == "log" && len(n.Args) == 2:
+			sb.WriteString("\\log_{")
+			writeLaTeX(sb, n.Args[1])
+			sb.WriteString("}")
+			writeLaTeXCall(sb, "", n.Args[:1])
+		case isConditional(n):
+			sb.WriteString("\\begin{cases}")
+			writeLaTeX(sb, n.Args[1])
+			sb.WriteString(" & \\text{if } ")
+			writeLaTeX(sb, n.Args[0])
+			sb.WriteString(" \\\\ ")
+			writeLaTeX(sb, n.Args[2])
+			sb.WriteString(" & \\text{otherwise}\\end{cases}")
+		case latexFunctions[n.Value] != "":
+			writeLaTeXCall(sb, latexFunctions[n.Value], n.Args)
+		default:
+			writeLaTeXCall(sb, "\\operatorname{"+strings.ReplaceAll(n.Value, "_", "\\_")+"}", n.Args)
+		}
+	case ListNode:
+		sb.WriteString("\\begin{pmatrix}")
+		for i, row := range n.Args {
+			if i > 0 {
+				sb.WriteString(" \\\\ ")
+			}
+			// строка матрицы — элементы через &, элемент вектора — строка столбца
+			for j, element := range elements(row) {
+				if j > 0 {
+					sb.WriteString(" & ")
+				}
+				writeLaTeX(sb, element)
+			}
+		}
+		sb.WriteString("\\end{pmatrix}")
+	}
+}
+
+func writeLaTeXOperand(sb *strings.Builder, n *Node, parens bool) {
+	if parens {
+		sb.WriteString("\\left(")
+	}
+	writeLaTeX(sb, n)
+	if parens {
+		sb.WriteString("\\right)")
+	}
+}
+
+func writeLaTeXCall(sb *strings.Builder, name string, args []*Node) {
+	sb.WriteString(name + "\\left(")
+	for i, arg := range args {
+		if i > 0 {
+			sb.WriteString(", ")
+		}
+		writeLaTeX(sb, arg)
+	}
+	sb.WriteString("\\right)")
+}
+
+// mathmlOperators is the MathML form of the operators; "/" is a fraction
+var mathmlOperators = map[string]string{
+	"+": "+", "-": "&#x2212;", "*": "&#x22C5;", "%": "mod", "//": "div",
+	"<": "&lt;", "<=": "&#x2264;", ">": "&gt;", ">=": "&#x2265;", "==": "=", "!=": "&#x2260;",
+	"&&": "&#x2227;", "||": "&#x2228;", "neg": "&#x2212;", "not": "&#x00AC;",
+}
+
+func renderMathML(statements []*statement) string {
+	var sb strings.Builder
+	sb.WriteString(`<math xmlns="http://www.w3.org/1998/Math/MathML" display="block"><mrow>`)
+	for i, st := range statements {
+		if i > 0 {
+			sb.WriteString(`<mo separator="true">;</mo>`)
+		}
+		if st.Name != "" {
+			sb.WriteString(mathmlName(st.Name) + "<mo>=</mo>")
+		}
+		writeMathML(&sb, st.Tree)
+	}
+	sb.WriteString("</mrow></math>")
+	return sb.String()
+}
+
+func mathmlName(name string) string {
+	if name == "pi" {
+		return "<mi>&#x03C0;</mi>"
+	}
+	return "<mi>" + html.EscapeString(name) + "</mi>"
+}
+
+func writeMathML(sb *strings.Builder, n *Node) {
+	switch n.Kind {
+	case NumberNode:
+		value := n.Value
+		if strings.HasPrefix(value, "-") {
+			sb.WriteString("<mrow><mo>&#x2212;</mo>")
+			value = value[1:]
+		}
+		if num, den, ok := strings.Cut(value, "/"); ok {
+			sb.WriteString("<mfrac><mn>" + num + "</mn><mn>" + den + "</mn></mfrac>")
+		} else {
+			sb.WriteString("<mn>" + value + "</mn>")
+		}
+		if value != n.Value {
+			sb.WriteString("</mrow>")
+		}
+	case IdentifierNode:
+		sb.WriteString(mathmlName(n.Value))
+	case ReferenceNode:
+		sb.WriteString("<mi mathvariant=\"monospace\">$" + html.EscapeString(n.Value) + "</mi>")
+	case UnaryNode:
+		sb.WriteString("<mrow><mo>" + mathmlOperators[n.Value] + "</mo>")
+		writeMathMLOperand(sb, n.Left, typesetParens(n, n.Left, false))
+		sb.WriteString("</mrow>")
+	case BinaryNode:
+		switch n.Value {
+		case "/":
+			sb.WriteString("<mfrac>")
+			writeMathML(sb, n.Left)
+			writeMathML(sb, n.Right)
+			sb.WriteString("</mfrac>")
+		case "^":
+			sb.WriteString("<msup>")
+			writeMathMLOperand(sb, n.Left, typesetParens(n, n.Left, false))
+			writeMathML(sb, n.Right)
+			sb.WriteString("</msup>")
+		default:
+			if precedence(n.Value) == 0 {
+				writeMathMLCall(sb, "<mi>"+n.Value+"</mi>", n.Operands())
+				return
+			}
+			sb.WriteString("<mrow>")
+			writeMathMLOperand(sb, n.Left, typesetParens(n, n.Left, false))
+			sb.WriteString("<mo>" + mathmlOperators[n.Value] + "</mo>")
+			writeMathMLOperand(sb, n.Right, typesetParens(n, n.Right, true))
+			sb.WriteString("</mrow>")
+		}
+	case CallNode:
+		switch {
+		case n.Value == "sqrt":
+			sb.WriteString("<msqrt>")
+			writeMathML(sb, n.Args[0])
+			sb.WriteString("</msqrt>")
+		case n.Value == "abs":
+			sb.WriteString("<mrow><mo>|</mo>")
+			writeMathML(sb, n.Args[0])
+			sb.WriteString("<mo>|</mo></mrow>")
+		case n.Value == "log" && len(n.Args) == 2:
+			var base strings.Builder
+			writeMathML(&base, n.Args[1])
+			writeMathMLCall(sb, "<msub><mi>log</mi>"+base.String()+"</msub>", n.Args[:1])
+		case n.Value == "log":
+			writeMathMLCall(sb, "<mi>ln</mi>", n.Args)
+		case isConditional(n):
+			sb.WriteString(`<mrow><mo>{</mo><mtable columnalign="left"><mtr><mtd>`)
+			writeMathML(sb, n.Args[1])
+			sb.WriteString("</mtd><mtd><mtext>if&#x00A0;</mtext>")
+			writeMathML(sb, n.Args[0])
+			sb.WriteString("</mtd></mtr><mtr><mtd>")
+			writeMathML(sb, n.Args[2])
+			sb.WriteString("</mtd><mtd><mtext>otherwise</mtext></mtd></mtr></mtable></mrow>")
+		default:
+			writeMathMLCall(sb, mathmlName(n.Value), n.Args)
+		}
+	case ListNode:
+		sb.WriteString("<mrow><mo>(</mo><mtable>")
+		for _, row := range n.Args {
+			sb.WriteString("<mtr>")
+			for _, element := range elements(row) {
+				sb.WriteString("<mtd>")
+				writeMathML(sb, element)
+				sb.WriteString("</mtd>")
+			}
+			sb.WriteString("</mtr>")
+		}
+		sb.WriteString("</mtable><mo>)</mo></mrow>")
+	}
+}
+
+func writeMathMLOperand(sb *strings.Builder, n *Node, parens bool) {
+	if parens {
+		sb.WriteString("<mrow><mo>(</mo>")
+	}
+	writeMathML(sb, n)
+	if parens {
+		sb.WriteString("<mo>)</mo></mrow>")
+	}
+}
+
+// writeMathMLCall renders a function application: the name, the invisible
+// function application operator and the arguments in parentheses
+func writeMathMLCall(sb *strings.Builder, name string, args []*Node) {
+	sb.WriteString("<mrow>" + name + "<mo>&#x2061;</mo><mrow><mo>(</mo>")
+	for i, arg := range args {
+		if i > 0 {
+			sb.WriteString(`<mo separator="true">,</mo>`)
+		}
+		writeMathML(sb, arg)
+	}
+	sb.WriteString("<mo>)</mo></mrow></mrow>")
+}
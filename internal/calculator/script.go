@@ -0,0 +1,169 @@
+package calculator
+
+import (
+	"calc-service/internal/store"
+)
+
+// binding is a name bound by a script statement and the node computing its value
+type binding struct {
+	name string
+	node *Node
+}
+
+// scope holds the names bound by the statements of a script processed so far
+type scope struct {
+	nodes          map[string]*Node
+	depth          map[string]int // глубина значения до оптимизаций
+	optimizedDepth map[string]int
+	bindings       []*binding
+}
+
+func newScope() *scope {
+	return &scope{
+		nodes:          make(map[string]*Node),
+		depth:          make(map[string]int),
+		optimizedDepth: make(map[string]int),
+	}
+}
+
+// define checks that the statement may bind its name
+func (s *scope) define(st *statement) error {
+	if _, ok := constants[st.Name]; ok {
+		return syntaxError(CodeInvalidBinding, st.NameSpan, "cannot assign to constant %s", st.Name)
+	}
+	if _, ok := s.nodes[st.Name]; ok {
+		return syntaxError(CodeInvalidBinding, st.NameSpan, "%s is already defined", st.Name)
+	}
+	return nil
+}
+
+// bind makes the value of a statement available to the following ones; the
+// elements of a vector or a matrix are also bound to their own names, which
+// expandMatrices puts in place of the name of the matrix
+func (s *scope) bind(name string, n *Node, depth, optimizedDepth int) {
+	s.nodes[name] = n
+	s.depth[name] = depth
+	s.optimizedDepth[name] = optimizedDepth
+	s.bindings = append(s.bindings, &binding{name: name, node: n})
+
+	if isList(n) {
+		for i, arg := range n.Args {
+			if isList(arg) {
+				for j, element := range arg.Args {
+					s.bindElement(elementName(name, i, j), element, depth)
+				}
+			} else {
+				s.bindElement(elementName(name, i), arg, depth)
+			}
+		}
+	}
+}
+
+func (s *scope) bindElement(name string, n *Node, d int) {
+	s.nodes[name] = n
+	s.depth[name] = d
+	s.optimizedDepth[name] = depth(n, s.optimizedDepth)
+}
+
+// operation returns the value of n if n is a name bound to an operation
+func (s *scope) operation(n *Node) (*Node, bool) {
+	if n.Kind != IdentifierNode {
+		return nil, false
+	}
+	v, ok := s.nodes[n.Value]
+	return v, ok && isOperation(v)
+}
+
+// substitute replaces names bound to numbers and to results of other
+// expressions with copies of their values, so that passes such as constant
+// folding see them; names bound to operations are left for link
+func (s *scope) substitute(n *Node) *Node {
+	if n.Kind == IdentifierNode {
+		if v, ok := s.nodes[n.Value]; ok && !isOperation(v) {
+			return &Node{Kind: v.Kind, Value: v.Value, TaskID: v.TaskID, Span: n.Span}
+		}
+		return n
+	}
+	for _, slot := range n.operandSlots() {
+		*slot = s.substitute(*slot)
+	}
+	return n
+}
+
+// link replaces the remaining bound names with the nodes of their values, so
+// that the statement depends on the tasks of the earlier ones instead of
+// repeating them. It runs after the other passes, which thus never walk the
+// same shared subtree twice
+func (s *scope) link(n *Node) *Node {
+	if v, ok := s.operation(n); ok {
+		return v
+	}
+	for _, slot := range n.operandSlots() {
+		*slot = s.link(*slot)
+	}
+	return n
+}
+
+// identity wraps n into n+0, so that the value gets a task of its own
+func identity(n *Node) *Node {
+	return &Node{Kind: BinaryNode, Value: "+", Left: n, Right: &Node{Kind: NumberNode, Value: "0"}, Span: n.Span}
+}
+
+// createScriptTasks creates the tasks of every binding of a script and of its
+// result; the task computing the result is registered last, since the last
+// task of an expression is its root. The elements of a vector or a matrix get
+// tasks of their own, and the result is assembled from them
+func createScriptTasks(exprID string, c *compiled) ([]*store.Task, []store.Binding, error) {
+	var tasks []*store.Task
+	for _, b := range c.bindings {
+		bindingTasks, err := createElementTasks(exprID, b.node)
+		if err != nil {
+			return nil, nil, err
+		}
+		tasks = append(tasks, bindingTasks...)
+	}
+
+	// результат — число или значение одной из привязок, а не последняя задача: нужна своя задача
+	root := c.tree
+	if len(tasks) > 0 && !isList(root) && (!isOperation(root) || (root.TaskID != "" && root.TaskID != tasks[len(tasks)-1].ID)) {
+		root = identity(root)
+	}
+	rootTasks, err := createElementTasks(exprID, root)
+	if err != nil {
+		return nil, nil, err
+	}
+	tasks = append(tasks, rootTasks...)
+
+	roots := elements(root)
+	for _, b := range c.bindings {
+		roots = append(roots, elements(b.node)...)
+	}
+	assignGuards(roots, tasks)
+
+	bindings := make([]store.Binding, 0, len(c.bindings))
+	for _, b := range c.bindings {
+		binding := store.Binding{Name: b.name, TaskID: b.node.TaskID}
+		switch {
+		case isList(b.node):
+			binding.Matrix = newMatrix(b.node)
+		case binding.TaskID == "":
+			binding.Value = b.node.Value
+		}
+		bindings = append(bindings, binding)
+	}
+	return tasks, bindings, nil
+}
+
+// createElementTasks creates the tasks of a value, of every element of a
+// vector or a matrix one after another
+func createElementTasks(exprID string, n *Node) ([]*store.Task, error) {
+	var tasks []*store.Task
+	for _, element := range elements(n) {
+		elementTasks, err := createTasksFromTree(exprID, element)
+		if err != nil {
+			return nil, err
+		}
+		tasks = append(tasks, elementTasks...)
+	}
+	return tasks, nil
+}
@@ -0,0 +1,104 @@
+package calculator
+
+import (
+	"calc-service/internal/store"
+	"calc-service/pkg/mathops"
+	"errors"
+	"testing"
+)
+
+// scriptTasks compiles a script and creates the tasks of its bindings and result
+func scriptTasks(t *testing.T, script string) ([]*store.Task, []store.Binding) {
+	t.Helper()
+	c, err := compile(script, "user-script", &Options{Mode: mathops.ModeFloat})
+	if err != nil {
+		t.Fatalf("%q: %v", script, err)
+	}
+	tasks, bindings, err := createScriptTasks("expr-script", c)
+	if err != nil {
+		t.Fatalf("%q: %v", script, err)
+	}
+	return tasks, bindings
+}
+
+func TestScriptBindings(t *testing.T) {
+	tasks, bindings := scriptTasks(t, "x = 1+2; y = x*x; y+1")
+
+	if len(tasks) != 3 {
+		t.Fatalf("got %d tasks, want 3", len(tasks))
+	}
+	x, y, root := tasks[0], tasks[1], tasks[2]
+	// привязка вычисляется один раз, следующие инструкции ссылаются на ее задачу
+	if y.Arg1 != "task:"+x.ID || y.Arg2 != "task:"+x.ID {
+		t.Errorf("y should reference x twice, got %s and %s", y.Arg1, y.Arg2)
+	}
+	if root.Arg1 != "task:"+y.ID || root.Arg2 != "1" {
+		t.Errorf("the result should be y+1, got %s %s %s", root.Arg1, root.Operator, root.Arg2)
+	}
+
+	want := []store.Binding{{Name: "x", TaskID: x.ID}, {Name: "y", TaskID: y.ID}}
+	if len(bindings) != len(want) {
+		t.Fatalf("got %d bindings, want %d", len(bindings), len(want))
+	}
+	for i := range want {
+		if bindings[i] != want[i] {
+			t.Errorf("binding %d: got %+v, want %+v", i, bindings[i], want[i])
+		}
+	}
+}
+
+func TestScriptResult(t *testing.T) {
+	tests := []struct {
+		script string
+		tasks  int
+	}{
+		// результат — последняя привязка: ее задача и есть корень
+		{"x = 2*3; x", 1},
+		// результат — более ранняя привязка: корню нужна своя задача x+0
+		{"x = 2*3; y = x+1; x", 3},
+		// имя, связанное с числом, подставляется значением
+		{"a = 5; a*2", 1},
+		{"a = 5; a", 0},
+	}
+
+	for _, tt := range tests {
+		tasks, _ := scriptTasks(t, tt.script)
+		if len(tasks) != tt.tasks {
+			t.Errorf("%q: got %d tasks, want %d", tt.script, len(tasks), tt.tasks)
+		}
+	}
+
+	tasks, bindings := scriptTasks(t, "a = 5; x = a*2; y = x+1; x")
+	if root := tasks[len(tasks)-1]; root.Operator != "+" || root.Arg1 != "task:"+tasks[0].ID || root.Arg2 != "0" {
+		t.Errorf("got root %s %s %s, want x+0", root.Arg1, root.Operator, root.Arg2)
+	}
+	if bindings[0] != (store.Binding{Name: "a", Value: "5"}) {
+		t.Errorf("got %+v, want a bound to 5", bindings[0])
+	}
+}
+
+func TestScriptErrors(t *testing.T) {
+	tests := []struct {
+		script string
+		code   string
+		offset int
+	}{
+		{"pi = 3; pi", CodeInvalidBinding, 0},
+		{"x = 1; x = 2", CodeInvalidBinding, 7},
+		// имя видно только инструкциям после своей
+		{"y = x; x = 1; y", CodeUnknownIdentifier, 4},
+		{"x = 1; y", CodeUnknownIdentifier, 7},
+	}
+
+	for _, tt := range tests {
+		_, err := compile(tt.script, "user-script", &Options{Mode: mathops.ModeFloat})
+		var syntaxErr *SyntaxError
+		if !errors.As(err, &syntaxErr) {
+			t.Errorf("%q: got %v, want a syntax error", tt.script, err)
+			continue
+		}
+		if syntaxErr.Code != tt.code || syntaxErr.Offset != tt.offset {
+			t.Errorf("%q: got %s at %d, want %s at %d", tt.script, syntaxErr.Code, syntaxErr.Offset, tt.code, tt.offset)
+		}
+	}
+}
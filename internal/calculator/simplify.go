@@ -0,0 +1,410 @@
+package calculator
+
+import (
+	"calc-service/pkg/mathops"
+	"math/big"
+	"slices"
+	"strings"
+)
+
+// maxSimplifyPasses bounds the rewriting; one pass is usually enough, the
+// next ones only confirm that nothing changes
+const maxSimplifyPasses = 10
+
+// simplify rewrites the tree bottom-up by rules until it stops changing:
+//   - operations over numbers are computed exactly, unless the result is
+//     irrational (sqrt(2), log(3)) or an error (1/0), which is kept for the
+//     calculation to report;
+//   - sums and differences are flattened into terms, and terms that differ
+//     only in the numeric factor are added: x+2*x-y -> 3*x-y;
+//   - products and quotients are flattened into factors, and powers of the
+//     same base are multiplied: 2*x*x^2/x -> 2*x^2;
+//   - neutral and absorbing elements are dropped: x^1, x^0, 0*x, --x.
+//
+// The input tree is not modified
+func simplify(n *Node) *Node {
+	text := formatNode(n)
+	for range maxSimplifyPasses {
+		n = simplifyNode(n)
+		next := formatNode(n)
+		if next == text {
+			break
+		}
+		text = next
+	}
+	return n
+}
+
+func simplifyNode(n *Node) *Node {
+	if !isOperation(n) {
+		return n
+	}
+	c := &Node{Kind: n.Kind, Value: n.Value, Span: n.Span}
+	if n.Left != nil {
+		c.Left = simplifyNode(n.Left)
+	}
+	if n.Right != nil {
+		c.Right = simplifyNode(n.Right)
+	}
+	for _, arg := range n.Args {
+		c.Args = append(c.Args, simplifyNode(arg))
+	}
+
+	if value, ok := foldExact(c); ok {
+		return numberNode(value)
+	}
+	switch c.Value {
+	case "+", "-", "neg":
+		return simplifySum(c)
+	case "*", "/":
+		return simplifyProduct(c)
+	case "^":
+		return simplifyPower(c)
+	case "if":
+		if isLiteral(c.Args[0]) {
+			return c.Args[1+boolIndex(!mathops.IsTrue(c.Args[0].Value))]
+		}
+		if formatNode(c.Args[1]) == formatNode(c.Args[2]) {
+			return c.Args[1]
+		}
+	case "log":
+		if len(c.Args) == 1 && isNumber(c.Args[0], "1") {
+			return numberNode("0")
+		}
+		if len(c.Args) == 1 && c.Args[0].Kind == IdentifierNode && c.Args[0].Value == "e" {
+			return numberNode("1")
+		}
+	case "sin":
+		if isNumber(c.Args[0], "0") {
+			return numberNode("0")
+		}
+	case "cos":
+		if isNumber(c.Args[0], "0") {
+			return numberNode("1")
+		}
+	}
+	return c
+}
+
+func boolIndex(v bool) int {
+	if v {
+		return 1
+	}
+	return 0
+}
+
+// foldExact computes an operation over numbers when the result is exact
+func foldExact(n *Node) (string, bool) {
+	operands := n.Operands()
+	args := make([]string, len(operands))
+	for i, operand := range operands {
+		if !isLiteral(operand) {
+			return "", false
+		}
+		args[i] = operand.Value
+	}
+	switch n.Value {
+	case "log", "sin", "cos":
+		return "", false
+	case "^":
+		// дробная степень иррациональна: 2^0.5 остается как есть
+		if exp, err := mathops.ParseDecimal(args[1]); err != nil || !exp.IsInt() {
+			return "", false
+		}
+	}
+	value, err := mathops.Evaluate(mathops.ModeDecimal, n.Value, args...)
+	if err != nil {
+		return "", false
+	}
+	if n.Value == "sqrt" {
+		// корень точен, только если его квадрат дает аргумент
+		if square, err := mathops.Evaluate(mathops.ModeDecimal, "*", value, value); err != nil || !isNumber(numberNode(square), args[0]) {
+			return "", false
+		}
+	}
+	return value, true
+}
+
+// isNumber reports whether n is a number equal to value
+func isNumber(n *Node, value string) bool {
+	if !isLiteral(n) {
+		return false
+	}
+	a, err := mathops.ParseDecimal(n.Value)
+	if err != nil {
+		return false
+	}
+	b, err := mathops.ParseDecimal(value)
+	return err == nil && a.Cmp(b) == 0
+}
+
+// rat parses a number known to be canonical
+func rat(value string) *big.Rat {
+	r, _ := mathops.ParseDecimal(value)
+	if r == nil {
+		return new(big.Rat)
+	}
+	return r
+}
+
+func ratNode(r *big.Rat) *Node {
+	return numberNode(mathops.FormatDecimal(r))
+}
+
+// term is an addend: a numeric coefficient and the rest, nil for a number
+type term struct {
+	coef *big.Rat
+	rest *Node
+	key  string
+}
+
+// simplifySum collects the terms of a sum and adds the like ones; the number
+// goes last: 1+x+x -> 2*x+1
+func simplifySum(n *Node) *Node {
+	var terms []*term
+	constant := new(big.Rat)
+	var collect func(n *Node, sign int64)
+	collect = func(n *Node, sign int64) {
+		switch {
+		case n.Kind == BinaryNode && (n.Value == "+" || n.Value == "-"):
+			collect(n.Left, sign)
+			if n.Value == "-" {
+				sign = -sign
+			}
+			collect(n.Right, sign)
+		case n.Kind == UnaryNode && n.Value == "neg":
+			collect(n.Left, -sign)
+		case isLiteral(n):
+			constant.Add(constant, new(big.Rat).Mul(rat(n.Value), big.NewRat(sign, 1)))
+		default:
+			coef, rest := splitCoefficient(n)
+			coef.Mul(coef, big.NewRat(sign, 1))
+			key := formatNode(rest)
+			for _, t := range terms {
+				if t.key == key {
+					t.coef.Add(t.coef, coef)
+					return
+				}
+			}
+			terms = append(terms, &term{coef: coef, rest: rest, key: key})
+		}
+	}
+	collect(n, 1)
+
+	var acc *Node
+	for _, t := range terms {
+		switch {
+		case t.coef.Sign() == 0:
+			continue
+		case acc == nil:
+			acc = scaled(t.coef, t.rest)
+		case t.coef.Sign() < 0:
+			acc = binaryNode("-", acc, scaled(new(big.Rat).Neg(t.coef), t.rest))
+		default:
+			acc = binaryNode("+", acc, scaled(t.coef, t.rest))
+		}
+	}
+	switch {
+	case acc == nil:
+		return ratNode(constant)
+	case constant.Sign() < 0:
+		return binaryNode("-", acc, ratNode(new(big.Rat).Neg(constant)))
+	case constant.Sign() > 0:
+		return binaryNode("+", acc, ratNode(constant))
+	}
+	return acc
+}
+
+// splitCoefficient separates the numeric factor of a product or a quotient:
+// 3*x*y -> 3, x*y; 3*x/y -> 3, x/y; 3/y -> 3, 1/y; x/3 -> 1/3, x
+func splitCoefficient(n *Node) (*big.Rat, *Node) {
+	switch {
+	case n.Kind == BinaryNode && n.Value == "*" && isLiteral(leftmost(n)):
+		return rat(leftmost(n).Value), withoutLeftmost(n)
+	case n.Kind == BinaryNode && n.Value == "/" && isLiteral(n.Right) && !isNumber(n.Right, "0"):
+		coef, rest := splitCoefficient(n.Left)
+		return coef.Quo(coef, rat(n.Right.Value)), rest
+	case n.Kind == BinaryNode && n.Value == "/" && isLiteral(n.Left):
+		return rat(n.Left.Value), binaryNode("/", numberNode("1"), n.Right)
+	case n.Kind == BinaryNode && n.Value == "/":
+		coef, rest := splitCoefficient(n.Left)
+		return coef, binaryNode("/", rest, n.Right)
+	}
+	return big.NewRat(1, 1), n
+}
+
+// leftmost returns the first factor of a chain of "*"
+func leftmost(n *Node) *Node {
+	for n.Kind == BinaryNode && n.Value == "*" {
+		n = n.Left
+	}
+	return n
+}
+
+// withoutLeftmost returns the chain of "*" without its first factor
+func withoutLeftmost(n *Node) *Node {
+	if n.Left.Kind == BinaryNode && n.Left.Value == "*" {
+		return binaryNode("*", withoutLeftmost(n.Left), n.Right)
+	}
+	return n.Right
+}
+
+// scaled multiplies rest by the coefficient: 1*x -> x, -1*x -> -x, 2/3*x -> 2*x/3
+func scaled(coef *big.Rat, rest *Node) *Node {
+	switch {
+	case rest == nil:
+		return ratNode(coef)
+	case !coef.IsInt():
+		num := scaled(new(big.Rat).SetInt(coef.Num()), rest)
+		return binaryNode("/", num, numberNode(coef.Denom().String()))
+	case coef.Cmp(big.NewRat(1, 1)) == 0:
+		return rest
+	case coef.Cmp(big.NewRat(-1, 1)) == 0:
+		return unaryNode("neg", rest)
+	}
+	if rest.Kind == BinaryNode && rest.Value == "/" && isLiteral(rest.Left) {
+		// 2*(1/x) -> 2/x
+		return binaryNode("/", ratNode(new(big.Rat).Mul(coef, rat(rest.Left.Value))), rest.Right)
+	}
+	return prepend(ratNode(coef), rest)
+}
+
+// prepend puts the factor before a chain of "*": 2, x*y -> 2*x*y
+func prepend(f, chain *Node) *Node {
+	if chain.Kind == BinaryNode && chain.Value == "*" {
+		return binaryNode("*", prepend(f, chain.Left), chain.Right)
+	}
+	return binaryNode("*", f, chain)
+}
+
+// factor is a base raised to a numeric power
+type factor struct {
+	base *Node
+	exp  *big.Rat
+	key  string
+}
+
+// simplifyProduct collects the factors of a product or a quotient, multiplies
+// the numbers and adds the powers of the same base; factors with negative
+// powers go to the denominator: x*y/x^3 -> y/x^2
+func simplifyProduct(n *Node) *Node {
+	var factors []*factor
+	coef := big.NewRat(1, 1)
+	var opaque []*Node // делители, которые нельзя сократить (деление на ноль)
+	var collect func(n *Node, sign int64)
+	collect = func(n *Node, sign int64) {
+		switch {
+		case n.Kind == BinaryNode && (n.Value == "*" || n.Value == "/"):
+			collect(n.Left, sign)
+			if n.Value == "/" {
+				sign = -sign
+			}
+			collect(n.Right, sign)
+		case n.Kind == UnaryNode && n.Value == "neg":
+			coef.Neg(coef)
+			collect(n.Left, sign)
+		case isLiteral(n):
+			v := rat(n.Value)
+			switch {
+			case sign > 0:
+				coef.Mul(coef, v)
+			case v.Sign() != 0:
+				coef.Quo(coef, v)
+			default:
+				opaque = append(opaque, n)
+			}
+		default:
+			base, exp := n, big.NewRat(1, 1)
+			if n.Kind == BinaryNode && n.Value == "^" && isLiteral(n.Right) {
+				base, exp = n.Left, rat(n.Right.Value)
+			}
+			exp.Mul(exp, big.NewRat(sign, 1))
+			key := formatNode(base)
+			for _, f := range factors {
+				if f.key == key {
+					f.exp.Add(f.exp, exp)
+					return
+				}
+			}
+			factors = append(factors, &factor{base: base, exp: exp, key: key})
+		}
+	}
+	collect(n, 1)
+
+	if coef.Sign() == 0 && len(opaque) == 0 {
+		return numberNode("0")
+	}
+	// имена — первыми и по алфавиту, остальные множители — в исходном порядке
+	slices.SortStableFunc(factors, func(a, b *factor) int {
+		switch {
+		case a.base.Kind == IdentifierNode && b.base.Kind == IdentifierNode:
+			return strings.Compare(a.key, b.key)
+		case a.base.Kind == IdentifierNode:
+			return -1
+		case b.base.Kind == IdentifierNode:
+			return 1
+		}
+		return 0
+	})
+
+	var numerator, denominator *Node
+	multiply := func(acc, n *Node) *Node {
+		if acc == nil {
+			return n
+		}
+		return binaryNode("*", acc, n)
+	}
+	for _, f := range factors {
+		switch f.exp.Sign() {
+		case 1:
+			numerator = multiply(numerator, power(f.base, f.exp))
+		case -1:
+			denominator = multiply(denominator, power(f.base, new(big.Rat).Neg(f.exp)))
+		}
+	}
+	for _, n := range opaque {
+		denominator = multiply(denominator, n)
+	}
+
+	// числитель: коэффициент и множители; у дроби коэффициент делится на знаменатель коэффициента
+	num := new(big.Rat).SetInt(coef.Num())
+	den := new(big.Rat).SetInt(coef.Denom())
+	if denominator == nil {
+		if numerator == nil {
+			return ratNode(coef)
+		}
+		return scaled(coef, numerator)
+	}
+	if den.Cmp(big.NewRat(1, 1)) != 0 {
+		denominator = binaryNode("*", ratNode(den), denominator)
+	}
+	if numerator == nil {
+		return binaryNode("/", ratNode(num), denominator)
+	}
+	return binaryNode("/", scaled(num, numerator), denominator)
+}
+
+// power raises base to a numeric exponent: x^1 -> x
+func power(base *Node, exp *big.Rat) *Node {
+	if exp.Cmp(big.NewRat(1, 1)) == 0 {
+		return base
+	}
+	return binaryNode("^", base, ratNode(exp))
+}
+
+// simplifyPower drops neutral exponents and multiplies nested numeric powers:
+// x^0 -> 1, 1^x -> 1, (x^2)^3 -> x^6, sqrt(x)^2 -> x
+func simplifyPower(n *Node) *Node {
+	a, b := n.Left, n.Right
+	switch {
+	case isNumber(b, "0"), isNumber(a, "1"):
+		return numberNode("1")
+	case isNumber(b, "1"):
+		return a
+	case isNumber(b, "2") && a.Kind == CallNode && a.Value == "sqrt":
+		return a.Args[0]
+	case isLiteral(b) && rat(b.Value).IsInt() && a.Kind == BinaryNode && a.Value == "^" && isLiteral(a.Right):
+		return power(a.Left, new(big.Rat).Mul(rat(a.Right.Value), rat(b.Value)))
+	}
+	return n
+}
@@ -0,0 +1,229 @@
+package calculator
+
+import (
+	"calc-service/pkg/mathops"
+	"strconv"
+)
+
+// SymbolicResult is an expression transformed symbolically: its tree, where
+// names stay variables, and its text
+type SymbolicResult struct {
+	Tree *Node
+	Text string
+}
+
+func newSymbolicResult(tree *Node) *SymbolicResult {
+	return &SymbolicResult{Tree: tree, Text: formatNode(tree)}
+}
+
+// Derive differentiates the expression with respect to variable and
+// simplifies the derivative. Other names are treated as constants; calls of
+// user functions are inlined first. Invalid expressions and operations
+// without a derivative (min, round, %, ...) are reported as *SyntaxError
+func Derive(expression, variable, userID string) (*SymbolicResult, error) {
+	if err := ValidateVariableName(variable); err != nil {
+		return nil, err
+	}
+	tree, err := parseSymbolic(expression, userID)
+	if err != nil {
+		return nil, annotate(expression, err)
+	}
+	derivative, err := derive(tree, variable)
+	if err != nil {
+		return nil, annotate(expression, err)
+	}
+	return newSymbolicResult(simplify(derivative)), nil
+}
+
+// Simplify rewrites the expression into a simpler equivalent one: numbers are
+// combined exactly, like terms and powers of the same base are collected and
+// neutral elements are dropped
+func Simplify(expression, userID string) (*SymbolicResult, error) {
+	tree, err := parseSymbolic(expression, userID)
+	if err != nil {
+		return nil, annotate(expression, err)
+	}
+	return newSymbolicResult(simplify(tree)), nil
+}
+
+// parseSymbolic parses a single expression whose names are variables and
+// inlines the user functions it calls; aggregates become plain sums and
+// products, vector arithmetic (a dot product) becomes scalar operations
+func parseSymbolic(expression, userID string) (*Node, error) {
+	statements, err := parseExpression(expression)
+	if err != nil {
+		return nil, err
+	}
+	st := statements[0]
+	if len(statements) > 1 || st.Name != "" {
+		span := st.NameSpan
+		if st.Name == "" {
+			span = statements[1].Tree.Span
+		}
+		return nil, syntaxError(CodeInvalidBinding, span, "symbolic expression must be a single expression without bindings")
+	}
+
+	tree, err := newExpander(userID).expand(st.Tree)
+	if err != nil {
+		return nil, err
+	}
+	if tree, err = expandMatrices(tree, newScope()); err != nil {
+		return nil, err
+	}
+	if isList(tree) {
+		return nil, syntaxError(CodeUnsupportedOperation, tree.Span, "symbolic expression must be a number, not %s", shapeName(tree))
+	}
+	err = walk(tree, func(n *Node) error {
+		if n.Kind == ReferenceNode {
+			return syntaxError(CodeInvalidReference, n.Span, "symbolic expression cannot refer to other expressions")
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return expandAggregates(tree), nil
+}
+
+// expandAggregates writes sum, product and avg as chains of "+" and "*", so
+// that the rewriting rules apply to them
+func expandAggregates(n *Node) *Node {
+	for _, slot := range n.operandSlots() {
+		*slot = expandAggregates(*slot)
+	}
+	if n.Kind != CallNode {
+		return n
+	}
+	chain := func(op string) *Node {
+		acc := n.Args[0]
+		for _, arg := range n.Args[1:] {
+			acc = &Node{Kind: BinaryNode, Value: op, Left: acc, Right: arg, Span: n.Span}
+		}
+		return acc
+	}
+	switch n.Value {
+	case "sum":
+		return chain("+")
+	case "product":
+		return chain("*")
+	case "avg":
+		count := &Node{Kind: NumberNode, Value: strconv.Itoa(len(n.Args)), Span: n.Span}
+		return &Node{Kind: BinaryNode, Value: "/", Left: chain("+"), Right: count, Span: n.Span}
+	}
+	return n
+}
+
+// dependsOn reports whether the tree refers to the variable
+func dependsOn(n *Node, variable string) bool {
+	if n.Kind == IdentifierNode {
+		return n.Value == variable
+	}
+	for _, child := range n.Operands() {
+		if dependsOn(child, variable) {
+			return true
+		}
+	}
+	return false
+}
+
+// Конструкторы узлов производной; у новых узлов нет позиции в исходном выражении
+func numberNode(value string) *Node { return &Node{Kind: NumberNode, Value: value} }
+
+func unaryNode(op string, operand *Node) *Node {
+	return &Node{Kind: UnaryNode, Value: op, Left: operand}
+}
+
+func binaryNode(op string, left, right *Node) *Node {
+	return &Node{Kind: BinaryNode, Value: op, Left: left, Right: right}
+}
+
+func callNode(name string, args ...*Node) *Node {
+	return &Node{Kind: CallNode, Value: name, Args: args}
+}
+
+// derive returns the derivative of n with respect to variable without
+// simplifying it; subtrees that don't depend on the variable are constants
+// whatever operations they contain
+func derive(n *Node, variable string) (*Node, error) {
+	if !dependsOn(n, variable) {
+		return numberNode("0"), nil
+	}
+	if n.Kind == IdentifierNode {
+		return numberNode("1"), nil
+	}
+
+	operands := n.Operands()
+	d := make([]*Node, len(operands))
+	for i, operand := range operands {
+		// у if производная условия не нужна: оно кусочно-постоянно
+		if isConditional(n) && i == 0 {
+			continue
+		}
+		var err error
+		if d[i], err = derive(operand, variable); err != nil {
+			return nil, err
+		}
+	}
+
+	switch n.Kind {
+	case UnaryNode:
+		if n.Value == "neg" {
+			return unaryNode("neg", d[0]), nil
+		}
+	case BinaryNode:
+		a, b := n.Left, n.Right
+		da, db := d[0], d[1]
+		switch n.Value {
+		case "+", "-":
+			return binaryNode(n.Value, da, db), nil
+		case "*":
+			return binaryNode("+", binaryNode("*", da, b), binaryNode("*", a, db)), nil
+		case "/":
+			return binaryNode("/", binaryNode("-", binaryNode("*", da, b), binaryNode("*", a, db)), binaryNode("^", b, numberNode("2"))), nil
+		case "^":
+			switch {
+			case !dependsOn(b, variable):
+				// (a^c)' = c*a^(c-1)*a'
+				return binaryNode("*", binaryNode("*", b, binaryNode("^", a, binaryNode("-", b, numberNode("1")))), da), nil
+			case !dependsOn(a, variable):
+				// (c^b)' = c^b*log(c)*b'
+				return binaryNode("*", binaryNode("*", n, callNode("log", a)), db), nil
+			default:
+				// (a^b)' = a^b*(b'*log(a) + b*a'/a)
+				return binaryNode("*", n, binaryNode("+", binaryNode("*", db, callNode("log", a)), binaryNode("/", binaryNode("*", b, da), a))), nil
+			}
+		}
+	case CallNode:
+		a, da := n.Args[0], d[0]
+		switch n.Value {
+		case "sqrt":
+			return binaryNode("/", da, binaryNode("*", numberNode("2"), n)), nil
+		case "abs":
+			return binaryNode("/", binaryNode("*", a, da), n), nil
+		case "sin":
+			return binaryNode("*", callNode("cos", a), da), nil
+		case "cos":
+			return unaryNode("neg", binaryNode("*", callNode("sin", a), da)), nil
+		case "log":
+			if len(n.Args) == 1 {
+				return binaryNode("/", da, a), nil
+			}
+			// log(a, b) = log(a)/log(b)
+			return derive(binaryNode("/", callNode("log", a), callNode("log", n.Args[1])), variable)
+		case "if":
+			return callNode("if", n.Args[0], d[1], d[2]), nil
+		}
+	}
+	return nil, syntaxError(CodeUnsupportedOperation, n.Span, "cannot differentiate %s with respect to %s", operatorName(n.Value), variable)
+}
+
+// operatorName returns the source form of an operator for messages
+func operatorName(op string) string {
+	if symbol, ok := unarySymbols[op]; ok {
+		return symbol
+	}
+	if mathops.IsFunction(op) {
+		return op + "()"
+	}
+	return op
+}
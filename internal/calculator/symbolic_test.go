@@ -0,0 +1,101 @@
+package calculator
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestDerive(t *testing.T) {
+	tests := []struct {
+		expr string
+		want string
+	}{
+		{"x^2", "2*x"},
+		{"3*x^2 + 2*x + 1", "6*x+2"},
+		{"y*x", "y"},
+		{"pi*x", "pi"},
+		{"-x", "-1"},
+		{"1/x", "-1/x^2"},
+		{"x/(x+1)", "1/(x+1)^2"},
+		// произведение и цепное правило
+		{"sin(x)*x", "x*cos(x)+sin(x)"},
+		{"cos(2*x)", "-2*sin(2*x)"},
+		{"sqrt(x)", "1/(2*sqrt(x))"},
+		{"log(x)", "1/x"},
+		{"2^x", "2^x*log(2)"},
+		{"x^x", "x^x*(log(x)+1)"},
+		// агрегаты — обычные суммы, у условия дифференцируются ветви
+		{"avg(x, 3*x)", "2"},
+		{"if(x > 0, x, -x)", "if(x>0,1,-1)"},
+	}
+
+	for _, tt := range tests {
+		result, err := Derive(tt.expr, "x", "user-symbolic")
+		if err != nil {
+			t.Errorf("%q: %v", tt.expr, err)
+			continue
+		}
+		if result.Text != tt.want {
+			t.Errorf("%q: got %s, want %s", tt.expr, result.Text, tt.want)
+		}
+	}
+}
+
+func TestSimplify(t *testing.T) {
+	tests := []struct {
+		expr string
+		want string
+	}{
+		// подобные слагаемые и степени одного основания
+		{"x+x", "2*x"},
+		{"2*x+3*x", "5*x"},
+		{"a+b-a", "b"},
+		{"(x+1)-(x+1)", "0"},
+		{"x*x*x", "x^3"},
+		{"x^2*x^3", "x^5"},
+		{"x*y/x", "y"},
+		{"2*(3*x)", "6*x"},
+		// нейтральные элементы
+		{"0*x+1*y", "y"},
+		{"x+0", "x"},
+		{"x^1", "x"},
+		{"x^0", "1"},
+		{"--x", "x"},
+		// числа складываются точно
+		{"0.1+0.2", "0.3"},
+		{"1/3+1/6", "0.5"},
+	}
+
+	for _, tt := range tests {
+		result, err := Simplify(tt.expr, "user-symbolic")
+		if err != nil {
+			t.Errorf("%q: %v", tt.expr, err)
+			continue
+		}
+		if result.Text != tt.want {
+			t.Errorf("%q: got %s, want %s", tt.expr, result.Text, tt.want)
+		}
+	}
+}
+
+func TestSymbolicErrors(t *testing.T) {
+	tests := []struct {
+		expr string
+		code string
+	}{
+		{"min(x, 1)", CodeUnsupportedOperation},
+		{"x % 2", CodeUnsupportedOperation},
+		{"f(x)", CodeUnknownFunction},
+		{"y = x; y", CodeInvalidBinding},
+		{"x; 2", CodeInvalidBinding},
+		{"$1 * x", CodeInvalidReference},
+	}
+
+	for _, tt := range tests {
+		_, err := Derive(tt.expr, "x", "user-symbolic")
+		var syntaxErr *SyntaxError
+		if !errors.As(err, &syntaxErr) || syntaxErr.Code != tt.code {
+			t.Errorf("%q: got %v, want %s", tt.expr, err, tt.code)
+		}
+	}
+}
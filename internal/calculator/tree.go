@@ -2,19 +2,132 @@ package calculator
 
 import (
 	"calc-service/internal/store"
+	"calc-service/pkg/mathops"
 	"os"
 	"strconv"
+	"strings"
 
 	"github.com/google/uuid"
 )
 
-// Синтаксический анализ: построение дерева выражения
+// NodeKind is the syntactic category of an expression tree node
+type NodeKind int
+
+const (
+	NumberNode     NodeKind = iota // числовой литерал, Value — каноническая запись числа
+	IdentifierNode                 // константа или переменная, до подстановки значения
+	ReferenceNode                  // ссылка $expr-<id>, до подстановки результата
+	TaskRefNode                    // результат задачи другого выражения, Value — "task:<id>"
+	UnaryNode                      // унарный оператор, операнд в Left
+	BinaryNode                     // бинарный оператор, операнды в Left и Right
+	CallNode                       // вызов функции, аргументы в Args
+	ListNode                       // вектор [a, b, ...] или матрица из строк-векторов, элементы в Args
+)
+
+var nodeKindNames = map[NodeKind]string{
+	NumberNode:     "number",
+	IdentifierNode: "identifier",
+	ReferenceNode:  "reference",
+	TaskRefNode:    "task_ref",
+	UnaryNode:      "unary",
+	BinaryNode:     "binary",
+	CallNode:       "call",
+	ListNode:       "list",
+}
+
+func (k NodeKind) String() string {
+	if name, ok := nodeKindNames[k]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+// Span is the byte range [Start, End) of a node in the source expression
+type Span struct {
+	Start int
+	End   int
+}
+
+// Синтаксический анализ: дерево выражения (AST)
 type Node struct {
-	Value    string
-	Left     *Node
-	Right    *Node
-	TaskID   string
-	Priority int
+	Kind   NodeKind
+	Value  string
+	Left   *Node
+	Right  *Node
+	Args   []*Node // аргументы вызова функции, элементы списка
+	Span   Span
+	TaskID string
+}
+
+// operationKind returns the kind of a node computing op
+func operationKind(op string) NodeKind {
+	switch {
+	case mathops.IsFunction(op):
+		return CallNode
+	case isUnaryOperator(op):
+		return UnaryNode
+	default:
+		return BinaryNode
+	}
+}
+
+// isOperation reports whether the node is computed by a task (operator or function call)
+func isOperation(n *Node) bool {
+	return n != nil && (n.Kind == UnaryNode || n.Kind == BinaryNode || n.Kind == CallNode)
+}
+
+// isLiteral reports whether the node is a plain number, not an operation or a task reference
+func isLiteral(n *Node) bool {
+	return n != nil && n.Kind == NumberNode
+}
+
+// Operands returns the child nodes of an operation (the elements of a list) in argument order
+func (n *Node) Operands() []*Node {
+	switch n.Kind {
+	case CallNode, ListNode:
+		return n.Args
+	case UnaryNode:
+		return []*Node{n.Left}
+	case BinaryNode:
+		return []*Node{n.Left, n.Right}
+	default:
+		return nil
+	}
+}
+
+// operandSlots returns pointers to the child links of an operation, so that
+// passes can replace operands in place
+func (n *Node) operandSlots() []**Node {
+	switch n.Kind {
+	case CallNode, ListNode:
+		slots := make([]**Node, len(n.Args))
+		for i := range n.Args {
+			slots[i] = &n.Args[i]
+		}
+		return slots
+	case UnaryNode:
+		return []**Node{&n.Left}
+	case BinaryNode:
+		return []**Node{&n.Left, &n.Right}
+	default:
+		return nil
+	}
+}
+
+// walk calls fn for every node of the tree in pre-order
+func walk(n *Node, fn func(*Node) error) error {
+	if n == nil {
+		return nil
+	}
+	if err := fn(n); err != nil {
+		return err
+	}
+	for _, child := range n.Operands() {
+		if err := walk(child, fn); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func generateTaskID() string {
@@ -25,13 +138,34 @@ func getNodeReference(n *Node) string {
 	if n == nil {
 		return ""
 	}
-	if isOperator(n.Value) {
+	if isOperation(n) {
 		return "task:" + n.TaskID
 	}
 	return n.Value
 }
 
+// functionTimes holds default operation times of built-in functions,
+// overridable with TIME_<NAME>_MS, e.g. TIME_SQRT_MS
+var functionTimes = map[string]int{
+	"sqrt":  200,
+	"abs":   100,
+	"min":   100,
+	"max":   100,
+	"log":   300,
+	"sin":   300,
+	"cos":   300,
+	"round": 100,
+}
+
 func getOperationTime(op string) int {
+	if def, ok := functionTimes[op]; ok {
+		t, err := strconv.Atoi(os.Getenv("TIME_" + strings.ToUpper(op) + "_MS"))
+		if err != nil {
+			return def
+		}
+		return t
+	}
+
 	var envVar string
 	switch op {
 	case "+":
@@ -40,19 +174,35 @@ func getOperationTime(op string) int {
 		envVar = os.Getenv("TIME_SUBTRACTION_MS")
 	case "*":
 		envVar = os.Getenv("TIME_MULTIPLICATIONS_MS")
-	case "/":
+	case "/", "quo":
 		envVar = os.Getenv("TIME_DIVISIONS_MS")
+	case "neg":
+		envVar = os.Getenv("TIME_NEGATION_MS")
+	case "^":
+		envVar = os.Getenv("TIME_POWERS_MS")
+	case "%":
+		envVar = os.Getenv("TIME_MODULO_MS")
+	case "//":
+		envVar = os.Getenv("TIME_INTEGER_DIVISIONS_MS")
+	case "<", "<=", ">", ">=", "==", "!=":
+		envVar = os.Getenv("TIME_COMPARISONS_MS")
+	case "&&", "||", "not":
+		envVar = os.Getenv("TIME_LOGICAL_MS")
+	case "if":
+		envVar = os.Getenv("TIME_CONDITIONAL_MS")
+	case "sum", "product", "avg", "median", "mean":
+		envVar = os.Getenv("TIME_AGGREGATES_MS")
 	default:
 		return 0
 	}
 	t, err := strconv.Atoi(envVar)
 	if err != nil {
 		switch op {
-		case "+", "-":
+		case "+", "-", "neg", "<", "<=", ">", ">=", "==", "!=", "&&", "||", "not", "if":
 			return 100
 		case "*":
 			return 200
-		case "/":
+		case "/", "quo", "^", "%", "//", "sum", "product", "avg", "median", "mean":
 			return 300
 		default:
 			return 0
@@ -63,38 +213,31 @@ func getOperationTime(op string) int {
 
 func createTasksFromTree(exprID string, node *Node) ([]*store.Task, error) {
 	var tasks []*store.Task
-	if node == nil {
+	// узел, общий для нескольких родителей, уже получил свою задачу
+	if !isOperation(node) || node.TaskID != "" {
 		return tasks, nil
 	}
-	// обход в пост-ордера
-	if node.Left != nil {
-		childTasks, err := createTasksFromTree(exprID, node.Left)
+	// обход в пост-ордере: задачи операндов регистрируются раньше
+	for _, child := range node.Operands() {
+		childTasks, err := createTasksFromTree(exprID, child)
 		if err != nil {
 			return nil, err
 		}
 		tasks = append(tasks, childTasks...)
 	}
-	if node.Right != nil {
-		childTasks, err := createTasksFromTree(exprID, node.Right)
-		if err != nil {
-			return nil, err
-		}
-		tasks = append(tasks, childTasks...)
+
+	taskID := generateTaskID()
+	node.TaskID = taskID
+	task := &store.Task{
+		ID:            taskID,
+		ExpressionID:  exprID,
+		Arg1:          getNodeReference(node.Left),
+		Arg2:          getNodeReference(node.Right),
+		Operator:      node.Value,
+		OperationTime: getOperationTime(node.Value),
 	}
-	if isOperator(node.Value) {
-		taskID := generateTaskID()
-		node.TaskID = taskID
-		arg1 := getNodeReference(node.Left)
-		arg2 := getNodeReference(node.Right)
-		task := &store.Task{
-			ID:            taskID,
-			ExpressionID:  exprID,
-			Arg1:          arg1,
-			Arg2:          arg2,
-			Operator:      node.Value,
-			OperationTime: getOperationTime(node.Value),
-		}
-		tasks = append(tasks, task)
+	for _, arg := range node.Args {
+		task.Args = append(task.Args, getNodeReference(arg))
 	}
-	return tasks, nil
+	return append(tasks, task), nil
 }
@@ -0,0 +1,87 @@
+package calculator
+
+import (
+	"calc-service/internal/store"
+	"calc-service/pkg/mathops"
+	"fmt"
+	"math"
+	"strconv"
+	"unicode"
+)
+
+// constants are built-in names available in every expression
+var constants = map[string]float64{
+	"pi": math.Pi,
+	"e":  math.E,
+}
+
+// isIdentifier reports whether s is a valid name: a letter or "_" followed by letters, digits or "_"
+func isIdentifier(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i, ch := range s {
+		if ch == '_' || unicode.IsLetter(ch) || (i > 0 && unicode.IsDigit(ch)) {
+			continue
+		}
+		return false
+	}
+	return true
+}
+
+// ValidateVariableName checks that a user variable name is an identifier
+// that does not clash with a constant or a built-in function
+func ValidateVariableName(name string) error {
+	if !isIdentifier(name) {
+		return fmt.Errorf("invalid variable name: %q", name)
+	}
+	if _, ok := constants[name]; ok {
+		return fmt.Errorf("%s is a built-in constant", name)
+	}
+	if mathops.IsFunction(name) {
+		return fmt.Errorf("%s is a built-in function", name)
+	}
+	return nil
+}
+
+// resolveIdentifiers replaces constants and user variables in the tree with
+// their values; names bound by earlier statements of a script are left as is.
+// Variables keep their exact values, applyMode checks them in the mode of the
+// expression like the other literals
+func resolveIdentifiers(tree *Node, userID string, bound map[string]*Node) error {
+	var variables map[string]string
+
+	return walk(tree, func(n *Node) error {
+		if n.Kind != IdentifierNode {
+			return nil
+		}
+		if _, ok := bound[n.Value]; ok {
+			return nil
+		}
+
+		var value string
+		constant, ok := constants[n.Value]
+		if ok {
+			value = strconv.FormatFloat(constant, 'g', -1, 64)
+		} else {
+			// переменные пользователя загружаем один раз и только если они нужны
+			if variables == nil {
+				list, err := store.ListVariables(userID)
+				if err != nil {
+					return fmt.Errorf("failed to load variables: %w", err)
+				}
+				variables = make(map[string]string, len(list))
+				for _, v := range list {
+					variables[v.Name] = v.Exact()
+				}
+			}
+			value, ok = variables[n.Value]
+		}
+		if !ok {
+			return syntaxError(CodeUnknownIdentifier, n.Span, "unknown variable %s", n.Value)
+		}
+		n.Kind = NumberNode
+		n.Value = value
+		return nil
+	})
+}
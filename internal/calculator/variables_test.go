@@ -0,0 +1,45 @@
+package calculator
+
+import (
+	"calc-service/internal/store"
+	"calc-service/pkg/mathops"
+	"errors"
+	"testing"
+)
+
+func TestResolveVariables(t *testing.T) {
+	const userID = "user-variables"
+	if _, err := store.SetVariable(userID, "big", "12345678901234567891"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.SetVariable(userID, "rate", "0.1"); err != nil {
+		t.Fatal(err)
+	}
+
+	statements, err := parseExpression("big + rate * pi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree := statements[0].Tree
+	if err := resolveIdentifiers(tree, userID, nil); err != nil {
+		t.Fatal(err)
+	}
+	// значения переменных подставляются точно, константы — в записи float64
+	if got := treeString(tree); got != "(+ 12345678901234567891 (* 0.1 3.141592653589793))" {
+		t.Errorf("got %s", got)
+	}
+
+	// в decimal значение не теряет знаков, в integer не помещается в int64
+	c, err := compile("big - 12345678901234567890", userID, &Options{Mode: mathops.ModeDecimal, Fold: FoldAll})
+	if err != nil {
+		t.Fatalf("decimal: %v", err)
+	}
+	if c.tree.Value != "1" {
+		t.Errorf("decimal: got %s, want 1", c.tree.Value)
+	}
+	_, err = compile("big - 12345678901234567890", userID, &Options{Mode: mathops.ModeInteger})
+	var syntaxErr *SyntaxError
+	if !errors.As(err, &syntaxErr) || syntaxErr.Code != CodeInvalidOperand || syntaxErr.Offset != 0 {
+		t.Errorf("integer: got %v, want an invalid operand at 0", err)
+	}
+}
@@ -0,0 +1,75 @@
+package handler
+
+import (
+	"calc-service/internal/store"
+	"calc-service/pkg/logger"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// agentTTL is how long an agent counts as connected after its last poll
+const agentTTL = 30 * time.Second
+
+type agentInfo struct {
+	workers  int
+	lastSeen time.Time
+}
+
+var (
+	agentsMu sync.Mutex
+	agents   = make(map[string]agentInfo)
+)
+
+// recordAgent remembers the capacity an agent reports in the X-Agent-ID and
+// X-Agent-Workers headers of its polls
+func recordAgent(r *http.Request) {
+	id := r.Header.Get("X-Agent-ID")
+	workers, err := strconv.Atoi(r.Header.Get("X-Agent-Workers"))
+	if id == "" || err != nil || workers < 1 {
+		return
+	}
+
+	agentsMu.Lock()
+	agents[id] = agentInfo{workers: workers, lastSeen: time.Now()}
+	agentsMu.Unlock()
+}
+
+// agentCapacity returns the number of workers of the agents seen recently.
+// An agent whose workers are all busy with long tasks stops polling, but keeps
+// extending its leases: while it holds a live lease it still counts, with the
+// number of its leases if it hasn't reported itself since the orchestrator
+// started. Without any agents it falls back to COMPUTING_POWER
+func agentCapacity() int {
+	leases, err := store.GetLeaseOwners()
+	if err != nil {
+		logger.Error("Failed to get lease owners: %v", err)
+	}
+
+	agentsMu.Lock()
+	defer agentsMu.Unlock()
+
+	total := 0
+	for id, agent := range agents {
+		if _, busy := leases[id]; !busy && time.Since(agent.lastSeen) > agentTTL {
+			delete(agents, id)
+			continue
+		}
+		total += agent.workers
+	}
+	for id, n := range leases {
+		if _, known := agents[id]; !known {
+			total += n
+		}
+	}
+	if total > 0 {
+		return total
+	}
+
+	if power, err := strconv.Atoi(os.Getenv("COMPUTING_POWER")); err == nil && power > 0 {
+		return power
+	}
+	return 1
+}
@@ -0,0 +1,52 @@
+package handler
+
+import (
+	"calc-service/internal/store"
+	"calc-service/pkg/database"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestAgentCapacityLeases(t *testing.T) {
+	t.Setenv("COMPUTING_POWER", "2")
+	if _, err := database.GetDB().Exec("DELETE FROM tasks"); err != nil {
+		t.Fatal(err)
+	}
+	agentsMu.Lock()
+	agents = map[string]agentInfo{
+		// агент давно не опрашивал очередь: все его воркеры заняты
+		"agent-busy": {workers: 4, lastSeen: time.Now().Add(-2 * agentTTL)},
+	}
+	agentsMu.Unlock()
+
+	expr, err := store.NewExpression("1+2", "user-capacity", "float", 1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tasks []*store.Task
+	for i := 0; i < 3; i++ {
+		tasks = append(tasks, &store.Task{ID: fmt.Sprintf("task-capacity-%d", i), Arg1: "1", Arg2: "2", Operator: "+", Mode: "float"})
+	}
+	if err := store.RegisterTasks(expr.ID, "user-capacity", tasks); err != nil {
+		t.Fatal(err)
+	}
+
+	// аренда держит агента в списке; агент, которого реестр не знает, дает столько воркеров, сколько у него аренд
+	for _, owner := range []string{"agent-busy", "agent-unknown", "agent-unknown"} {
+		if _, ok := store.ClaimNextTask(owner, time.Minute); !ok {
+			t.Fatal("no task to claim")
+		}
+	}
+	if got := agentCapacity(); got != 6 {
+		t.Errorf("got capacity %d with live leases, want 6", got)
+	}
+
+	// без аренд устаревший агент забывается, и остается COMPUTING_POWER
+	if _, err := database.GetDB().Exec("DELETE FROM tasks"); err != nil {
+		t.Fatal(err)
+	}
+	if got := agentCapacity(); got != 2 {
+		t.Errorf("got capacity %d without leases, want 2", got)
+	}
+}
@@ -0,0 +1,16 @@
+package handler
+
+import (
+	"calc-service/internal/cache"
+	"net/http"
+)
+
+// HandleCacheStats reports the state of the result cache and its hit/miss counters
+func HandleCacheStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	writeJSON(w, cache.GetStats())
+}
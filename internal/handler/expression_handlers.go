@@ -4,27 +4,199 @@ import (
 	"calc-service/internal/calculator"
 	"calc-service/internal/store"
 	"calc-service/pkg/logger"
+	"calc-service/pkg/mathops"
 	"encoding/json"
+	"errors"
 	"net/http"
 	"strings"
 )
 
 type CalculateRequest struct {
 	Expression string `json:"expression"`
+	Mode       string `json:"mode,omitempty"`     // "float" (по умолчанию), "decimal" или "integer"
+	Division   string `json:"division,omitempty"` // для "integer": "exact" (по умолчанию) или "truncate"
+	Fold       string `json:"fold,omitempty"`     // "none", "cheap" или "all"; по умолчанию FOLD_POLICY
+	Rebalance  bool   `json:"rebalance,omitempty"`
+	Syntax     string `json:"syntax,omitempty"` // "infix" (по умолчанию), "rpn" или "sexpr"
+}
+
+func (req CalculateRequest) options() calculator.Options {
+	return calculator.Options{Mode: req.Mode, Division: req.Division, Fold: req.Fold, Rebalance: req.Rebalance, Syntax: req.Syntax}
 }
 
 type CalculateResponse struct {
 	ID string `json:"id"`
 }
 
+// ExpressionErrorResponse describes a rejected expression; syntax errors also
+// carry the code, the byte offset and a caret snippet pointing at the problem
+type ExpressionErrorResponse struct {
+	Error    string `json:"error"`
+	Code     string `json:"code,omitempty"`
+	Position *int   `json:"position,omitempty"`
+	Token    string `json:"token,omitempty"`
+	Snippet  string `json:"snippet,omitempty"`
+}
+
+// writeExpressionError responds with 422 and a JSON description of err
+func writeExpressionError(w http.ResponseWriter, err error) {
+	response := ExpressionErrorResponse{Error: "Invalid expression: " + err.Error()}
+	var syntaxErr *calculator.SyntaxError
+	if errors.As(err, &syntaxErr) {
+		response.Error = "Invalid expression: " + syntaxErr.Message
+		response.Code = syntaxErr.Code
+		response.Position = &syntaxErr.Offset
+		response.Token = syntaxErr.Token
+		response.Snippet = syntaxErr.Snippet
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusUnprocessableEntity)
+	json.NewEncoder(w).Encode(response)
+}
+
 type ExpressionsResponse struct {
 	Expressions []ExpressionResponse `json:"expressions"`
 }
 
 type ExpressionResponse struct {
-	ID     string  `json:"id"`
-	Status string  `json:"status"`
-	Result float64 `json:"result,omitempty"`
+	ID          string   `json:"id"`
+	Expression  string   `json:"expression,omitempty"` // каноническая запись, только в ответе по ID
+	Status      string   `json:"status"`
+	Mode        string   `json:"mode,omitempty"`
+	Result      *float64 `json:"result,omitempty"` // только у вычисленного выражения; 0 — в том числе ложь
+	ResultExact string   `json:"result_exact,omitempty"`
+	Error       string   `json:"error,omitempty"`
+
+	// результат-вектор или матрица: числа и, в режимах decimal и integer, точные значения
+	ResultMatrix      any `json:"result_matrix,omitempty"`
+	ResultMatrixExact any `json:"result_matrix_exact,omitempty"`
+
+	// глубина дерева до и после оптимизаций и значения привязок сценария, только в ответе по ID
+	Depth          int               `json:"depth,omitempty"`
+	OptimizedDepth int               `json:"optimized_depth,omitempty"`
+	Bindings       []BindingResponse `json:"bindings,omitempty"`
+
+	// запись выражения в формате ?format=text|latex|mathml, только в ответе по ID
+	Format   string `json:"format,omitempty"`
+	Rendered string `json:"rendered,omitempty"`
+}
+
+// BindingResponse is the value of a name bound by a statement of a script
+type BindingResponse struct {
+	Name              string   `json:"name"`
+	Status            string   `json:"status"`
+	Result            *float64 `json:"result,omitempty"`
+	ResultExact       string   `json:"result_exact,omitempty"`
+	ResultMatrix      any      `json:"result_matrix,omitempty"`
+	ResultMatrixExact any      `json:"result_matrix_exact,omitempty"`
+	Error             string   `json:"error,omitempty"`
+}
+
+// newExpressionResponse builds the API view of an expression; the mode and the
+// exact result are only reported for non-default numeric modes
+func newExpressionResponse(expr *store.Expression) ExpressionResponse {
+	response := ExpressionResponse{
+		ID:     expr.ID,
+		Status: expr.Status,
+		Error:  expr.Error,
+	}
+	if expr.Status == "completed" && expr.Matrix == nil {
+		response.Result = &expr.Result
+	}
+	if expr.Mode != mathops.ModeFloat {
+		response.Mode = expr.Mode
+		response.ResultExact = expr.ResultExact
+	}
+	if expr.Matrix != nil && expr.Matrix.Result != nil {
+		response.ResultMatrix, response.ResultMatrixExact = matrixResults(expr.Matrix, expr.Matrix.Result, expr.Mode)
+	}
+	return response
+}
+
+// matrixResults shapes the values of the elements of a vector or a matrix into
+// nested arrays: of numbers and, in the exact modes, of the exact values
+func matrixResults(m *store.Matrix, values []string, mode string) (any, any) {
+	numbers := make([]float64, len(values))
+	for i, value := range values {
+		numbers[i] = mathops.ToFloat(value)
+	}
+	if mode == mathops.ModeFloat {
+		return shapeValues(m.Shape, numbers), nil
+	}
+	return shapeValues(m.Shape, numbers), shapeValues(m.Shape, values)
+}
+
+// shapeValues arranges values given in row-major order into a vector or a
+// matrix of the shape
+func shapeValues[T any](shape []int, values []T) any {
+	if len(shape) == 1 {
+		return values
+	}
+	rows := make([][]T, shape[0])
+	for i := range rows {
+		rows[i] = values[i*shape[1] : (i+1)*shape[1]]
+	}
+	return rows
+}
+
+// matrixStatus is the status of a vector or a matrix computed by tasks: the
+// status of its first element that is not completed, if any
+func matrixStatus(m *store.Matrix) (string, string) {
+	for _, element := range m.Elements {
+		id, ok := strings.CutPrefix(element, "task:")
+		if !ok {
+			continue
+		}
+		task, found := store.GetTask(id)
+		if !found {
+			return store.TaskPending, ""
+		}
+		if status := task.Status(); status != store.TaskCompleted {
+			return status, task.Error
+		}
+	}
+	return store.TaskCompleted, ""
+}
+
+// newBindingResponses reports the bindings of a script with the current state
+// of the tasks computing them
+func newBindingResponses(expr *store.Expression) []BindingResponse {
+	var responses []BindingResponse
+	for _, b := range expr.Bindings {
+		response := BindingResponse{Name: b.Name, Status: store.TaskCompleted}
+		if b.Matrix != nil {
+			response.Status, response.Error = matrixStatus(b.Matrix)
+			if response.Status == store.TaskCompleted {
+				values, err := calculator.MatrixValues(b.Matrix, expr.Mode)
+				if err != nil {
+					continue
+				}
+				response.ResultMatrix, response.ResultMatrixExact = matrixResults(b.Matrix, values, expr.Mode)
+			}
+			responses = append(responses, response)
+			continue
+		}
+		exact := b.Value
+		if b.TaskID != "" {
+			task, found := store.GetTask(b.TaskID)
+			if !found {
+				continue
+			}
+			response.Status = task.Status()
+			response.Error = task.Error
+			exact = task.Exact()
+		}
+		if response.Status == store.TaskCompleted {
+			result := mathops.ToFloat(exact)
+			response.Result = &result
+			if expr.Mode != mathops.ModeFloat {
+				response.ResultExact = exact
+			}
+		}
+		responses = append(responses, response)
+	}
+	return responses
 }
 
 type ExpressionDetailResponse struct {
@@ -50,10 +222,10 @@ func HandleCalculate(w http.ResponseWriter, r *http.Request) {
 
 	logger.Info("HandleCalculate: Processing expression: %s", req.Expression)
 
-	expr, err := calculator.ProcessExpression(req.Expression, userID)
+	expr, err := calculator.ProcessExpression(req.Expression, userID, req.options())
 	if err != nil {
 		logger.Error("HandleCalculate: Expression processing error: %v", err)
-		http.Error(w, "Invalid expression: "+err.Error(), http.StatusUnprocessableEntity)
+		writeExpressionError(w, err)
 		return
 	}
 
@@ -64,6 +236,35 @@ func HandleCalculate(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(CalculateResponse{ID: expr.ID})
 }
 
+// HandlePlan parses the expression and estimates its calculation without
+// creating the expression
+func HandlePlan(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID := getUserIDFromContext(r.Context())
+
+	var req CalculateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		logger.Error("HandlePlan: Failed to decode request: %v", err)
+		http.Error(w, "Invalid request body", http.StatusUnprocessableEntity)
+		return
+	}
+
+	plan, err := calculator.PlanExpression(req.Expression, userID, req.options(), agentCapacity())
+	if err != nil {
+		logger.Error("HandlePlan: Expression processing error: %v", err)
+		writeExpressionError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(plan)
+}
+
 func HandleExpressions(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
@@ -77,11 +278,7 @@ func HandleExpressions(w http.ResponseWriter, r *http.Request) {
 	response := make([]ExpressionResponse, 0, len(expressions))
 
 	for _, expr := range expressions {
-		response = append(response, ExpressionResponse{
-			ID:     expr.ID,
-			Status: expr.Status,
-			Result: expr.Result,
-		})
+		response = append(response, newExpressionResponse(expr))
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -99,7 +296,14 @@ func HandleExpressionByID(w http.ResponseWriter, r *http.Request) {
 	id := strings.TrimPrefix(r.URL.Path, "/api/v1/expressions/")
 	logger.Info("HandleExpressionByID: Looking for expression ID: %s", id)
 
-	expr, exists := store.GetExpression(id)
+	format := r.URL.Query().Get("format")
+	if format != "" && !calculator.IsFormat(format) {
+		http.Error(w, "Unknown format: use text, latex or mathml", http.StatusBadRequest)
+		return
+	}
+
+	// чужие выражения не видны: ответ содержит их текст, привязки и запись
+	expr, exists := store.GetUserExpression(id, getUserIDFromContext(r.Context()))
 	if !exists {
 		logger.Warn("HandleExpressionByID: Expression not found: %s", id)
 		http.Error(w, "Expression not found", http.StatusNotFound)
@@ -108,10 +312,20 @@ func HandleExpressionByID(w http.ResponseWriter, r *http.Request) {
 
 	logger.Info("HandleExpressionByID: Found expression ID: %s, status: %s", expr.ID, expr.Status)
 
-	response := ExpressionResponse{
-		ID:     expr.ID,
-		Status: expr.Status,
-		Result: expr.Result,
+	response := newExpressionResponse(expr)
+	response.Expression = expr.Expression
+	response.Depth = expr.Depth
+	response.OptimizedDepth = expr.OptimizedDepth
+	response.Bindings = newBindingResponses(expr)
+	if format != "" {
+		rendered, err := calculator.Render(expr.Expression, format)
+		if err != nil {
+			logger.Error("HandleExpressionByID: Failed to render expression %s: %v", expr.ID, err)
+			http.Error(w, "Failed to render expression", http.StatusInternalServerError)
+			return
+		}
+		response.Format = format
+		response.Rendered = rendered
 	}
 
 	w.Header().Set("Content-Type", "application/json")
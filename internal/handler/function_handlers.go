@@ -0,0 +1,112 @@
+package handler
+
+import (
+	"calc-service/internal/calculator"
+	"calc-service/internal/store"
+	"calc-service/pkg/logger"
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+type FunctionRequest struct {
+	Definition string `json:"definition"` // например, "f(x, y) = x*x + y"
+}
+
+type FunctionsResponse struct {
+	Functions []*store.Function `json:"functions"`
+}
+
+type FunctionDetailResponse struct {
+	Function *store.Function `json:"function"`
+}
+
+// HandleFunctions lists the user's functions (GET) or defines one (POST)
+func HandleFunctions(w http.ResponseWriter, r *http.Request) {
+	userID := getUserIDFromContext(r.Context())
+
+	switch r.Method {
+	case http.MethodGet:
+		functions, err := store.ListFunctions(userID)
+		if err != nil {
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		if functions == nil {
+			functions = []*store.Function{}
+		}
+		writeJSON(w, FunctionsResponse{Functions: functions})
+	case http.MethodPost:
+		var req FunctionRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			logger.Error("HandleFunctions: Failed to decode request: %v", err)
+			http.Error(w, "Invalid request body", http.StatusUnprocessableEntity)
+			return
+		}
+		saveFunction(w, userID, "", req.Definition, http.StatusCreated)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// HandleFunctionByName reads (GET), redefines (PUT) or deletes (DELETE) a single function
+func HandleFunctionByName(w http.ResponseWriter, r *http.Request) {
+	userID := getUserIDFromContext(r.Context())
+	name := strings.TrimPrefix(r.URL.Path, "/api/v1/functions/")
+
+	switch r.Method {
+	case http.MethodGet:
+		function, found := store.GetFunction(userID, name)
+		if !found {
+			http.Error(w, "Function not found", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, FunctionDetailResponse{Function: function})
+	case http.MethodPut:
+		var req FunctionRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			logger.Error("HandleFunctionByName: Failed to decode request: %v", err)
+			http.Error(w, "Invalid request body", http.StatusUnprocessableEntity)
+			return
+		}
+		saveFunction(w, userID, name, req.Definition, http.StatusOK)
+	case http.MethodDelete:
+		deleted, err := store.DeleteFunction(userID, name)
+		if err != nil {
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		if !deleted {
+			http.Error(w, "Function not found", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// saveFunction validates the definition and stores it; name, if set, must
+// match the name in the definition
+func saveFunction(w http.ResponseWriter, userID, name, definition string, status int) {
+	fn, err := calculator.ParseFunction(definition, userID)
+	if err != nil {
+		writeExpressionError(w, err)
+		return
+	}
+	if name != "" && fn.Name != name {
+		http.Error(w, "Function name in body does not match the URL", http.StatusUnprocessableEntity)
+		return
+	}
+
+	function, err := store.SetFunction(userID, fn.Name, fn.Params, fn.Body)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	logger.Info("Function %s saved for user %s", fn.Name, userID)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(FunctionDetailResponse{Function: function})
+}
@@ -0,0 +1,94 @@
+package handler
+
+import (
+	"calc-service/internal/calculator"
+	"calc-service/pkg/logger"
+	"encoding/json"
+	"net/http"
+)
+
+// defaultSymbolicVariable is the variable of derivation unless the request names another one
+const defaultSymbolicVariable = "x"
+
+// SymbolicRequest asks to transform an expression symbolically; if At is set,
+// the result is also submitted for calculation with the variable equal to At
+// in the mode and with the options of CalculateRequest
+type SymbolicRequest struct {
+	CalculateRequest
+	Variable string       `json:"variable,omitempty"` // по умолчанию x
+	At       *json.Number `json:"at,omitempty"`
+}
+
+// SymbolicResponse is the transformed expression as text and as a tree
+type SymbolicResponse struct {
+	Expression string            `json:"expression"`
+	Tree       *TreeNodeResponse `json:"tree"`
+	ID         string            `json:"id,omitempty"` // выражение, вычисляющее результат в точке at
+}
+
+// HandleDerive returns the simplified derivative of the expression
+func HandleDerive(w http.ResponseWriter, r *http.Request) {
+	handleSymbolic(w, r, func(req SymbolicRequest, userID string) (*calculator.SymbolicResult, error) {
+		return calculator.Derive(req.Expression, req.Variable, userID)
+	})
+}
+
+// HandleSimplify returns the simplified expression
+func HandleSimplify(w http.ResponseWriter, r *http.Request) {
+	handleSymbolic(w, r, func(req SymbolicRequest, userID string) (*calculator.SymbolicResult, error) {
+		return calculator.Simplify(req.Expression, userID)
+	})
+}
+
+func handleSymbolic(w http.ResponseWriter, r *http.Request, transform func(SymbolicRequest, string) (*calculator.SymbolicResult, error)) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID := getUserIDFromContext(r.Context())
+
+	var req SymbolicRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		logger.Error("handleSymbolic: Failed to decode request: %v", err)
+		http.Error(w, "Invalid request body", http.StatusUnprocessableEntity)
+		return
+	}
+	if req.Variable == "" {
+		req.Variable = defaultSymbolicVariable
+	}
+	if err := calculator.ValidateVariableName(req.Variable); err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	// символьные преобразования разбирают только инфиксную запись
+	if req.Syntax != "" && req.Syntax != calculator.SyntaxInfix {
+		http.Error(w, "symbolic expressions use the infix syntax", http.StatusUnprocessableEntity)
+		return
+	}
+
+	result, err := transform(req, userID)
+	if err != nil {
+		logger.Error("handleSymbolic: Expression processing error: %v", err)
+		writeExpressionError(w, err)
+		return
+	}
+	response := SymbolicResponse{
+		Expression: result.Text,
+		Tree:       newTreeNodeResponse(result.Tree, nil, make(map[*calculator.Node]bool)),
+	}
+
+	// значение в точке считается обычным сценарием: x = <at>; <результат>
+	if req.At != nil {
+		script := req.Variable + "=" + req.At.String() + ";" + result.Text
+		expr, err := calculator.ProcessExpression(script, userID, req.options())
+		if err != nil {
+			logger.Error("handleSymbolic: Evaluation error: %v", err)
+			writeExpressionError(w, err)
+			return
+		}
+		response.ID = expr.ID
+	}
+
+	writeJSON(w, response)
+}
@@ -1,21 +1,34 @@
 package handler
 
 import (
+	"calc-service/internal/cache"
 	"calc-service/internal/calculator"
 	"calc-service/internal/store"
 	"calc-service/pkg/logger"
+	"calc-service/pkg/mathops"
 	"encoding/json"
 	"net/http"
+	"strconv"
 	"strings"
 )
 
 type TaskResponse struct {
-	Task *store.Task `json:"task"`
+	Task  *store.Task `json:"task"`
+	Lease int64       `json:"lease_ms"` // срок аренды: агент продлевает его, пока вычисляет задачу
 }
 
 type TaskResultRequest struct {
-	ID     string  `json:"id"`
-	Result float64 `json:"result"`
+	ID          string  `json:"id"`
+	Result      float64 `json:"result"`
+	ResultExact string  `json:"result_exact,omitempty"` // результат в числовом режиме задачи
+	Error       string  `json:"error,omitempty"`        // ошибка вычисления вместо результата
+}
+
+// TaskResultResponse is the result of a completed task
+type TaskResultResponse struct {
+	Result      float64 `json:"result"`
+	ResultExact string  `json:"result_exact,omitempty"`
+	Error       string  `json:"error,omitempty"`
 }
 
 // TaskHandler handles getting executable tasks and posting task results
@@ -30,15 +43,32 @@ func TaskHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// handleGetTask returns an executable task from any user
-func handleGetTask(w http.ResponseWriter, _ *http.Request) {
-	task, found := store.GetNextExecutableTask()
-	if !found {
-		w.WriteHeader(http.StatusNotFound)
+// handleGetTask leases an executable task from any user to the polling agent
+func handleGetTask(w http.ResponseWriter, r *http.Request) {
+	owner, ok := leaseOwner(r)
+	if !ok {
+		http.Error(w, "X-Agent-ID header is required", http.StatusBadRequest)
 		return
 	}
+	recordAgent(r)
+
+	// условия, завершение агрегатов и задачи, результат которых уже известен,
+	// завершаем сразу и берем следующую
+	lease := taskLease()
+	var task *store.Task
+	for {
+		var found bool
+		task, found = store.ClaimNextTask(owner, lease)
+		if !found {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if !completeConditional(task) && !completeFinalizer(task) && !completeFromCache(task) {
+			break
+		}
+	}
 
-	response := TaskResponse{Task: task}
+	response := TaskResponse{Task: task, Lease: lease.Milliseconds()}
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
@@ -50,6 +80,12 @@ func handleGetTask(w http.ResponseWriter, _ *http.Request) {
 
 // handlePostTaskResult updates a task with its result and rolls up expression status
 func handlePostTaskResult(w http.ResponseWriter, r *http.Request) {
+	owner, ok := leaseOwner(r)
+	if !ok {
+		http.Error(w, "X-Agent-ID header is required", http.StatusBadRequest)
+		return
+	}
+
 	var req TaskResultRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		logger.Error("Failed to decode task result: %v", err)
@@ -63,11 +99,56 @@ func handlePostTaskResult(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := store.CompleteTask(req.ID, req.Result); err != nil {
+	// результат принимается только от агента, которому задача выдана; задача,
+	// завершенная другим агентом, из кэша или с ошибкой, или аренда, истекшая
+	// и перешедшая к другому агенту, — 409, как при продлении аренды
+	if req.Error != "" {
+		failed, err := store.FailTask(req.ID, owner, req.Error)
+		if err != nil {
+			logger.Error("Failed to fail task: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		if !failed {
+			http.Error(w, "Task is not leased to the agent", http.StatusConflict)
+			return
+		}
+		logger.Warn("Task %s failed: %s", req.ID, req.Error)
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	// агенты без поддержки режимов присылают только число
+	if req.ResultExact == "" {
+		req.ResultExact = strconv.FormatFloat(req.Result, 'g', -1, 64)
+	}
+
+	completed, err := completeTask(task, owner, req.Result, req.ResultExact)
+	if err != nil {
 		logger.Error("Failed to complete task: %v", err)
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
+	if !completed {
+		http.Error(w, "Task is not leased to the agent", http.StatusConflict)
+		return
+	}
+	if cache.Enabled() {
+		if key, ok := taskCacheKey(task); ok {
+			cache.Put(key, req.ResultExact)
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// completeTask stores the result of the task leased to owner and rolls up the
+// expression status; it reports false if the task is not owner's anymore
+func completeTask(task *store.Task, owner string, result float64, exact string) (bool, error) {
+	completed, err := store.CompleteTask(task.ID, owner, result, exact)
+	if err != nil || !completed {
+		return completed, err
+	}
 
 	// апдейтим статус выражения
 	exprID := task.ExpressionID
@@ -75,18 +156,160 @@ func handlePostTaskResult(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		logger.Error("CountIncompleteTasks: %v", err)
 	} else if remaining == 0 {
-		// все таски готовы → completed, сохраняем финальный результат
-		if err := store.UpdateExpressionStatus(exprID, "completed", req.Result); err != nil {
+		// все таски готовы → completed, сохраняем финальный результат;
+		// последней может завершиться привязка сценария, а не корень
+		if completeMatrix(exprID) {
+			return true, nil
+		}
+		if rootID, ok := store.GetRootTaskID(exprID); ok && rootID != task.ID {
+			if root, found := store.GetTask(rootID); found {
+				result, exact = root.Result, root.Exact()
+			}
+		}
+		if err := store.UpdateExpressionStatus(exprID, "completed", result, exact); err != nil {
 			logger.Error("UpdateExpressionStatus to completed: %v", err)
 		}
 	} else {
 		// первый результат пришёл → in_progress
-		if err := store.UpdateExpressionStatus(exprID, "in_progress", 0); err != nil {
+		if err := store.UpdateExpressionStatus(exprID, "in_progress", 0, ""); err != nil {
 			logger.Error("UpdateExpressionStatus to in_progress: %v", err)
 		}
 	}
 
-	w.WriteHeader(http.StatusOK)
+	return true, nil
+}
+
+// completeMatrix completes an expression whose result is a vector or a matrix
+// once all the tasks are done: the orchestrator assembles the values of the
+// elements into the result. It reports whether the expression has such a result
+func completeMatrix(exprID string) bool {
+	expr, found := store.GetExpression(exprID)
+	if !found || expr.Matrix == nil {
+		return false
+	}
+	values, err := calculator.MatrixValues(expr.Matrix, expr.Mode)
+	if err != nil {
+		logger.Error("completeMatrix: %v", err)
+		return true
+	}
+	expr.Matrix.Result = values
+	if err := store.CompleteMatrixExpression(exprID, expr.Matrix); err != nil {
+		logger.Error("CompleteMatrixExpression: %v", err)
+	}
+	return true
+}
+
+// completeFromCache completes an executable task with the cached result of the
+// same operation over the same values, without sending it to an agent
+func completeFromCache(task *store.Task) bool {
+	if !cache.Enabled() {
+		return false
+	}
+	key, ok := taskCacheKey(task)
+	if !ok {
+		return false
+	}
+	value, ok := cache.Get(key)
+	if !ok {
+		return false
+	}
+	if _, err := completeTask(task, task.LeaseOwner, mathops.ToFloat(value), value); err != nil {
+		logger.Error("Failed to complete task %s from cache: %v", task.ID, err)
+		return false
+	}
+	logger.Info("Task %s completed from cache", task.ID)
+	return true
+}
+
+// completeConditional completes an executable if(cond, a, b) with the value
+// of the branch selected by its condition; conditionals are not sent to
+// agents, and the tasks of the other branch are cancelled by then
+func completeConditional(task *store.Task) bool {
+	if task.Operator != "if" || len(task.Args) != 3 {
+		return false
+	}
+	cond, ok := argValue(task, task.Args[0])
+	if !ok {
+		return false
+	}
+	branch := task.Args[2]
+	if mathops.IsTrue(cond) {
+		branch = task.Args[1]
+	}
+	value, ok := argValue(task, branch)
+	if !ok {
+		return false
+	}
+	if _, err := completeTask(task, task.LeaseOwner, mathops.ToFloat(value), value); err != nil {
+		logger.Error("Failed to complete conditional %s: %v", task.ID, err)
+		return false
+	}
+	return true
+}
+
+// completeFinalizer computes an executable "mean" or median, which finish the
+// aggregates, once the values are known; like conditionals they are not sent
+// to agents. An error of the computation (e.g. a fractional average in integer
+// mode) fails the task
+func completeFinalizer(task *store.Task) bool {
+	if !mathops.IsFinalizer(task.Operator) {
+		return false
+	}
+	args := task.Operands()
+	values := make([]string, len(args))
+	for i, arg := range args {
+		value, ok := argValue(task, arg)
+		if !ok {
+			return false
+		}
+		values[i] = value
+	}
+
+	value, err := mathops.Evaluate(task.Mode, task.Operator, values...)
+	if err != nil {
+		if _, err := store.FailTask(task.ID, task.LeaseOwner, err.Error()); err != nil {
+			logger.Error("Failed to fail task %s: %v", task.ID, err)
+			return false
+		}
+		return true
+	}
+	if _, err := completeTask(task, task.LeaseOwner, mathops.ToFloat(value), value); err != nil {
+		logger.Error("Failed to complete %s %s: %v", task.Operator, task.ID, err)
+		return false
+	}
+	return true
+}
+
+// taskCacheKey addresses the result of the task by its operation, mode and the
+// values of its arguments; it fails while a dependency has no result
+func taskCacheKey(task *store.Task) (string, bool) {
+	args := task.Operands()
+	values := make([]string, len(args))
+	for i, arg := range args {
+		value, ok := argValue(task, arg)
+		if !ok {
+			return "", false
+		}
+		values[i] = value
+	}
+	return cache.Key(task.Mode, task.Operator, values...), true
+}
+
+// argValue returns an argument of the task as a number of its mode, looking up
+// the result of the task it refers to; it fails while that task has no result
+func argValue(task *store.Task, arg string) (string, bool) {
+	if id, ok := strings.CutPrefix(arg, "task:"); ok {
+		dep, found := store.GetTask(id)
+		if !found || dep.Status() != store.TaskCompleted {
+			return "", false
+		}
+		arg = dep.Exact()
+	}
+	value, err := mathops.Normalize(task.Mode, arg)
+	if err != nil {
+		return "", false
+	}
+	return value, true
 }
 
 // HandleTaskByID gets a completed task by ID
@@ -123,9 +346,7 @@ func HandleTaskByID(w http.ResponseWriter, r *http.Request) {
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(struct {
-		Result float64 `json:"result"`
-	}{Result: task.Result})
+	json.NewEncoder(w).Encode(TaskResultResponse{Result: task.Result, ResultExact: task.ResultExact, Error: task.Error})
 }
 
 // HandleInternalTaskByID возвращает результат задачи любому внутреннему клиенту
@@ -140,10 +361,13 @@ func HandleInternalTaskByID(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Not found", http.StatusNotFound)
 		return
 	}
+	// у отмененной задачи невыбранной ветви результата нет, нулевой Result — не значение
+	if task.Status() == store.TaskCancelled {
+		http.Error(w, "Task was cancelled", http.StatusConflict)
+		return
+	}
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(struct {
-		Result float64 `json:"result"`
-	}{Result: task.Result})
+	json.NewEncoder(w).Encode(TaskResultResponse{Result: task.Result, ResultExact: task.ResultExact, Error: task.Error})
 }
 
 // ProcessPendingTasks processes all pending tasks from all users
@@ -188,6 +412,9 @@ func ProcessUserTasks(userID string) {
 			}
 
 			// Если всё завершено, финализируем результат
+			if incomplete == 0 && completeMatrix(expr.ID) {
+				continue
+			}
 			if incomplete == 0 {
 				tasks, err := store.GetTasksByExpression(expr.ID, userID)
 				if err != nil {
@@ -201,14 +428,14 @@ func ProcessUserTasks(userID string) {
 					continue
 				}
 
-				err = store.UpdateExpressionStatus(expr.ID, "completed", result)
+				err = store.UpdateExpressionStatus(expr.ID, "completed", mathops.ToFloat(result), result)
 				if err != nil {
 					logger.Error("ProcessUserTasks: UpdateExpressionStatus failed: %v", err)
 				}
 			}
 		} else if expr.Status == "pending" {
 			// Если есть executable таски и статус был pending, меняем на in_progress
-			err = store.UpdateExpressionStatus(expr.ID, "in_progress", 0)
+			err = store.UpdateExpressionStatus(expr.ID, "in_progress", 0, "")
 			if err != nil {
 				logger.Error("ProcessUserTasks: UpdateExpressionStatus to in_progress failed: %v", err)
 			}
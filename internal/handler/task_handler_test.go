@@ -0,0 +1,37 @@
+package handler
+
+import (
+	"calc-service/internal/store"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestInternalTaskResultCancelled(t *testing.T) {
+	// if(1 > 2, 3*3, 4*4): ветвь «истина» отменяется ложным условием
+	cond := &store.Task{ID: "task-result-cond", Arg1: "1", Arg2: "2", Operator: ">", Mode: "float"}
+	then := &store.Task{ID: "task-result-then", Arg1: "3", Arg2: "3", Operator: "*", Mode: "float", Guard: cond.ID, GuardValue: true}
+	if err := store.RegisterTasks("expr-result-cancelled", "user-result", []*store.Task{cond, then}); err != nil {
+		t.Fatal(err)
+	}
+	if claimed, ok := store.ClaimNextTask("agent-1", time.Minute); !ok || claimed.ID != cond.ID {
+		t.Fatalf("got %v, want the condition %s", claimed, cond.ID)
+	}
+	if ok, err := store.CompleteTask(cond.ID, "agent-1", 0, "0"); err != nil || !ok {
+		t.Fatalf("condition was not completed: %v", err)
+	}
+
+	get := func(id string) int {
+		w := httptest.NewRecorder()
+		HandleInternalTaskByID(w, httptest.NewRequest(http.MethodGet, "/internal/task/result/"+id, nil))
+		return w.Code
+	}
+	if code := get(cond.ID); code != http.StatusOK {
+		t.Errorf("result of the condition: got status %d, want 200", code)
+	}
+	// у отмененной задачи нет результата, нулевой Result не выдается за значение
+	if code := get(then.ID); code != http.StatusConflict {
+		t.Errorf("result of the cancelled task: got status %d, want 409", code)
+	}
+}
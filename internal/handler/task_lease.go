@@ -0,0 +1,115 @@
+package handler
+
+import (
+	"calc-service/internal/store"
+	"calc-service/pkg/logger"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+const (
+	// defaultTaskLease is how long a task stays with an agent without a
+	// heartbeat unless TASK_LEASE_MS is set
+	defaultTaskLease = 10 * time.Second
+	// defaultTaskMaxAttempts is how many times a task is handed out before it
+	// fails unless TASK_MAX_ATTEMPTS is set
+	defaultTaskMaxAttempts = 3
+)
+
+// HeartbeatRequest extends the lease of a task the agent is computing
+type HeartbeatRequest struct {
+	ID string `json:"id"`
+}
+
+func taskLease() time.Duration {
+	ms, err := strconv.Atoi(os.Getenv("TASK_LEASE_MS"))
+	if err != nil || ms <= 0 {
+		return defaultTaskLease
+	}
+	return time.Duration(ms) * time.Millisecond
+}
+
+func taskMaxAttempts() int {
+	n, err := strconv.Atoi(os.Getenv("TASK_MAX_ATTEMPTS"))
+	if err != nil || n <= 0 {
+		return defaultTaskMaxAttempts
+	}
+	return n
+}
+
+// leaseOwner identifies the agent holding a lease by the X-Agent-ID header.
+// The header is required: the address of the agent changes its port with
+// every connection and doesn't tell apart the agents of one host
+func leaseOwner(r *http.Request) (string, bool) {
+	id := r.Header.Get("X-Agent-ID")
+	return id, id != ""
+}
+
+// HandleTaskHeartbeat extends the lease of a running task. 409 Conflict tells
+// the agent that the task is no longer its own: it is completed or, after the
+// lease expired, handed out again
+func HandleTaskHeartbeat(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req HeartbeatRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ID == "" {
+		http.Error(w, "Invalid request body", http.StatusUnprocessableEntity)
+		return
+	}
+
+	owner, ok := leaseOwner(r)
+	if !ok {
+		http.Error(w, "X-Agent-ID header is required", http.StatusBadRequest)
+		return
+	}
+	extended, err := store.ExtendLease(req.ID, owner, taskLease())
+	if err != nil {
+		logger.Error("Failed to extend lease: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if !extended {
+		http.Error(w, "Task is not leased to the agent", http.StatusConflict)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// ReapExpiredLeases returns the tasks of agents that stopped sending
+// heartbeats (crashed or lost) to the queue; a task whose lease has expired
+// TASK_MAX_ATTEMPTS times fails with its expression
+func ReapExpiredLeases() {
+	tasks, err := store.GetExpiredLeases()
+	if err != nil {
+		logger.Error("ReapExpiredLeases: %v", err)
+		return
+	}
+
+	maxAttempts := taskMaxAttempts()
+	for _, task := range tasks {
+		if task.Attempts >= maxAttempts {
+			logger.Warn("Task %s lease expired, giving up after %d attempts", task.ID, task.Attempts)
+			message := fmt.Sprintf("task was not completed after %d attempts", task.Attempts)
+			if _, err := store.FailTask(task.ID, task.LeaseOwner, message); err != nil {
+				logger.Error("ReapExpiredLeases: %v", err)
+			}
+			continue
+		}
+
+		requeued, err := store.RequeueTask(task.ID)
+		if err != nil {
+			logger.Error("ReapExpiredLeases: %v", err)
+			continue
+		}
+		if requeued {
+			logger.Warn("Task %s lease of %s expired, requeued after %d attempts", task.ID, task.LeaseOwner, task.Attempts)
+		}
+	}
+}
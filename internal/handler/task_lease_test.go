@@ -0,0 +1,132 @@
+package handler
+
+import (
+	"calc-service/internal/store"
+	"calc-service/pkg/database"
+	"calc-service/pkg/logger"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "calc-handler-test")
+	if err != nil {
+		panic(err)
+	}
+	os.Setenv("DB_PATH", filepath.Join(dir, "test.db"))
+	logger.Init("fatal")
+	if err := database.InitDB(); err != nil {
+		panic(err)
+	}
+
+	code := m.Run()
+	database.CloseDB()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+func TestReapExpiredLeases(t *testing.T) {
+	t.Setenv("TASK_MAX_ATTEMPTS", "2")
+	expr, err := store.NewExpression("1+2", "user-lease", "float", 1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	task := &store.Task{ID: "task-reap", Arg1: "1", Arg2: "2", Operator: "+", Mode: "float"}
+	if err := store.RegisterTasks(expr.ID, "user-lease", []*store.Task{task}); err != nil {
+		t.Fatal(err)
+	}
+
+	// первая аренда истекла: задача возвращается в очередь
+	if _, ok := store.ClaimNextTask("agent-1", time.Millisecond); !ok {
+		t.Fatal("no task to claim")
+	}
+	time.Sleep(10 * time.Millisecond)
+	ReapExpiredLeases()
+	got, _ := store.GetTask(task.ID)
+	if got.Status() != store.TaskPending || got.LeaseOwner != "" {
+		t.Fatalf("got status %s leased to %q, want pending", got.Status(), got.LeaseOwner)
+	}
+
+	// вторая аренда — последняя попытка: задача и выражение завершаются ошибкой
+	if _, ok := store.ClaimNextTask("agent-2", time.Millisecond); !ok {
+		t.Fatal("requeued task was not handed out again")
+	}
+	time.Sleep(10 * time.Millisecond)
+	ReapExpiredLeases()
+	got, _ = store.GetTask(task.ID)
+	if got.Status() != store.TaskError || got.Attempts != 2 {
+		t.Errorf("got status %s after %d attempts, want error after 2", got.Status(), got.Attempts)
+	}
+	if e, _ := store.GetExpression(expr.ID); e.Status != "error" {
+		t.Errorf("got expression status %s, want error", e.Status)
+	}
+	if task, ok := store.ClaimNextTask("agent-3", time.Minute); ok {
+		t.Errorf("claimed failed task %s", task.ID)
+	}
+}
+
+func TestPostTaskResultOwner(t *testing.T) {
+	expr, err := store.NewExpression("1+2", "user-lease", "float", 1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	task := &store.Task{ID: "task-post", Arg1: "1", Arg2: "2", Operator: "+", Mode: "float"}
+	if err := store.RegisterTasks(expr.ID, "user-lease", []*store.Task{task}); err != nil {
+		t.Fatal(err)
+	}
+
+	get := httptest.NewRequest(http.MethodGet, "/internal/task", nil)
+	get.Header.Set("X-Agent-ID", "agent-1")
+	w := httptest.NewRecorder()
+	TaskHandler(w, get)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d, want a task", w.Code)
+	}
+
+	post := func(agent string) int {
+		body := `{"id": "task-post", "result": 3, "result_exact": "3"}`
+		r := httptest.NewRequest(http.MethodPost, "/internal/task", strings.NewReader(body))
+		r.Header.Set("X-Agent-ID", agent)
+		w := httptest.NewRecorder()
+		TaskHandler(w, r)
+		return w.Code
+	}
+	if code := post("agent-2"); code != http.StatusConflict {
+		t.Errorf("result of another agent: got status %d, want 409", code)
+	}
+	if code := post("agent-1"); code != http.StatusOK {
+		t.Errorf("result of the owner: got status %d, want 200", code)
+	}
+	if code := post("agent-1"); code != http.StatusConflict {
+		t.Errorf("repeated result: got status %d, want 409", code)
+	}
+	if e, _ := store.GetExpression(expr.ID); e.Status != "completed" || e.ResultExact != "3" {
+		t.Errorf("got expression %s with %s, want completed with 3", e.Status, e.ResultExact)
+	}
+}
+
+func TestLeaseOwnerRequired(t *testing.T) {
+	// без X-Agent-ID агента не отличить от других: адрес меняет порт с каждым соединением
+	requests := []*http.Request{
+		httptest.NewRequest(http.MethodGet, "/internal/task", nil),
+		httptest.NewRequest(http.MethodPost, "/internal/task", strings.NewReader(`{"id": "task-post", "result": 3}`)),
+	}
+	for _, r := range requests {
+		w := httptest.NewRecorder()
+		TaskHandler(w, r)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s without X-Agent-ID: got status %d, want 400", r.Method, w.Code)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	HandleTaskHeartbeat(w, httptest.NewRequest(http.MethodPost, "/internal/task/heartbeat", strings.NewReader(`{"id": "task-post"}`)))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("heartbeat without X-Agent-ID: got status %d, want 400", w.Code)
+	}
+}
@@ -0,0 +1,152 @@
+package handler
+
+import (
+	"calc-service/internal/calculator"
+	"calc-service/internal/store"
+	"calc-service/pkg/logger"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ExpressionTreeResponse is the expression tree restored from the tasks of an expression
+type ExpressionTreeResponse struct {
+	ID         string            `json:"id"`
+	Expression string            `json:"expression"`
+	Status     string            `json:"status"`
+	Tree       *TreeNodeResponse `json:"tree"`
+}
+
+// TreeNodeResponse is a node of the expression tree; operations and results of
+// referenced expressions carry the task that computes them
+type TreeNodeResponse struct {
+	Kind     string              `json:"kind"`
+	Value    string              `json:"value"`
+	Task     *TreeTaskResponse   `json:"task,omitempty"`
+	Children []*TreeNodeResponse `json:"children,omitempty"`
+	Shared   bool                `json:"shared,omitempty"` // повтор общего узла, его поддерево показано при первом появлении
+}
+
+// TreeTaskResponse describes the state of a task in the tree
+type TreeTaskResponse struct {
+	ID           string     `json:"id"`
+	ExpressionID string     `json:"expression_id"`
+	Operation    string     `json:"operation"`
+	Args         []string   `json:"args"`
+	Status       string     `json:"status"`
+	Result       *float64   `json:"result,omitempty"`
+	ResultExact  string     `json:"result_exact,omitempty"`
+	Error        string     `json:"error,omitempty"`
+	CreatedAt    *time.Time `json:"created_at,omitempty"`
+	StartedAt    *time.Time `json:"started_at,omitempty"`
+	CompletedAt  *time.Time `json:"completed_at,omitempty"`
+	DurationMs   *int64     `json:"duration_ms,omitempty"` // от выдачи агенту до результата
+
+	LeaseOwner     string     `json:"lease_owner,omitempty"` // агент, вычисляющий задачу
+	LeaseExpiresAt *time.Time `json:"lease_expires_at,omitempty"`
+	Attempts       int        `json:"attempts,omitempty"` // выдачи агентам, больше одной — после истекшей аренды
+}
+
+// HandleExpressionTree returns the tree of an expression with the state of every task
+func HandleExpressionTree(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID := getUserIDFromContext(r.Context())
+	id := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/api/v1/expressions/"), "/tree")
+
+	expr, found := store.GetUserExpression(id, userID)
+	if !found {
+		http.Error(w, "Expression not found", http.StatusNotFound)
+		return
+	}
+
+	tasks, err := store.GetTasksByExpression(expr.ID, userID)
+	if err != nil {
+		logger.Error("HandleExpressionTree: GetTasksByExpression failed: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	response := ExpressionTreeResponse{ID: expr.ID, Expression: expr.Expression, Status: expr.Status}
+	byID := make(map[string]*store.Task, len(tasks))
+	for _, task := range tasks {
+		byID[task.ID] = task
+	}
+	if expr.Matrix != nil {
+		// у вектора и матрицы дерево — список деревьев элементов
+		response.Tree = newTreeNodeResponse(calculator.BuildMatrixTree(tasks, expr.Matrix), byID, make(map[*calculator.Node]bool))
+		writeJSON(w, response)
+		return
+	}
+	if len(tasks) == 0 {
+		// выражение без операций сразу вычисляется в число
+		response.Tree = &TreeNodeResponse{Kind: calculator.NumberNode.String(), Value: expr.Exact()}
+		writeJSON(w, response)
+		return
+	}
+
+	root, err := calculator.BuildTree(tasks)
+	if err != nil {
+		logger.Error("HandleExpressionTree: BuildTree failed: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	response.Tree = newTreeNodeResponse(root, byID, make(map[*calculator.Node]bool))
+	writeJSON(w, response)
+}
+
+// newTreeNodeResponse converts the tree, looking up tasks of other expressions
+// in the store; a node shared by several parents is expanded only once
+func newTreeNodeResponse(n *calculator.Node, tasks map[string]*store.Task, seen map[*calculator.Node]bool) *TreeNodeResponse {
+	response := &TreeNodeResponse{Kind: n.Kind.String(), Value: n.Value}
+	if n.TaskID != "" {
+		task, ok := tasks[n.TaskID]
+		if !ok {
+			task, ok = store.GetTask(n.TaskID)
+		}
+		if ok {
+			response.Task = newTreeTaskResponse(task)
+		}
+	}
+	if seen[n] && n.TaskID != "" {
+		response.Shared = true
+		return response
+	}
+	seen[n] = true
+	for _, child := range n.Operands() {
+		response.Children = append(response.Children, newTreeNodeResponse(child, tasks, seen))
+	}
+	return response
+}
+
+func newTreeTaskResponse(task *store.Task) *TreeTaskResponse {
+	response := &TreeTaskResponse{
+		ID:           task.ID,
+		ExpressionID: task.ExpressionID,
+		Operation:    task.Operator,
+		Args:         task.Operands(),
+		Status:       task.Status(),
+		Error:        task.Error,
+		CreatedAt:    task.CreatedAt,
+		StartedAt:    task.StartedAt,
+		CompletedAt:  task.CompletedAt,
+		Attempts:     task.Attempts,
+	}
+	if task.Status() == store.TaskRunning {
+		response.LeaseOwner = task.LeaseOwner
+		response.LeaseExpiresAt = task.LeaseExpiresAt
+	}
+	if task.Status() == store.TaskCompleted {
+		response.Result = &task.Result
+		response.ResultExact = task.ResultExact
+	}
+	if task.StartedAt != nil && task.CompletedAt != nil {
+		duration := task.CompletedAt.Sub(*task.StartedAt).Milliseconds()
+		response.DurationMs = &duration
+	}
+	return response
+}
@@ -0,0 +1,122 @@
+package handler
+
+import (
+	"calc-service/internal/calculator"
+	"calc-service/internal/store"
+	"calc-service/pkg/logger"
+	"calc-service/pkg/mathops"
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+type VariableRequest struct {
+	Name  string       `json:"name"`
+	Value *json.Number `json:"value"` // запись числа сохраняется точно, без округления до float64
+}
+
+type VariablesResponse struct {
+	Variables []*store.Variable `json:"variables"`
+}
+
+type VariableDetailResponse struct {
+	Variable *store.Variable `json:"variable"`
+}
+
+// HandleVariables lists the user's variables (GET) or creates/updates one (POST)
+func HandleVariables(w http.ResponseWriter, r *http.Request) {
+	userID := getUserIDFromContext(r.Context())
+
+	switch r.Method {
+	case http.MethodGet:
+		variables, err := store.ListVariables(userID)
+		if err != nil {
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		if variables == nil {
+			variables = []*store.Variable{}
+		}
+		writeJSON(w, VariablesResponse{Variables: variables})
+	case http.MethodPost:
+		var req VariableRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			logger.Error("HandleVariables: Failed to decode request: %v", err)
+			http.Error(w, "Invalid request body", http.StatusUnprocessableEntity)
+			return
+		}
+		saveVariable(w, userID, req.Name, req.Value, http.StatusCreated)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// HandleVariableByName reads (GET), updates (PUT) or deletes (DELETE) a single variable
+func HandleVariableByName(w http.ResponseWriter, r *http.Request) {
+	userID := getUserIDFromContext(r.Context())
+	name := strings.TrimPrefix(r.URL.Path, "/api/v1/variables/")
+
+	switch r.Method {
+	case http.MethodGet:
+		variable, found := store.GetVariable(userID, name)
+		if !found {
+			http.Error(w, "Variable not found", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, VariableDetailResponse{Variable: variable})
+	case http.MethodPut:
+		var req VariableRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			logger.Error("HandleVariableByName: Failed to decode request: %v", err)
+			http.Error(w, "Invalid request body", http.StatusUnprocessableEntity)
+			return
+		}
+		if req.Name != "" && req.Name != name {
+			http.Error(w, "Variable name in body does not match the URL", http.StatusUnprocessableEntity)
+			return
+		}
+		saveVariable(w, userID, name, req.Value, http.StatusOK)
+	case http.MethodDelete:
+		deleted, err := store.DeleteVariable(userID, name)
+		if err != nil {
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		if !deleted {
+			http.Error(w, "Variable not found", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func saveVariable(w http.ResponseWriter, userID, name string, value *json.Number, status int) {
+	if err := calculator.ValidateVariableName(name); err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	if value == nil {
+		http.Error(w, "Variable value is required", http.StatusUnprocessableEntity)
+		return
+	}
+
+	// значение хранится канонической десятичной записью, в каждом режиме оно приводится при подстановке
+	exact, err := mathops.Normalize(mathops.ModeDecimal, value.String())
+	if err != nil {
+		http.Error(w, "Invalid variable value: "+err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+
+	variable, err := store.SetVariable(userID, name, exact)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	logger.Info("Variable %s saved for user %s", name, userID)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(VariableDetailResponse{Variable: variable})
+}
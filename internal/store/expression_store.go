@@ -4,21 +4,85 @@ import (
 	"calc-service/pkg/database"
 	"calc-service/pkg/logger"
 	"database/sql"
+	"encoding/json"
 	"fmt"
+	"strconv"
 	"time"
 )
 
 // Expression represents a mathematical expression
 type Expression struct {
-	ID         string    `json:"id"`
-	Expression string    `json:"expression"`
-	Status     string    `json:"status"`
-	Result     float64   `json:"result,omitempty"`
-	CreatedAt  time.Time `json:"created_at"`
+	ID          string    `json:"id"`
+	Expression  string    `json:"expression"`
+	Status      string    `json:"status"`
+	Mode        string    `json:"mode"`
+	Result      float64   `json:"result,omitempty"`
+	ResultExact string    `json:"result_exact,omitempty"`
+	Error       string    `json:"error,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+
+	Depth          int `json:"depth"`           // глубина дерева выражения
+	OptimizedDepth int `json:"optimized_depth"` // глубина дерева, по которому созданы задачи
+
+	Bindings []Binding `json:"bindings,omitempty"` // имена, связанные инструкциями сценария
+	Matrix   *Matrix   `json:"matrix,omitempty"`   // результат-вектор или матрица
+}
+
+// Binding is a name bound by a statement of a script: either to the task that
+// computes its value or, if no task is needed, to the value itself
+type Binding struct {
+	Name   string  `json:"name"`
+	TaskID string  `json:"task_id,omitempty"`
+	Value  string  `json:"value,omitempty"`
+	Matrix *Matrix `json:"matrix,omitempty"` // значение-вектор или матрица
 }
 
-// NewExpression creates a new expression record
-func NewExpression(exprText, userID string) (*Expression, error) {
+// Matrix is a vector or a matrix computed element by element: its shape (the
+// length of a vector, the rows and the columns of a matrix) and its elements
+// in row-major order as task arguments, "task:<id>" or a number. Result holds
+// the values of the elements once the orchestrator has assembled them
+type Matrix struct {
+	Shape    []int    `json:"shape"`
+	Elements []string `json:"elements"`
+	Result   []string `json:"result,omitempty"`
+}
+
+// Exact returns the result of a completed expression as a canonical number in
+// its mode, falling back to the float value like Task.Exact
+func (e *Expression) Exact() string {
+	if e.ResultExact != "" {
+		return e.ResultExact
+	}
+	return strconv.FormatFloat(e.Result, 'g', -1, 64)
+}
+
+// expressionColumns is the column list matching scanExpression
+const expressionColumns = "id, expression, status, mode, COALESCE(result, 0), COALESCE(result_exact, ''), COALESCE(error, ''), created_at, depth, optimized_depth, bindings, COALESCE(matrix, '')"
+
+// scanExpression reads an expression selected with expressionColumns
+func scanExpression(row rowScanner) (*Expression, error) {
+	var expr Expression
+	var bindings, matrix string
+	if err := row.Scan(
+		&expr.ID, &expr.Expression, &expr.Status, &expr.Mode, &expr.Result, &expr.ResultExact, &expr.Error, &expr.CreatedAt,
+		&expr.Depth, &expr.OptimizedDepth, &bindings, &matrix,
+	); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(bindings), &expr.Bindings); err != nil {
+		logger.Error("Failed to decode bindings of %s: %v", expr.ID, err)
+	}
+	if matrix != "" {
+		if err := json.Unmarshal([]byte(matrix), &expr.Matrix); err != nil {
+			logger.Error("Failed to decode matrix of %s: %v", expr.ID, err)
+		}
+	}
+	return &expr, nil
+}
+
+// NewExpression creates a new expression record; depth and optimizedDepth are
+// the depths of the expression tree before and after optimization
+func NewExpression(exprText, userID, mode string, depth, optimizedDepth int) (*Expression, error) {
 	id := fmt.Sprintf("expr-%d", time.Now().UnixNano())
 	now := time.Now()
 
@@ -26,14 +90,18 @@ func NewExpression(exprText, userID string) (*Expression, error) {
 		ID:         id,
 		Expression: exprText,
 		Status:     "pending",
+		Mode:       mode,
 		CreatedAt:  now,
+
+		Depth:          depth,
+		OptimizedDepth: optimizedDepth,
 	}
 
 	// Вставка в базу данных с учетом userID
 	db := database.GetDB()
 	_, err := db.Exec(
-		"INSERT INTO expressions (id, user_id, expression, status, created_at) VALUES (?, ?, ?, ?, ?)",
-		expr.ID, userID, expr.Expression, expr.Status, expr.CreatedAt,
+		"INSERT INTO expressions (id, user_id, expression, status, mode, created_at, depth, optimized_depth) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+		expr.ID, userID, expr.Expression, expr.Status, expr.Mode, expr.CreatedAt, expr.Depth, expr.OptimizedDepth,
 	)
 	if err != nil {
 		return nil, fmt.Errorf("failed to insert expression: %w", err)
@@ -42,15 +110,57 @@ func NewExpression(exprText, userID string) (*Expression, error) {
 	return expr, nil
 }
 
+// SetExpressionBindings stores the names bound by the statements of a script
+func SetExpressionBindings(exprID string, bindings []Binding) error {
+	data, err := json.Marshal(bindings)
+	if err != nil {
+		return err
+	}
+	db := database.GetDB()
+	if _, err := db.Exec("UPDATE expressions SET bindings = ? WHERE id = ?", string(data), exprID); err != nil {
+		return fmt.Errorf("failed to store bindings: %w", err)
+	}
+	return nil
+}
+
+// SetExpressionMatrix stores the elements of the vector or matrix an expression evaluates to
+func SetExpressionMatrix(exprID string, m *Matrix) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	db := database.GetDB()
+	if _, err := db.Exec("UPDATE expressions SET matrix = ? WHERE id = ?", string(data), exprID); err != nil {
+		return fmt.Errorf("failed to store matrix: %w", err)
+	}
+	return nil
+}
+
+// CompleteMatrixExpression completes an expression with a vector or matrix
+// result: m.Result holds the values of its elements
+func CompleteMatrixExpression(exprID string, m *Matrix) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	db := database.GetDB()
+	if _, err := db.Exec(
+		"UPDATE expressions SET status = 'completed', matrix = ? WHERE id = ?",
+		string(data), exprID,
+	); err != nil {
+		return fmt.Errorf("failed to complete matrix expression: %w", err)
+	}
+	return nil
+}
+
 // GetExpression retrieves an expression by ID
 func GetExpression(id string) (*Expression, bool) {
 	db := database.GetDB()
-	var expr Expression
 
-	err := db.QueryRow(
-		"SELECT id, expression, status, COALESCE(result, 0), created_at FROM expressions WHERE id = ?",
+	expr, err := scanExpression(db.QueryRow(
+		"SELECT "+expressionColumns+" FROM expressions WHERE id = ?",
 		id,
-	).Scan(&expr.ID, &expr.Expression, &expr.Status, &expr.Result, &expr.CreatedAt)
+	))
 
 	if err != nil {
 		if err == sql.ErrNoRows {
@@ -60,14 +170,34 @@ func GetExpression(id string) (*Expression, bool) {
 		return nil, false
 	}
 
-	return &expr, true
+	return expr, true
+}
+
+// GetUserExpression retrieves an expression by ID only if it belongs to the user
+func GetUserExpression(id, userID string) (*Expression, bool) {
+	db := database.GetDB()
+
+	expr, err := scanExpression(db.QueryRow(
+		"SELECT "+expressionColumns+" FROM expressions WHERE id = ? AND user_id = ?",
+		id, userID,
+	))
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, false
+		}
+		logger.Error("Database error in GetUserExpression: %v", err)
+		return nil, false
+	}
+
+	return expr, true
 }
 
 // ListExpressions возвращает все выражения для конкретного пользователя
 func ListExpressions(userID string) []*Expression {
 	db := database.GetDB()
 	rows, err := db.Query(
-		"SELECT id, expression, status, COALESCE(result, 0), created_at FROM expressions WHERE user_id = ? ORDER BY created_at DESC",
+		"SELECT "+expressionColumns+" FROM expressions WHERE user_id = ? ORDER BY created_at DESC",
 		userID,
 	)
 	if err != nil {
@@ -78,12 +208,12 @@ func ListExpressions(userID string) []*Expression {
 
 	var expressions []*Expression
 	for rows.Next() {
-		var expr Expression
-		if err := rows.Scan(&expr.ID, &expr.Expression, &expr.Status, &expr.Result, &expr.CreatedAt); err != nil {
+		expr, err := scanExpression(rows)
+		if err != nil {
 			logger.Error("Error scanning expression row: %v", err)
 			continue
 		}
-		expressions = append(expressions, &expr)
+		expressions = append(expressions, expr)
 	}
 
 	return expressions
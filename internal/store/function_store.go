@@ -0,0 +1,107 @@
+package store
+
+import (
+	"calc-service/pkg/database"
+	"calc-service/pkg/logger"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// Function представляет функцию пользователя f(x, y) = body
+type Function struct {
+	Name      string    `json:"name"`
+	Params    []string  `json:"params"`
+	Body      string    `json:"body"` // тело в канонической записи
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// SetFunction создает функцию или заменяет определение существующей
+func SetFunction(userID, name string, params []string, body string) (*Function, error) {
+	now := time.Now()
+
+	db := database.GetDB()
+	_, err := db.Exec(
+		`INSERT INTO functions (user_id, name, params, body, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT (user_id, name) DO UPDATE SET params = excluded.params, body = excluded.body, updated_at = excluded.updated_at`,
+		userID, name, encodeArgs(params), body, now, now,
+	)
+	if err != nil {
+		logger.Error("Failed to save function %s: %v", name, err)
+		return nil, fmt.Errorf("failed to save function: %w", err)
+	}
+
+	function, found := GetFunction(userID, name)
+	if !found {
+		return nil, fmt.Errorf("function %s not found after save", name)
+	}
+	return function, nil
+}
+
+// GetFunction получает функцию пользователя по имени
+func GetFunction(userID, name string) (*Function, bool) {
+	db := database.GetDB()
+	var function Function
+	var params string
+
+	err := db.QueryRow(
+		"SELECT name, params, body, created_at, updated_at FROM functions WHERE user_id = ? AND name = ?",
+		userID, name,
+	).Scan(&function.Name, &params, &function.Body, &function.CreatedAt, &function.UpdatedAt)
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, false
+		}
+		logger.Error("Database error in GetFunction: %v", err)
+		return nil, false
+	}
+
+	function.Params = decodeArgs(params)
+	return &function, true
+}
+
+// ListFunctions возвращает все функции пользователя
+func ListFunctions(userID string) ([]*Function, error) {
+	db := database.GetDB()
+	rows, err := db.Query(
+		"SELECT name, params, body, created_at, updated_at FROM functions WHERE user_id = ? ORDER BY name",
+		userID,
+	)
+	if err != nil {
+		logger.Error("Database error in ListFunctions: %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var functions []*Function
+	for rows.Next() {
+		var function Function
+		var params string
+		if err := rows.Scan(&function.Name, &params, &function.Body, &function.CreatedAt, &function.UpdatedAt); err != nil {
+			logger.Error("Error scanning function row: %v", err)
+			continue
+		}
+		function.Params = decodeArgs(params)
+		functions = append(functions, &function)
+	}
+
+	return functions, nil
+}
+
+// DeleteFunction удаляет функцию, возвращает false, если ее не было
+func DeleteFunction(userID, name string) (bool, error) {
+	db := database.GetDB()
+	res, err := db.Exec(
+		"DELETE FROM functions WHERE user_id = ? AND name = ?",
+		userID, name,
+	)
+	if err != nil {
+		logger.Error("Failed to delete function: %v", err)
+		return false, fmt.Errorf("failed to delete function: %w", err)
+	}
+
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
@@ -3,37 +3,129 @@ package store
 import (
 	"calc-service/pkg/database"
 	"calc-service/pkg/logger"
+	"calc-service/pkg/mathops"
 	"database/sql"
+	"encoding/json"
 	"fmt"
+	"strconv"
+	"time"
 )
 
 // Task represents an atomic calculation operation
 type Task struct {
-	ID            string  `json:"id"`
-	ExpressionID  string  `json:"expression_id"`
-	Arg1          string  `json:"arg1"`
-	Arg2          string  `json:"arg2"`
-	Operator      string  `json:"operation"`
-	OperationTime int     `json:"operation_time"`
-	Result        float64 `json:"result,omitempty"`
-	Completed     bool    `json:"-"`
-	UserID        string  `json:"user_id"`
+	ID            string   `json:"id"`
+	ExpressionID  string   `json:"expression_id"`
+	Arg1          string   `json:"arg1"`
+	Arg2          string   `json:"arg2"`
+	Args          []string `json:"args,omitempty"` // аргументы вызова функции
+	Operator      string   `json:"operation"`
+	OperationTime int      `json:"operation_time"`
+	Mode          string   `json:"mode"` // числовой режим: float, decimal или integer
+	Result        float64  `json:"result,omitempty"`
+	ResultExact   string   `json:"result_exact,omitempty"` // точный результат в режиме выражения
+	Error         string   `json:"error,omitempty"`        // ошибка вычисления; задача с ошибкой тоже completed
+	Completed     bool     `json:"-"`
+	Cancelled     bool     `json:"-"` // задача не нужна: выбрана другая ветвь условия; отмененная задача тоже completed
+	UserID        string   `json:"user_id"`
+
+	// Guard is the task computing the condition of the branch the task belongs
+	// to; the task waits for it and is cancelled unless its truth equals GuardValue
+	Guard      string `json:"-"`
+	GuardValue bool   `json:"-"`
+
+	CreatedAt   *time.Time `json:"created_at,omitempty"`
+	StartedAt   *time.Time `json:"started_at,omitempty"` // первая выдача агенту
+	CompletedAt *time.Time `json:"completed_at,omitempty"`
+
+	// LeaseOwner is the agent the task is handed out to until LeaseExpiresAt;
+	// the agent extends the lease while it computes, an expired lease returns
+	// the task to the queue. Attempts counts the handouts
+	LeaseOwner     string     `json:"lease_owner,omitempty"`
+	LeaseExpiresAt *time.Time `json:"lease_expires_at,omitempty"`
+	Attempts       int        `json:"attempts,omitempty"`
+}
+
+// Task statuses derived from the task row
+const (
+	TaskPending   = "pending"
+	TaskRunning   = "running" // задача выдана агенту и ее аренда не истекла
+	TaskCompleted = "completed"
+	TaskError     = "error"
+	TaskCancelled = "cancelled"
+)
+
+// Status reports the state of the task
+func (t *Task) Status() string {
+	switch {
+	case t.Error != "":
+		return TaskError
+	case t.Cancelled:
+		return TaskCancelled
+	case t.Completed:
+		return TaskCompleted
+	case t.LeaseOwner != "":
+		return TaskRunning
+	default:
+		return TaskPending
+	}
+}
+
+// taskColumns is the column list matching scanTask
+const taskColumns = `id, expression_id, user_id, arg1, arg2, args, operator, operation_time, mode,
+	COALESCE(result, 0), COALESCE(result_exact, ''), COALESCE(error, ''), completed, cancelled, guard, guard_value,
+	created_at, started_at, completed_at, lease_owner, lease_expires_at, attempts`
+
+// rowScanner is implemented by both *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+// scanTask reads a task selected with taskColumns
+func scanTask(row rowScanner) (*Task, error) {
+	var task Task
+	var args string
+	var createdAt, startedAt, completedAt, leaseExpiresAt sql.NullTime
+	if err := row.Scan(
+		&task.ID, &task.ExpressionID, &task.UserID, &task.Arg1, &task.Arg2, &args, &task.Operator, &task.OperationTime,
+		&task.Mode, &task.Result, &task.ResultExact, &task.Error, &task.Completed, &task.Cancelled, &task.Guard, &task.GuardValue,
+		&createdAt, &startedAt, &completedAt, &task.LeaseOwner, &leaseExpiresAt, &task.Attempts,
+	); err != nil {
+		return nil, err
+	}
+	task.Args = decodeArgs(args)
+	task.CreatedAt = nullTime(createdAt)
+	task.StartedAt = nullTime(startedAt)
+	task.CompletedAt = nullTime(completedAt)
+	task.LeaseExpiresAt = nullTime(leaseExpiresAt)
+	return &task, nil
 }
 
 // RegisterTasks ассоциирует задачи с выражением и пользователем
 func RegisterTasks(exprID, userID string, tasks []*Task) error {
+	now := time.Now()
 	return database.Transaction(func(tx *sql.Tx) error {
+		guards := make(map[string]bool)
 		for _, task := range tasks {
 			_, err := tx.Exec(
 				`INSERT INTO tasks (
-					id, expression_id, user_id, arg1, arg2, operator, operation_time, completed
-				) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
-				task.ID, exprID, userID, task.Arg1, task.Arg2, task.Operator, task.OperationTime,
-				task.Completed,
+					id, expression_id, user_id, arg1, arg2, args, operator, operation_time, mode, completed, guard, guard_value, created_at
+				) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+				task.ID, exprID, userID, task.Arg1, task.Arg2, encodeArgs(task.Args), task.Operator, task.OperationTime,
+				task.Mode, task.Completed, task.Guard, task.GuardValue, now,
 			)
 			if err != nil {
 				return fmt.Errorf("failed to insert task %s: %w", task.ID, err)
 			}
+			if task.Guard != "" {
+				guards[task.Guard] = true
+			}
+		}
+
+		// условие может оказаться результатом уже вычисленного выражения
+		for guard := range guards {
+			if err := settleGuards(tx, guard); err != nil {
+				return err
+			}
 		}
 		return nil
 	})
@@ -43,11 +135,10 @@ func RegisterTasks(exprID, userID string, tasks []*Task) error {
 func GetTasksByExpression(exprID, userID string) ([]*Task, error) {
 	db := database.GetDB()
 	rows, err := db.Query(
-		`SELECT 
-			id, expression_id, user_id, arg1, arg2, operator, operation_time, 
-			COALESCE(result, 0), completed 
+		`SELECT `+taskColumns+`
 		FROM tasks 
-		WHERE expression_id = ? AND user_id = ?`,
+		WHERE expression_id = ? AND user_id = ?
+		ORDER BY rowid`,
 		exprID, userID,
 	)
 	if err != nil {
@@ -57,14 +148,11 @@ func GetTasksByExpression(exprID, userID string) ([]*Task, error) {
 
 	var tasks []*Task
 	for rows.Next() {
-		var task Task
-		if err := rows.Scan(
-			&task.ID, &task.ExpressionID, &task.UserID, &task.Arg1, &task.Arg2, &task.Operator, &task.OperationTime,
-			&task.Result, &task.Completed,
-		); err != nil {
+		task, err := scanTask(rows)
+		if err != nil {
 			return nil, err
 		}
-		tasks = append(tasks, &task)
+		tasks = append(tasks, task)
 	}
 
 	return tasks, nil
@@ -79,12 +167,26 @@ func GetExecutableTasks(exprID, userID string) ([]*Task, error) {
 
 	// Create lookup map for completed tasks
 	completedTasks := make(map[string]bool)
+	ownTasks := make(map[string]bool)
 	for _, task := range tasks {
+		ownTasks[task.ID] = true
 		if task.Completed {
 			completedTasks[task.ID] = true
 		}
 	}
 
+	// Dependencies on tasks of other expressions (references like $expr-1) are looked up directly
+	for _, task := range tasks {
+		for _, arg := range task.dependencies() {
+			if !isTaskReference(arg) || ownTasks[arg[5:]] {
+				continue
+			}
+			if dep, found := GetTask(arg[5:]); found && dep.Completed {
+				completedTasks[dep.ID] = true
+			}
+		}
+	}
+
 	// Filter executable tasks (not completed and all dependencies resolved)
 	var executableTasks []*Task
 	for _, task := range tasks {
@@ -93,10 +195,15 @@ func GetExecutableTasks(exprID, userID string) ([]*Task, error) {
 		}
 
 		// Check if dependencies are resolved
-		arg1Ready := !isTaskReference(task.Arg1) || isTaskCompleted(task.Arg1[5:], completedTasks)
-		arg2Ready := !isTaskReference(task.Arg2) || isTaskCompleted(task.Arg2[5:], completedTasks)
+		ready := true
+		for _, arg := range task.dependencies() {
+			if isTaskReference(arg) && !isTaskCompleted(arg[5:], completedTasks) {
+				ready = false
+				break
+			}
+		}
 
-		if arg1Ready && arg2Ready {
+		if ready {
 			executableTasks = append(executableTasks, task)
 		}
 	}
@@ -104,64 +211,156 @@ func GetExecutableTasks(exprID, userID string) ([]*Task, error) {
 	return executableTasks, nil
 }
 
-// GetNextExecutableTask returns a task that is ready to be processed
-func GetNextExecutableTask() (*Task, bool) {
+// ClaimNextTask atomically leases a task that is ready to be processed to the
+// agent owner for the given time: the task becomes running and is not handed
+// out again until the lease expires or the agent reports the result
+func ClaimNextTask(owner string, lease time.Duration) (*Task, bool) {
 	db := database.GetDB()
+	now := time.Now()
 
-	// Подзапрос для получения ID задач, у которых есть зависимости от незавершенных задач
+	// выбор и захват задачи — один оператор UPDATE, поэтому два агента не получат одну задачу
 	query := `
-		SELECT 
-			t.id, t.expression_id, t.arg1, t.arg2, t.operator, t.operation_time, 
-			COALESCE(t.result, 0), t.completed 
-		FROM tasks t
-		WHERE t.completed = false
-		AND NOT EXISTS (
-			-- Проверка зависимостей Arg1
-			SELECT 1 FROM tasks t2
-			WHERE t2.completed = false
-			AND CONCAT('task:', t2.id) = t.arg1
-		)
-		AND NOT EXISTS (
-			-- Проверка зависимостей Arg2
-			SELECT 1 FROM tasks t2
-			WHERE t2.completed = false
-			AND CONCAT('task:', t2.id) = t.arg2
+		UPDATE tasks
+		SET lease_owner = ?, lease_expires_at = ?, attempts = attempts + 1, started_at = COALESCE(started_at, ?)
+		WHERE id = (
+			SELECT t.id
+			FROM tasks t
+			WHERE t.completed = false
+			AND t.lease_owner = ''
+			AND (
+				-- задача ветви условия ждет его результата; задачи невыбранной ветви к этому моменту отменены
+				t.guard = '' OR EXISTS (SELECT 1 FROM tasks g WHERE g.id = t.guard AND g.completed = true)
+			)
+			AND NOT EXISTS (
+				-- Проверка зависимостей Arg1
+				SELECT 1 FROM tasks t2
+				WHERE t2.completed = false
+				AND CONCAT('task:', t2.id) = t.arg1
+			)
+			AND NOT EXISTS (
+				-- Проверка зависимостей Arg2
+				SELECT 1 FROM tasks t2
+				WHERE t2.completed = false
+				AND CONCAT('task:', t2.id) = t.arg2
+			)
+			AND NOT EXISTS (
+				-- Проверка зависимостей аргументов функций
+				SELECT 1 FROM json_each(t.args) a
+				JOIN tasks t2 ON CONCAT('task:', t2.id) = a.value
+				WHERE t2.completed = false
+			)
+			ORDER BY t.rowid
+			LIMIT 1
 		)
-		LIMIT 1
-	`
-
-	var task Task
-	err := db.QueryRow(query).Scan(
-		&task.ID, &task.ExpressionID, &task.Arg1, &task.Arg2, &task.Operator, &task.OperationTime,
-		&task.Result, &task.Completed,
-	)
+		RETURNING ` + taskColumns
 
+	task, err := scanTask(db.QueryRow(query, owner, now.Add(lease), now))
 	if err != nil {
 		if err != sql.ErrNoRows {
-			logger.Error("Database error in GetNextExecutableTask: %v", err)
+			logger.Error("Database error in ClaimNextTask: %v", err)
 		}
 		return nil, false
 	}
 
-	return &task, true
+	return task, true
+}
+
+// ExtendLease prolongs the lease of a running task held by owner; it fails if
+// the task is completed or its lease has expired and passed to another agent
+func ExtendLease(taskID, owner string, lease time.Duration) (bool, error) {
+	db := database.GetDB()
+	res, err := db.Exec(
+		"UPDATE tasks SET lease_expires_at = ? WHERE id = ? AND lease_owner = ? AND completed = false",
+		time.Now().Add(lease), taskID, owner,
+	)
+	if err != nil {
+		return false, fmt.Errorf("ExtendLease: %w", err)
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+// GetExpiredLeases returns the unfinished tasks whose agents stopped extending
+// their leases
+func GetExpiredLeases() ([]*Task, error) {
+	db := database.GetDB()
+	rows, err := db.Query(
+		`SELECT `+taskColumns+`
+		FROM tasks
+		WHERE completed = false AND lease_owner != '' AND lease_expires_at < ?
+		ORDER BY rowid`,
+		time.Now(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("GetExpiredLeases: %w", err)
+	}
+	defer rows.Close()
+
+	var tasks []*Task
+	for rows.Next() {
+		task, err := scanTask(rows)
+		if err != nil {
+			return nil, fmt.Errorf("GetExpiredLeases: %w", err)
+		}
+		tasks = append(tasks, task)
+	}
+	return tasks, rows.Err()
+}
+
+// GetLeaseOwners returns the agents holding live leases with the number of
+// tasks each of them is computing
+func GetLeaseOwners() (map[string]int, error) {
+	db := database.GetDB()
+	rows, err := db.Query(
+		`SELECT lease_owner, COUNT(*)
+		FROM tasks
+		WHERE completed = false AND lease_owner != '' AND lease_expires_at >= ?
+		GROUP BY lease_owner`,
+		time.Now(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("GetLeaseOwners: %w", err)
+	}
+	defer rows.Close()
+
+	owners := make(map[string]int)
+	for rows.Next() {
+		var owner string
+		var leases int
+		if err := rows.Scan(&owner, &leases); err != nil {
+			return nil, fmt.Errorf("GetLeaseOwners: %w", err)
+		}
+		owners[owner] = leases
+	}
+	return owners, rows.Err()
+}
+
+// RequeueTask returns a task with an expired lease to the queue, unless the
+// agent has extended the lease or completed the task in the meantime
+func RequeueTask(taskID string) (bool, error) {
+	db := database.GetDB()
+	res, err := db.Exec(
+		`UPDATE tasks SET lease_owner = '', lease_expires_at = NULL
+		WHERE id = ? AND completed = false AND lease_expires_at < ?`,
+		taskID, time.Now(),
+	)
+	if err != nil {
+		return false, fmt.Errorf("RequeueTask: %w", err)
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, nil
 }
 
 // GetTask retrieves a task by ID
 func GetTask(taskID string) (*Task, bool) {
 	db := database.GetDB()
 
-	var task Task
-	err := db.QueryRow(
-		`SELECT 
-			id, expression_id, arg1, arg2, operator, operation_time, 
-			COALESCE(result, 0), completed 
+	task, err := scanTask(db.QueryRow(
+		`SELECT `+taskColumns+`
 		FROM tasks 
 		WHERE id = ?`,
 		taskID,
-	).Scan(
-		&task.ID, &task.ExpressionID, &task.Arg1, &task.Arg2, &task.Operator, &task.OperationTime,
-		&task.Result, &task.Completed,
-	)
+	))
 
 	if err != nil {
 		if err != sql.ErrNoRows {
@@ -170,23 +369,224 @@ func GetTask(taskID string) (*Task, bool) {
 		return nil, false
 	}
 
-	return &task, true
+	return task, true
 }
 
-// CompleteTask marks a task as completed
-func CompleteTask(taskID string, result float64) error {
+// GetRootTaskID returns the task producing the final result of an expression.
+// Tasks are registered in post-order, so the root is the last one inserted.
+func GetRootTaskID(exprID string) (string, bool) {
 	db := database.GetDB()
-	_, err := db.Exec(
-		"UPDATE tasks SET completed = true, result = ? WHERE id = ?",
-		result, taskID,
-	)
+
+	var taskID string
+	err := db.QueryRow(
+		"SELECT id FROM tasks WHERE expression_id = ? ORDER BY rowid DESC LIMIT 1",
+		exprID,
+	).Scan(&taskID)
+
 	if err != nil {
-		return fmt.Errorf("CompleteTask: %w", err)
+		if err != sql.ErrNoRows {
+			logger.Error("Database error in GetRootTaskID: %v", err)
+		}
+		return "", false
+	}
+
+	return taskID, true
+}
+
+// CompleteTask marks a task leased to owner as completed, exact is the result
+// in the task's numeric mode. It reports false if the task is already completed
+// or leased to another agent: after the lease expired its result belongs to
+// the next owner. If the task is the condition of a conditional, the tasks of
+// the branch not taken are cancelled in the same transaction, before an agent
+// can get them
+func CompleteTask(taskID, owner string, result float64, exact string) (bool, error) {
+	completed := false
+	err := database.Transaction(func(tx *sql.Tx) error {
+		res, err := tx.Exec(
+			`UPDATE tasks SET completed = true, result = ?, result_exact = ?, completed_at = ?
+			WHERE id = ? AND completed = false AND lease_owner = ?`,
+			result, exact, time.Now(), taskID, owner,
+		)
+		if err != nil {
+			return fmt.Errorf("CompleteTask: %w", err)
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			return nil
+		}
+		completed = true
+		return settleGuards(tx, taskID)
+	})
+	return completed, err
+}
+
+// settleGuards cancels the unfinished tasks guarded by the completed task
+// taskID whose branch was not taken, then the tasks guarded by the cancelled
+// ones, and so on down the nested conditionals
+func settleGuards(tx *sql.Tx, taskID string) error {
+	queue := []string{taskID}
+	for len(queue) > 0 {
+		id := queue[0]
+		queue = queue[1:]
+
+		var completed, cancelled bool
+		var exact, message string
+		var result float64
+		err := tx.QueryRow(
+			"SELECT completed, cancelled, COALESCE(result, 0), COALESCE(result_exact, ''), COALESCE(error, '') FROM tasks WHERE id = ?",
+			id,
+		).Scan(&completed, &cancelled, &result, &exact, &message)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("settleGuards: %w", err)
+		}
+		// ошибку условия обрабатывает FailTask
+		if !completed || message != "" {
+			continue
+		}
+
+		value := result != 0
+		if exact != "" {
+			value = mathops.IsTrue(exact)
+		}
+		rows, err := tx.Query(
+			"SELECT id FROM tasks WHERE guard = ? AND completed = false AND (? OR guard_value != ?)",
+			id, cancelled, value,
+		)
+		if err != nil {
+			return fmt.Errorf("settleGuards: %w", err)
+		}
+		var ids []string
+		for rows.Next() {
+			var guarded string
+			if err := rows.Scan(&guarded); err != nil {
+				rows.Close()
+				return fmt.Errorf("settleGuards: %w", err)
+			}
+			ids = append(ids, guarded)
+		}
+		rows.Close()
+
+		now := time.Now()
+		for _, guarded := range ids {
+			if _, err := tx.Exec(
+				"UPDATE tasks SET completed = true, cancelled = true, completed_at = ? WHERE id = ?",
+				now, guarded,
+			); err != nil {
+				return fmt.Errorf("settleGuards: %w", err)
+			}
+		}
+		queue = append(queue, ids...)
 	}
 	return nil
 }
 
+// FailTask records a calculation error of a task leased to owner; like
+// CompleteTask it reports false if the task is completed or leased to another
+// agent. The rest of the expression can't be computed anymore, so its
+// unfinished tasks are closed with the same error and the expression gets the
+// "error" status.
+func FailTask(taskID, owner, message string) (bool, error) {
+	failed := false
+	err := database.Transaction(func(tx *sql.Tx) error {
+		now := time.Now()
+		res, err := tx.Exec(
+			"UPDATE tasks SET completed = true, error = ?, completed_at = ? WHERE id = ? AND completed = false AND lease_owner = ?",
+			message, now, taskID, owner,
+		)
+		if err != nil {
+			return fmt.Errorf("FailTask: %w", err)
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			return nil
+		}
+
+		var exprID string
+		if err := tx.QueryRow("SELECT expression_id FROM tasks WHERE id = ?", taskID).Scan(&exprID); err != nil {
+			return fmt.Errorf("FailTask: %w", err)
+		}
+		if _, err := tx.Exec(
+			"UPDATE tasks SET completed = true, error = ?, completed_at = ? WHERE expression_id = ? AND completed = false",
+			message, now, exprID,
+		); err != nil {
+			return fmt.Errorf("FailTask: %w", err)
+		}
+		if _, err := tx.Exec(
+			"UPDATE expressions SET status = 'error', error = ? WHERE id = ?",
+			message, exprID,
+		); err != nil {
+			return fmt.Errorf("FailTask: %w", err)
+		}
+		failed = true
+		return nil
+	})
+	return failed, err
+}
+
 // Helper functions
+
+// nullTime converts a nullable timestamp column into an optional time
+func nullTime(t sql.NullTime) *time.Time {
+	if !t.Valid {
+		return nil
+	}
+	return &t.Time
+}
+
+// Exact returns the result of the task as a canonical number in its mode;
+// tasks completed before exact results were stored only have the float value
+func (t *Task) Exact() string {
+	if t.ResultExact != "" {
+		return t.ResultExact
+	}
+	return strconv.FormatFloat(t.Result, 'g', -1, 64)
+}
+
+// Operands returns the arguments of the operation in order: the function call
+// arguments, or arg1 and, for binary operators, arg2
+func (t *Task) Operands() []string {
+	if len(t.Args) > 0 {
+		return t.Args
+	}
+	if t.Arg2 == "" {
+		return []string{t.Arg1}
+	}
+	return []string{t.Arg1, t.Arg2}
+}
+
+// dependencies returns every argument of the task, including function call
+// arguments, and the condition guarding it
+func (t *Task) dependencies() []string {
+	deps := append([]string{t.Arg1, t.Arg2}, t.Args...)
+	if t.Guard != "" {
+		deps = append(deps, "task:"+t.Guard)
+	}
+	return deps
+}
+
+// encodeArgs serializes function call arguments into the args column
+func encodeArgs(args []string) string {
+	if len(args) == 0 {
+		return "[]"
+	}
+	data, _ := json.Marshal(args)
+	return string(data)
+}
+
+// decodeArgs parses the args column, an empty list becomes nil
+func decodeArgs(data string) []string {
+	var args []string
+	if err := json.Unmarshal([]byte(data), &args); err != nil {
+		logger.Error("Failed to decode task args %q: %v", data, err)
+		return nil
+	}
+	if len(args) == 0 {
+		return nil
+	}
+	return args
+}
+
 func isTaskReference(arg string) bool {
 	return len(arg) > 5 && arg[:5] == "task:"
 }
@@ -260,14 +660,15 @@ func CountIncompleteTasks(exprID string) (int, error) {
 	return cnt, nil
 }
 
-// UpdateExpressionStatus обновляет status и result в таблице expressions
-func UpdateExpressionStatus(exprID, status string, result float64) error {
+// UpdateExpressionStatus обновляет status и result в таблице expressions,
+// exact — точный результат в режиме выражения (пустой, пока результата нет)
+func UpdateExpressionStatus(exprID, status string, result float64, exact string) error {
 	db := database.GetDB()
 	res, err := db.Exec(
 		`UPDATE expressions
-        SET status = ?, result = ?
+        SET status = ?, result = ?, result_exact = NULLIF(?, '')
         WHERE id = ?`,
-		status, result, exprID,
+		status, result, exact, exprID,
 	)
 	if err != nil {
 		return fmt.Errorf("UpdateExpressionStatus exec: %w", err)
@@ -0,0 +1,281 @@
+package store
+
+import (
+	"calc-service/pkg/database"
+	"calc-service/pkg/logger"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "calc-store-test")
+	if err != nil {
+		panic(err)
+	}
+	os.Setenv("DB_PATH", filepath.Join(dir, "test.db"))
+	logger.Init("fatal")
+	if err := database.InitDB(); err != nil {
+		panic(err)
+	}
+
+	code := m.Run()
+	database.CloseDB()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// resetTasks empties the task queue: ClaimNextTask hands out the tasks of all
+// expressions, so a test must not see the tasks left by another
+func resetTasks(t *testing.T) {
+	t.Helper()
+	if _, err := database.GetDB().Exec("DELETE FROM tasks"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClaimSharedTask(t *testing.T) {
+	resetTasks(t)
+	// (1+2)*(1+2): задача 1+2 общая, корень ссылается на нее дважды
+	sum := &Task{ID: "task-shared-sum", Arg1: "1", Arg2: "2", Operator: "+", Mode: "float"}
+	product := &Task{ID: "task-shared-product", Arg1: "task:" + sum.ID, Arg2: "task:" + sum.ID, Operator: "*", Mode: "float"}
+	if err := RegisterTasks("expr-shared", "user-test", []*Task{sum, product}); err != nil {
+		t.Fatal(err)
+	}
+	lease := time.Minute
+
+	claimed, ok := ClaimNextTask("agent-1", lease)
+	if !ok || claimed.ID != sum.ID {
+		t.Fatalf("got %v, want the shared task %s", claimed, sum.ID)
+	}
+	if claimed.Status() != TaskRunning || claimed.Attempts != 1 {
+		t.Errorf("got status %s after %d attempts, want running after 1", claimed.Status(), claimed.Attempts)
+	}
+	// общая задача выдана, а корень ждет ее результата
+	if task, ok := ClaimNextTask("agent-2", lease); ok {
+		t.Fatalf("claimed %s while the shared task is running", task.ID)
+	}
+
+	if ok, err := CompleteTask(sum.ID, "agent-1", 3, "3"); err != nil || !ok {
+		t.Fatalf("shared task was not completed: %v", err)
+	}
+	executable, err := GetExecutableTasks("expr-shared", "user-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(executable) != 1 || executable[0].ID != product.ID {
+		t.Fatalf("got %d executable tasks, want only %s", len(executable), product.ID)
+	}
+
+	claimed, ok = ClaimNextTask("agent-2", lease)
+	if !ok || claimed.ID != product.ID {
+		t.Fatalf("got %v, want %s", claimed, product.ID)
+	}
+	if task, ok := ClaimNextTask("agent-3", lease); ok {
+		t.Fatalf("claimed %s twice", task.ID)
+	}
+
+	if ok, err := CompleteTask(product.ID, "agent-2", 9, "9"); err != nil || !ok {
+		t.Fatalf("root task was not completed: %v", err)
+	}
+	remaining, err := CountIncompleteTasks("expr-shared")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if remaining != 0 {
+		t.Errorf("got %d incomplete tasks, want 0", remaining)
+	}
+	if task, ok := ClaimNextTask("agent-3", lease); ok {
+		t.Errorf("claimed completed task %s", task.ID)
+	}
+	if task, _ := GetTask(sum.ID); task.Attempts != 1 || task.ResultExact != "3" {
+		t.Errorf("shared task was claimed %d times with result %s, want once with 3", task.Attempts, task.ResultExact)
+	}
+}
+
+func TestCompleteTaskSettlesGuards(t *testing.T) {
+	resetTasks(t)
+	// if(c, if(d, 1*2, 3*3), 4*4): ветви ждут своих условий
+	cond := &Task{ID: "task-guard-cond", Arg1: "1", Arg2: "2", Operator: "<", Mode: "float"}
+	inner := &Task{ID: "task-guard-inner", Arg1: "3", Arg2: "4", Operator: "<", Mode: "float", Guard: cond.ID, GuardValue: true}
+	innerThen := &Task{ID: "task-guard-inner-then", Arg1: "1", Arg2: "2", Operator: "*", Mode: "float", Guard: inner.ID, GuardValue: true}
+	innerElse := &Task{ID: "task-guard-inner-else", Arg1: "3", Arg2: "3", Operator: "*", Mode: "float", Guard: inner.ID, GuardValue: false}
+	outerElse := &Task{ID: "task-guard-else", Arg1: "4", Arg2: "4", Operator: "*", Mode: "float", Guard: cond.ID, GuardValue: false}
+	if err := RegisterTasks("expr-guards", "user-test", []*Task{cond, inner, innerThen, innerElse, outerElse}); err != nil {
+		t.Fatal(err)
+	}
+
+	// ложное условие отменяет ветвь «истина» целиком, вместе с вложенным условием
+	if claimed, ok := ClaimNextTask("agent-1", time.Minute); !ok || claimed.ID != cond.ID {
+		t.Fatalf("got %v, want the condition %s", claimed, cond.ID)
+	}
+	if ok, err := CompleteTask(cond.ID, "agent-1", 0, "0"); err != nil || !ok {
+		t.Fatalf("condition was not completed: %v", err)
+	}
+	for _, task := range []*Task{inner, innerThen, innerElse, outerElse} {
+		got, _ := GetTask(task.ID)
+		want := TaskCancelled
+		if task == outerElse {
+			want = TaskPending
+		}
+		if got.Status() != want {
+			t.Errorf("%s: got %s, want %s", task.ID, got.Status(), want)
+		}
+	}
+}
+
+func TestClaimNextTaskExclusive(t *testing.T) {
+	resetTasks(t)
+	var tasks []*Task
+	for i := range 50 {
+		tasks = append(tasks, &Task{ID: fmt.Sprintf("task-claim-%d", i), Arg1: "1", Arg2: "2", Operator: "+", Mode: "float"})
+	}
+	if err := RegisterTasks("expr-claim", "user-test", tasks); err != nil {
+		t.Fatal(err)
+	}
+
+	// два агента разбирают очередь одновременно
+	var mu sync.Mutex
+	owners := make(map[string]string)
+	var wg sync.WaitGroup
+	for _, owner := range []string{"agent-1", "agent-2"} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				task, ok := ClaimNextTask(owner, time.Minute)
+				if !ok {
+					return
+				}
+				mu.Lock()
+				if other, claimed := owners[task.ID]; claimed {
+					t.Errorf("%s claimed by %s and %s", task.ID, other, owner)
+				}
+				owners[task.ID] = owner
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if len(owners) != len(tasks) {
+		t.Fatalf("claimed %d tasks, want %d", len(owners), len(tasks))
+	}
+	for _, task := range tasks {
+		got, _ := GetTask(task.ID)
+		if got.LeaseOwner != owners[task.ID] || got.Attempts != 1 {
+			t.Errorf("%s: leased to %s after %d attempts, want %s after 1", task.ID, got.LeaseOwner, got.Attempts, owners[task.ID])
+		}
+	}
+}
+
+func TestExtendLease(t *testing.T) {
+	resetTasks(t)
+	task := &Task{ID: "task-extend", Arg1: "1", Arg2: "2", Operator: "+", Mode: "float"}
+	if err := RegisterTasks("expr-extend", "user-test", []*Task{task}); err != nil {
+		t.Fatal(err)
+	}
+	claimed, ok := ClaimNextTask("agent-1", time.Second)
+	if !ok {
+		t.Fatal("no task to claim")
+	}
+
+	if extended, err := ExtendLease(task.ID, "agent-1", time.Hour); err != nil || !extended {
+		t.Fatalf("owner could not extend the lease: %v", err)
+	}
+	got, _ := GetTask(task.ID)
+	if !got.LeaseExpiresAt.After(claimed.LeaseExpiresAt.Add(time.Minute)) {
+		t.Errorf("lease expires at %v, want about an hour from now", got.LeaseExpiresAt)
+	}
+
+	// продлить аренду может только ее владелец и только до завершения задачи
+	if extended, _ := ExtendLease(task.ID, "agent-2", time.Hour); extended {
+		t.Error("another agent extended the lease")
+	}
+	if ok, err := CompleteTask(task.ID, "agent-1", 3, "3"); err != nil || !ok {
+		t.Fatalf("task was not completed: %v", err)
+	}
+	if extended, _ := ExtendLease(task.ID, "agent-1", time.Hour); extended {
+		t.Error("the lease of a completed task was extended")
+	}
+}
+
+func TestCompleteTaskOwner(t *testing.T) {
+	resetTasks(t)
+	task := &Task{ID: "task-owner", Arg1: "1", Arg2: "2", Operator: "+", Mode: "float"}
+	other := &Task{ID: "task-owner-other", Arg1: "3", Arg2: "4", Operator: "+", Mode: "float"}
+	if err := RegisterTasks("expr-owner", "user-test", []*Task{task, other}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := ClaimNextTask("agent-1", time.Minute); !ok {
+		t.Fatal("no task to claim")
+	}
+
+	// результат или ошибку присылает только владелец аренды
+	if ok, err := CompleteTask(task.ID, "agent-2", 4, "4"); err != nil || ok {
+		t.Fatalf("another agent completed the task: %v", err)
+	}
+	if ok, err := FailTask(task.ID, "agent-2", "boom"); err != nil || ok {
+		t.Fatalf("another agent failed the task: %v", err)
+	}
+	if ok, err := CompleteTask(task.ID, "agent-1", 3, "3"); err != nil || !ok {
+		t.Fatalf("owner could not complete the task: %v", err)
+	}
+	// поздний повтор не перезаписывает результат
+	if ok, _ := CompleteTask(task.ID, "agent-1", 5, "5"); ok {
+		t.Error("completed task was completed again")
+	}
+	if ok, _ := FailTask(task.ID, "agent-1", "boom"); ok {
+		t.Error("completed task was failed")
+	}
+	if got, _ := GetTask(task.ID); got.Status() != TaskCompleted || got.ResultExact != "3" {
+		t.Errorf("got status %s with result %s, want completed with 3", got.Status(), got.ResultExact)
+	}
+
+	// задача, которую еще никто не получил, тоже не принимает чужих результатов
+	if ok, _ := CompleteTask(other.ID, "agent-1", 7, "7"); ok {
+		t.Error("a task that was not handed out was completed")
+	}
+}
+
+func TestRequeueExpiredLease(t *testing.T) {
+	resetTasks(t)
+	task := &Task{ID: "task-expired", Arg1: "1", Arg2: "2", Operator: "+", Mode: "float"}
+	if err := RegisterTasks("expr-expired", "user-test", []*Task{task}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := ClaimNextTask("agent-1", time.Millisecond); !ok {
+		t.Fatal("no task to claim")
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	expired, err := GetExpiredLeases()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(expired) != 1 || expired[0].ID != task.ID || expired[0].LeaseOwner != "agent-1" {
+		t.Fatalf("got %d expired leases, want the lease of %s", len(expired), task.ID)
+	}
+	if requeued, err := RequeueTask(task.ID); err != nil || !requeued {
+		t.Fatalf("task was not requeued: %v", err)
+	}
+	if expired, _ := GetExpiredLeases(); len(expired) != 0 {
+		t.Errorf("got %d expired leases after requeue, want 0", len(expired))
+	}
+
+	// вернувшуюся в очередь задачу получает другой агент, а прежний теряет аренду
+	claimed, ok := ClaimNextTask("agent-2", time.Minute)
+	if !ok || claimed.ID != task.ID || claimed.Attempts != 2 {
+		t.Fatalf("got %v, want %s on the second attempt", claimed, task.ID)
+	}
+	if extended, _ := ExtendLease(task.ID, "agent-1", time.Minute); extended {
+		t.Error("the agent extended a lease it had lost")
+	}
+	// живую аренду не отбирают
+	if requeued, _ := RequeueTask(task.ID); requeued {
+		t.Error("a task with a live lease was requeued")
+	}
+}
@@ -0,0 +1,125 @@
+package store
+
+import (
+	"calc-service/pkg/database"
+	"calc-service/pkg/logger"
+	"calc-service/pkg/mathops"
+	"database/sql"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// Variable представляет именованное значение пользователя
+type Variable struct {
+	Name       string    `json:"name"`
+	Value      float64   `json:"value"`
+	ValueExact string    `json:"value_exact,omitempty"` // точное значение, каноническая десятичная запись
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+// Exact returns the exact value of the variable; variables saved before exact
+// values were stored fall back to the float value
+func (v *Variable) Exact() string {
+	if v.ValueExact != "" {
+		return v.ValueExact
+	}
+	return strconv.FormatFloat(v.Value, 'g', -1, 64)
+}
+
+// variableColumns is the column list matching scanVariable
+const variableColumns = "name, value, COALESCE(value_exact, ''), created_at, updated_at"
+
+// scanVariable reads a variable selected with variableColumns
+func scanVariable(row rowScanner) (*Variable, error) {
+	var variable Variable
+	if err := row.Scan(&variable.Name, &variable.Value, &variable.ValueExact, &variable.CreatedAt, &variable.UpdatedAt); err != nil {
+		return nil, err
+	}
+	return &variable, nil
+}
+
+// SetVariable создает переменную или обновляет значение существующей; value —
+// каноническая десятичная запись, ее точность не теряется при хранении
+func SetVariable(userID, name, value string) (*Variable, error) {
+	now := time.Now()
+
+	db := database.GetDB()
+	_, err := db.Exec(
+		`INSERT INTO variables (user_id, name, value, value_exact, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT (user_id, name) DO UPDATE SET value = excluded.value, value_exact = excluded.value_exact, updated_at = excluded.updated_at`,
+		userID, name, mathops.ToFloat(value), value, now, now,
+	)
+	if err != nil {
+		logger.Error("Failed to save variable %s: %v", name, err)
+		return nil, fmt.Errorf("failed to save variable: %w", err)
+	}
+
+	variable, found := GetVariable(userID, name)
+	if !found {
+		return nil, fmt.Errorf("variable %s not found after save", name)
+	}
+	return variable, nil
+}
+
+// GetVariable получает переменную пользователя по имени
+func GetVariable(userID, name string) (*Variable, bool) {
+	db := database.GetDB()
+
+	variable, err := scanVariable(db.QueryRow(
+		"SELECT "+variableColumns+" FROM variables WHERE user_id = ? AND name = ?",
+		userID, name,
+	))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, false
+		}
+		logger.Error("Database error in GetVariable: %v", err)
+		return nil, false
+	}
+
+	return variable, true
+}
+
+// ListVariables возвращает все переменные пользователя
+func ListVariables(userID string) ([]*Variable, error) {
+	db := database.GetDB()
+	rows, err := db.Query(
+		"SELECT "+variableColumns+" FROM variables WHERE user_id = ? ORDER BY name",
+		userID,
+	)
+	if err != nil {
+		logger.Error("Database error in ListVariables: %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var variables []*Variable
+	for rows.Next() {
+		variable, err := scanVariable(rows)
+		if err != nil {
+			logger.Error("Error scanning variable row: %v", err)
+			continue
+		}
+		variables = append(variables, variable)
+	}
+
+	return variables, nil
+}
+
+// DeleteVariable удаляет переменную, возвращает false, если ее не было
+func DeleteVariable(userID, name string) (bool, error) {
+	db := database.GetDB()
+	res, err := db.Exec(
+		"DELETE FROM variables WHERE user_id = ? AND name = ?",
+		userID, name,
+	)
+	if err != nil {
+		logger.Error("Failed to delete variable: %v", err)
+		return false, fmt.Errorf("failed to delete variable: %w", err)
+	}
+
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
@@ -0,0 +1,50 @@
+package store
+
+import (
+	"calc-service/pkg/database"
+	"testing"
+	"time"
+)
+
+func TestSetVariableExact(t *testing.T) {
+	tests := []struct {
+		value string
+		float float64
+	}{
+		{"0.1", 0.1},
+		// точность значения не ограничена float64
+		{"12345678901234567891", 12345678901234567891},
+		{"0.30000000000000000001", 0.3},
+	}
+
+	for _, tt := range tests {
+		if _, err := SetVariable("user-variables", "x", tt.value); err != nil {
+			t.Fatal(err)
+		}
+		v, found := GetVariable("user-variables", "x")
+		if !found {
+			t.Fatalf("%s: variable not found", tt.value)
+		}
+		if v.Exact() != tt.value || v.Value != tt.float {
+			t.Errorf("got %s (%g), want %s (%g)", v.Exact(), v.Value, tt.value, tt.float)
+		}
+	}
+}
+
+func TestVariableWithoutExactValue(t *testing.T) {
+	// переменные, сохраненные до появления value_exact, отдают значение REAL
+	now := time.Now()
+	if _, err := database.GetDB().Exec(
+		"INSERT INTO variables (user_id, name, value, created_at, updated_at) VALUES (?, ?, ?, ?, ?)",
+		"user-variables-old", "rate", 0.07, now, now,
+	); err != nil {
+		t.Fatal(err)
+	}
+	list, err := ListVariables("user-variables-old")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].Exact() != "0.07" {
+		t.Fatalf("got %v, want rate = 0.07", list)
+	}
+}
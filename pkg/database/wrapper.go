@@ -81,6 +81,40 @@ func createTables() error {
 		return err
 	}
 
+	// User-scoped variables referenced by name in expressions
+	_, err = db.Exec(`
+        CREATE TABLE IF NOT EXISTS variables (
+            user_id TEXT NOT NULL,
+            name TEXT NOT NULL,
+            value REAL NOT NULL,
+            value_exact TEXT,
+            created_at TIMESTAMP NOT NULL,
+            updated_at TIMESTAMP NOT NULL,
+            PRIMARY KEY (user_id, name),
+            FOREIGN KEY (user_id) REFERENCES users(id)
+        )
+    `)
+	if err != nil {
+		return err
+	}
+
+	// User-defined functions inlined into expressions that call them
+	_, err = db.Exec(`
+        CREATE TABLE IF NOT EXISTS functions (
+            user_id TEXT NOT NULL,
+            name TEXT NOT NULL,
+            params TEXT NOT NULL,
+            body TEXT NOT NULL,
+            created_at TIMESTAMP NOT NULL,
+            updated_at TIMESTAMP NOT NULL,
+            PRIMARY KEY (user_id, name),
+            FOREIGN KEY (user_id) REFERENCES users(id)
+        )
+    `)
+	if err != nil {
+		return err
+	}
+
 	// Updated expressions table with user_id
 	_, err = db.Exec(`
         CREATE TABLE IF NOT EXISTS expressions (
@@ -89,7 +123,14 @@ func createTables() error {
             expression TEXT NOT NULL,
             status TEXT NOT NULL,
             result REAL,
+            mode TEXT NOT NULL DEFAULT 'float',
+            result_exact TEXT,
+            error TEXT,
             created_at TIMESTAMP NOT NULL,
+            depth INTEGER NOT NULL DEFAULT 0,
+            optimized_depth INTEGER NOT NULL DEFAULT 0,
+            bindings TEXT NOT NULL DEFAULT '[]',
+            matrix TEXT,
             FOREIGN KEY (user_id) REFERENCES users(id)
         )
     `)
@@ -109,11 +150,117 @@ func createTables() error {
 				operation_time INTEGER NOT NULL,
 				result REAL,
 				completed BOOLEAN NOT NULL DEFAULT FALSE,
+				args TEXT NOT NULL DEFAULT '[]',
+				mode TEXT NOT NULL DEFAULT 'float',
+				result_exact TEXT,
+				error TEXT,
+				created_at TIMESTAMP,
+				started_at TIMESTAMP,
+				completed_at TIMESTAMP,
+				cancelled BOOLEAN NOT NULL DEFAULT FALSE,
+				guard TEXT NOT NULL DEFAULT '',
+				guard_value BOOLEAN NOT NULL DEFAULT FALSE,
+				lease_owner TEXT NOT NULL DEFAULT '',
+				lease_expires_at TIMESTAMP,
+				attempts INTEGER NOT NULL DEFAULT 0,
 				FOREIGN KEY (expression_id) REFERENCES expressions(id),
 				FOREIGN KEY (user_id)       REFERENCES users(id)
 			)
     `)
-	return err
+	if err != nil {
+		return err
+	}
+
+	// Results of operations shared between expressions (CACHE_PERSIST=true)
+	_, err = db.Exec(`
+        CREATE TABLE IF NOT EXISTS result_cache (
+            key TEXT PRIMARY KEY,
+            result TEXT NOT NULL,
+            used_at TIMESTAMP NOT NULL
+        )
+    `)
+	if err != nil {
+		return err
+	}
+
+	return migrateTables()
+}
+
+// columnMigrations lists columns introduced after the initial schema,
+// so that databases created by older versions keep working
+var columnMigrations = []struct {
+	table      string
+	column     string
+	definition string
+}{
+	{"tasks", "args", "TEXT NOT NULL DEFAULT '[]'"}, // аргументы вызовов функций (JSON-массив)
+	{"tasks", "mode", "TEXT NOT NULL DEFAULT 'float'"},
+	{"tasks", "result_exact", "TEXT"}, // точный результат в виде строки
+	{"expressions", "mode", "TEXT NOT NULL DEFAULT 'float'"},
+	{"expressions", "result_exact", "TEXT"},
+	{"tasks", "error", "TEXT"}, // ошибка вычисления (переполнение, деление на ноль)
+	{"expressions", "error", "TEXT"},
+	{"tasks", "created_at", "TIMESTAMP"}, // время регистрации, выдачи агенту и завершения задачи
+	{"tasks", "started_at", "TIMESTAMP"},
+	{"tasks", "completed_at", "TIMESTAMP"},
+	{"expressions", "depth", "INTEGER NOT NULL DEFAULT 0"}, // глубина дерева до и после оптимизаций
+	{"expressions", "optimized_depth", "INTEGER NOT NULL DEFAULT 0"},
+	{"expressions", "bindings", "TEXT NOT NULL DEFAULT '[]'"}, // привязки сценария (JSON-массив)
+	{"tasks", "cancelled", "BOOLEAN NOT NULL DEFAULT FALSE"},  // задача невыбранной ветви условия
+	{"tasks", "guard", "TEXT NOT NULL DEFAULT ''"},            // задача-условие ветви и ее значение
+	{"tasks", "guard_value", "BOOLEAN NOT NULL DEFAULT FALSE"},
+	{"expressions", "matrix", "TEXT"},                    // результат-вектор или матрица (JSON)
+	{"tasks", "lease_owner", "TEXT NOT NULL DEFAULT ''"}, // агент, которому выдана задача, и срок аренды
+	{"tasks", "lease_expires_at", "TIMESTAMP"},
+	{"tasks", "attempts", "INTEGER NOT NULL DEFAULT 0"}, // число выдач задачи
+	{"variables", "value_exact", "TEXT"},                // точное значение переменной
+}
+
+// migrateTables adds missing columns to existing databases
+func migrateTables() error {
+	for _, m := range columnMigrations {
+		if err := addColumnIfMissing(m.table, m.column, m.definition); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addColumnIfMissing adds a column to the table unless it already exists
+func addColumnIfMissing(table, column, definition string) error {
+	rows, err := db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			cid        int
+			name       string
+			colType    string
+			notNull    bool
+			defaultVal sql.NullString
+			primaryKey int
+		)
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &defaultVal, &primaryKey); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	_, err = db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	if err != nil {
+		return fmt.Errorf("failed to add column %s.%s: %w", table, column, err)
+	}
+	log.Printf("Added column %s.%s", table, column)
+	return nil
 }
 
 // Transaction executes a function within a database transaction
@@ -0,0 +1,105 @@
+package mathops
+
+import (
+	"fmt"
+	"math/big"
+	"slices"
+)
+
+// IsAggregate reports whether name is an aggregate function over any number of
+// values: sum, product, avg or median. Orchestrator splits them into reductions
+func IsAggregate(name string) bool {
+	switch name {
+	case "sum", "product", "avg", "median":
+		return true
+	}
+	return false
+}
+
+// IsFinalizer reports whether op finishes an aggregate: the internal "mean"
+// (sum, count) of avg and median. The orchestrator computes them itself once
+// the values are known instead of sending them to agents
+func IsFinalizer(op string) bool {
+	return op == "mean" || op == "median"
+}
+
+func sumFloat(a []float64) float64 {
+	res := 0.0
+	for _, v := range a {
+		res += v
+	}
+	return res
+}
+
+func medianFloat(a []float64) float64 {
+	sorted := slices.Sorted(slices.Values(a))
+	mid := len(sorted) / 2
+	if len(sorted)%2 == 1 {
+		return sorted[mid]
+	}
+	return (sorted[mid-1] + sorted[mid]) / 2
+}
+
+// applyAggregate evaluates an aggregate function over exact rationals
+func applyAggregate(op string, args []*big.Rat) (*big.Rat, error) {
+	switch op {
+	case "sum", "avg":
+		res := new(big.Rat)
+		for _, v := range args {
+			res.Add(res, v)
+		}
+		if op == "avg" {
+			res.Quo(res, big.NewRat(int64(len(args)), 1))
+		}
+		return res, nil
+	case "product":
+		res := big.NewRat(1, 1)
+		for _, v := range args {
+			res.Mul(res, v)
+		}
+		return res, nil
+	case "median":
+		sorted := slices.SortedFunc(slices.Values(args), (*big.Rat).Cmp)
+		mid := len(sorted) / 2
+		if len(sorted)%2 == 1 {
+			return new(big.Rat).Set(sorted[mid]), nil
+		}
+		res := new(big.Rat).Add(sorted[mid-1], sorted[mid])
+		return res.Quo(res, big.NewRat(2, 1)), nil
+	default:
+		return nil, fmt.Errorf("unknown aggregate function %s", op)
+	}
+}
+
+// applyMean divides the sum of count values, finishing avg
+func applyMean(sum, count *big.Rat) (*big.Rat, error) {
+	if count.Sign() <= 0 {
+		return nil, fmt.Errorf("average of %s values", FormatDecimal(count))
+	}
+	return new(big.Rat).Quo(sum, count), nil
+}
+
+// integerAggregate evaluates an aggregate function or "mean" in integer mode:
+// the result must be an int64 integer, so e.g. avg(1, 2) is an error
+func integerAggregate(op string, args []*big.Int) (*big.Int, error) {
+	rats := make([]*big.Rat, len(args))
+	for i, v := range args {
+		rats[i] = new(big.Rat).SetInt(v)
+	}
+
+	var res *big.Rat
+	var err error
+	if op == "mean" {
+		op = "avg"
+		res, err = applyMean(rats[0], rats[1])
+	} else {
+		res, err = applyAggregate(op, rats)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !res.IsInt() {
+		return nil, fmt.Errorf("%s is not an integer: %s", op, res.RatString())
+	}
+	return checkInt64(op, res.Num())
+}
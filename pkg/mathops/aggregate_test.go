@@ -0,0 +1,54 @@
+package mathops
+
+import "testing"
+
+func TestEvaluateAggregate(t *testing.T) {
+	tests := []struct {
+		mode string
+		op   string
+		args []string
+		want string
+	}{
+		{ModeFloat, "mean", []string{"6", "4"}, "1.5"},
+		{ModeFloat, "median", []string{"3", "1", "2"}, "2"},
+		{ModeFloat, "median", []string{"4", "1", "3", "2"}, "2.5"},
+		{ModeDecimal, "mean", []string{"1", "3"}, "1/3"},
+		{ModeDecimal, "median", []string{"0.1", "0.2"}, "0.15"},
+		{ModeDecimal, "sum", []string{"0.1", "0.2", "0.3"}, "0.6"},
+		{ModeInteger, "mean", []string{"9", "3"}, "3"},
+		{ModeInteger, "median", []string{"5", "-1", "3"}, "3"},
+		{ModeInteger, "product", []string{"2", "3", "4"}, "24"},
+	}
+
+	for _, tt := range tests {
+		got, err := Evaluate(tt.mode, tt.op, tt.args...)
+		if err != nil {
+			t.Errorf("%s %s %v: %v", tt.mode, tt.op, tt.args, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s %s %v: got %s, want %s", tt.mode, tt.op, tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestEvaluateAggregateErrors(t *testing.T) {
+	tests := []struct {
+		mode string
+		op   string
+		args []string
+	}{
+		// в целочисленном режиме среднее и медиана должны быть целыми
+		{ModeInteger, "mean", []string{"1", "2"}},
+		{ModeInteger, "median", []string{"1", "2"}},
+		{ModeInteger, "product", []string{"4294967296", "4294967296"}},
+		{ModeFloat, "mean", []string{"1", "0"}},
+		{ModeDecimal, "mean", []string{"1", "0"}},
+	}
+
+	for _, tt := range tests {
+		if got, err := Evaluate(tt.mode, tt.op, tt.args...); err == nil {
+			t.Errorf("%s %s %v: got %s, want an error", tt.mode, tt.op, tt.args, got)
+		}
+	}
+}
@@ -0,0 +1,218 @@
+package mathops
+
+import (
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+)
+
+// DecimalPrecision is the number of significant digits kept when a decimal
+// operation has no exact rational result (sqrt, log, sin, cos, fractional powers)
+const DecimalPrecision = 34
+
+// maxPowerBits limits the size of exact powers so that 10^1000000 can't exhaust memory
+const maxPowerBits = 1 << 16
+
+// ParseDecimal parses a canonical number ("0.1", "-3", "1/3") into an exact rational
+func ParseDecimal(s string) (*big.Rat, error) {
+	r, ok := new(big.Rat).SetString(s)
+	if !ok {
+		return nil, fmt.Errorf("invalid decimal number: %s", s)
+	}
+	return r, nil
+}
+
+// FormatDecimal renders a rational exactly: as a finite decimal fraction when
+// possible ("0.3"), otherwise as a reduced fraction ("1/3")
+func FormatDecimal(r *big.Rat) string {
+	if r.IsInt() {
+		return r.Num().String()
+	}
+
+	// знаменатель вида 2^a * 5^b дает конечную десятичную дробь из max(a, b) знаков
+	den := new(big.Int).Set(r.Denom())
+	digits := 0
+	for _, p := range []int64{2, 5} {
+		prime := big.NewInt(p)
+		count := 0
+		mod := new(big.Int)
+		for {
+			q, m := new(big.Int).QuoRem(den, prime, mod)
+			if m.Sign() != 0 {
+				break
+			}
+			den = q
+			count++
+		}
+		if count > digits {
+			digits = count
+		}
+	}
+	if den.Cmp(big.NewInt(1)) != 0 {
+		return r.RatString()
+	}
+	return r.FloatString(digits)
+}
+
+// roundedDecimal converts an approximate float result into a rational
+func roundedDecimal(v float64) (*big.Rat, error) {
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return nil, fmt.Errorf("result is not a finite number")
+	}
+	return ParseDecimal(strconv.FormatFloat(v, 'g', -1, 64))
+}
+
+// floorRat returns the largest integer not greater than r
+func floorRat(r *big.Rat) *big.Int {
+	// знаменатель всегда положителен, поэтому евклидово деление совпадает с округлением вниз
+	return new(big.Int).Div(r.Num(), r.Denom())
+}
+
+// roundRat rounds half away from zero, like math.Round
+func roundRat(r *big.Rat) *big.Rat {
+	half := big.NewRat(1, 2)
+	abs := new(big.Rat).Abs(r)
+	res := new(big.Rat).SetInt(floorRat(abs.Add(abs, half)))
+	if r.Sign() < 0 {
+		res.Neg(res)
+	}
+	return res
+}
+
+// powRat raises base to an integer exponent exactly
+func powRat(base *big.Rat, exp *big.Int) (*big.Rat, error) {
+	if base.Sign() == 0 && exp.Sign() < 0 {
+		return nil, fmt.Errorf("invalid power 0^%s", exp)
+	}
+	// примерное число бит в результате на единицу показателя; у 0, 1 и -1 оно нулевое
+	size := int64(base.Num().BitLen() + base.Denom().BitLen() - 2)
+	if size > 0 && (!exp.IsInt64() || new(big.Int).Abs(exp).Int64() > maxPowerBits/size) {
+		return nil, fmt.Errorf("power result is too large")
+	}
+
+	n := new(big.Int).Abs(exp)
+	num := new(big.Int).Exp(base.Num(), n, nil)
+	den := new(big.Int).Exp(base.Denom(), n, nil)
+	if exp.Sign() < 0 {
+		num, den = den, num
+	}
+	return new(big.Rat).SetFrac(num, den), nil
+}
+
+// sqrtRat computes the square root rounded to DecimalPrecision significant digits
+func sqrtRat(r *big.Rat) (*big.Rat, error) {
+	if r.Sign() < 0 {
+		return nil, fmt.Errorf("sqrt of negative number %s", FormatDecimal(r))
+	}
+	f := new(big.Float).SetPrec(256).SetRat(r)
+	f.Sqrt(f)
+	return ParseDecimal(f.Text('g', DecimalPrecision))
+}
+
+// applyDecimal evaluates an operator or a built-in function over exact rationals.
+// Only functions without a rational result fall back to float64 arithmetic.
+func applyDecimal(op string, args []*big.Rat) (*big.Rat, error) {
+	if IsFunction(op) {
+		if err := CheckArity(op, len(args)); err != nil {
+			return nil, err
+		}
+		switch op {
+		case "sqrt":
+			return sqrtRat(args[0])
+		case "abs":
+			return new(big.Rat).Abs(args[0]), nil
+		case "min", "max":
+			res := args[0]
+			for _, v := range args[1:] {
+				if (op == "min" && v.Cmp(res) < 0) || (op == "max" && v.Cmp(res) > 0) {
+					res = v
+				}
+			}
+			return new(big.Rat).Set(res), nil
+		case "round":
+			if len(args) == 1 {
+				return roundRat(args[0]), nil
+			}
+			if !args[1].IsInt() {
+				return nil, fmt.Errorf("round precision must be an integer, got %s", FormatDecimal(args[1]))
+			}
+			scale, err := powRat(big.NewRat(10, 1), args[1].Num())
+			if err != nil {
+				return nil, err
+			}
+			res := roundRat(new(big.Rat).Mul(args[0], scale))
+			return res.Quo(res, scale), nil
+		case "sum", "product", "avg", "median":
+			return applyAggregate(op, args)
+		default:
+			// log, sin, cos — иррациональные результаты считаем во float64
+			return applyApproximate(op, args)
+		}
+	}
+
+	if op == "neg" {
+		if len(args) != 1 {
+			return nil, fmt.Errorf("operator %s expects 1 argument, got %d", op, len(args))
+		}
+		return new(big.Rat).Neg(args[0]), nil
+	}
+
+	if len(args) != 2 {
+		return nil, fmt.Errorf("operator %s expects 2 arguments, got %d", op, len(args))
+	}
+	a, b := args[0], args[1]
+	switch op {
+	case "+":
+		return new(big.Rat).Add(a, b), nil
+	case "-":
+		return new(big.Rat).Sub(a, b), nil
+	case "*":
+		return new(big.Rat).Mul(a, b), nil
+	case "/":
+		if b.Sign() == 0 {
+			return nil, fmt.Errorf("division by zero")
+		}
+		return new(big.Rat).Quo(a, b), nil
+	case "//":
+		if b.Sign() == 0 {
+			return nil, fmt.Errorf("division by zero")
+		}
+		return new(big.Rat).SetInt(floorRat(new(big.Rat).Quo(a, b))), nil
+	case "quo":
+		if b.Sign() == 0 {
+			return nil, fmt.Errorf("division by zero")
+		}
+		q := new(big.Rat).Quo(a, b)
+		return new(big.Rat).SetInt(new(big.Int).Quo(q.Num(), q.Denom())), nil
+	case "mean":
+		return applyMean(a, b)
+	case "%":
+		if b.Sign() == 0 {
+			return nil, fmt.Errorf("modulo by zero")
+		}
+		// a - b*floor(a/b): остаток со знаком делителя, как и во float-режиме
+		q := new(big.Rat).SetInt(floorRat(new(big.Rat).Quo(a, b)))
+		return new(big.Rat).Sub(a, q.Mul(q, b)), nil
+	case "^":
+		if b.IsInt() {
+			return powRat(a, b.Num())
+		}
+		return applyApproximate(op, args)
+	default:
+		return nil, fmt.Errorf("unknown operator: %s", op)
+	}
+}
+
+// applyApproximate evaluates op in float64 and converts the result back to a rational
+func applyApproximate(op string, args []*big.Rat) (*big.Rat, error) {
+	vals := make([]float64, len(args))
+	for i, a := range args {
+		vals[i], _ = a.Float64()
+	}
+	res, err := Apply(op, vals...)
+	if err != nil {
+		return nil, err
+	}
+	return roundedDecimal(res)
+}
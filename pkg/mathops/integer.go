@@ -0,0 +1,162 @@
+package mathops
+
+import (
+	"fmt"
+	"math/big"
+)
+
+// ParseInteger parses a canonical number that must be an int64 integer
+func ParseInteger(s string) (*big.Int, error) {
+	r, ok := new(big.Rat).SetString(s)
+	if !ok {
+		return nil, fmt.Errorf("invalid integer: %s", s)
+	}
+	if !r.IsInt() {
+		return nil, fmt.Errorf("%s is not an integer", s)
+	}
+	if !r.Num().IsInt64() {
+		return nil, fmt.Errorf("integer %s overflows int64", s)
+	}
+	return new(big.Int).Set(r.Num()), nil
+}
+
+// checkInt64 turns a big result into an overflow error when it doesn't fit into int64
+func checkInt64(op string, res *big.Int) (*big.Int, error) {
+	if !res.IsInt64() {
+		return nil, fmt.Errorf("integer overflow in %s", op)
+	}
+	return res, nil
+}
+
+// floorDivInt divides rounding towards negative infinity, like // in the other modes
+func floorDivInt(a, b *big.Int) *big.Int {
+	q, r := new(big.Int).QuoRem(a, b, new(big.Int))
+	if r.Sign() != 0 && (r.Sign() < 0) != (b.Sign() < 0) {
+		q.Sub(q, big.NewInt(1))
+	}
+	return q
+}
+
+// CheckModeSupport reports an error when op has no integer-valued counterpart in the mode
+func CheckModeSupport(mode, op string) error {
+	if mode != ModeInteger {
+		return nil
+	}
+	switch op {
+	case "log", "sin", "cos":
+		return fmt.Errorf("function %s is not supported in integer mode", op)
+	}
+	return nil
+}
+
+// applyInteger evaluates an operator or a built-in function over int64 values.
+// Results are computed exactly and rejected when they overflow int64.
+func applyInteger(op string, args []*big.Int) (*big.Int, error) {
+	if err := CheckModeSupport(ModeInteger, op); err != nil {
+		return nil, err
+	}
+
+	if IsFunction(op) {
+		if err := CheckArity(op, len(args)); err != nil {
+			return nil, err
+		}
+		switch op {
+		case "sqrt":
+			if args[0].Sign() < 0 {
+				return nil, fmt.Errorf("sqrt of negative number %s", args[0])
+			}
+			root := new(big.Int).Sqrt(args[0])
+			if new(big.Int).Mul(root, root).Cmp(args[0]) != 0 {
+				return nil, fmt.Errorf("sqrt(%s) is not an integer", args[0])
+			}
+			return root, nil
+		case "abs":
+			return checkInt64(op, new(big.Int).Abs(args[0]))
+		case "min", "max":
+			res := args[0]
+			for _, v := range args[1:] {
+				if (op == "min" && v.Cmp(res) < 0) || (op == "max" && v.Cmp(res) > 0) {
+					res = v
+				}
+			}
+			return new(big.Int).Set(res), nil
+		case "round":
+			// целое уже округлено; round(x, -n) округляет до 10^n
+			if len(args) == 1 || args[1].Sign() >= 0 {
+				return new(big.Int).Set(args[0]), nil
+			}
+			scale, err := powRat(big.NewRat(10, 1), new(big.Int).Neg(args[1]))
+			if err != nil {
+				return nil, err
+			}
+			res := roundRat(new(big.Rat).Quo(new(big.Rat).SetInt(args[0]), scale))
+			res.Mul(res, scale)
+			return checkInt64(op, res.Num())
+		case "sum", "product", "avg", "median":
+			return integerAggregate(op, args)
+		default:
+			return nil, fmt.Errorf("function %s is not supported in integer mode", op)
+		}
+	}
+
+	if op == "neg" {
+		if len(args) != 1 {
+			return nil, fmt.Errorf("operator %s expects 1 argument, got %d", op, len(args))
+		}
+		return checkInt64(op, new(big.Int).Neg(args[0]))
+	}
+
+	if len(args) != 2 {
+		return nil, fmt.Errorf("operator %s expects 2 arguments, got %d", op, len(args))
+	}
+	a, b := args[0], args[1]
+	switch op {
+	case "+":
+		return checkInt64(op, new(big.Int).Add(a, b))
+	case "-":
+		return checkInt64(op, new(big.Int).Sub(a, b))
+	case "*":
+		return checkInt64(op, new(big.Int).Mul(a, b))
+	case "/":
+		if b.Sign() == 0 {
+			return nil, fmt.Errorf("division by zero")
+		}
+		q, r := new(big.Int).QuoRem(a, b, new(big.Int))
+		if r.Sign() != 0 {
+			return nil, fmt.Errorf("%s / %s is not an integer", a, b)
+		}
+		return checkInt64(op, q)
+	case "quo":
+		if b.Sign() == 0 {
+			return nil, fmt.Errorf("division by zero")
+		}
+		return checkInt64(op, new(big.Int).Quo(a, b))
+	case "mean":
+		return integerAggregate(op, args)
+	case "//":
+		if b.Sign() == 0 {
+			return nil, fmt.Errorf("division by zero")
+		}
+		return checkInt64(op, floorDivInt(a, b))
+	case "%":
+		if b.Sign() == 0 {
+			return nil, fmt.Errorf("modulo by zero")
+		}
+		q := floorDivInt(a, b)
+		return new(big.Int).Sub(a, q.Mul(q, b)), nil
+	case "^":
+		if b.Sign() < 0 {
+			if a.CmpAbs(big.NewInt(1)) != 0 {
+				return nil, fmt.Errorf("%s^%s is not an integer", a, b)
+			}
+			b = new(big.Int).Neg(b)
+		}
+		// |a| >= 2 в степени больше 63 гарантированно переполняет int64
+		if a.CmpAbs(big.NewInt(1)) > 0 && b.Cmp(big.NewInt(63)) > 0 {
+			return nil, fmt.Errorf("integer overflow in %s", op)
+		}
+		return checkInt64(op, new(big.Int).Exp(a, b, nil))
+	default:
+		return nil, fmt.Errorf("unknown operator: %s", op)
+	}
+}
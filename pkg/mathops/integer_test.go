@@ -0,0 +1,72 @@
+package mathops
+
+import "testing"
+
+func TestEvaluateInteger(t *testing.T) {
+	tests := []struct {
+		op   string
+		args []string
+		want string
+	}{
+		{"+", []string{"9223372036854775806", "1"}, "9223372036854775807"},
+		{"-", []string{"-9223372036854775807", "1"}, "-9223372036854775808"},
+		{"*", []string{"-4294967296", "2147483648"}, "-9223372036854775808"},
+		{"/", []string{"12", "-4"}, "-3"},
+		// division=truncate: дробная часть отбрасывается
+		{"quo", []string{"7", "2"}, "3"},
+		{"quo", []string{"-7", "2"}, "-3"},
+		{"//", []string{"-7", "2"}, "-4"},
+		{"%", []string{"-7", "2"}, "1"},
+		{"^", []string{"2", "62"}, "4611686018427387904"},
+		{"^", []string{"-1", "-3"}, "-1"},
+		{"sqrt", []string{"144"}, "12"},
+		{"round", []string{"1250", "-2"}, "1300"},
+		{"min", []string{"3", "-2", "5"}, "-2"},
+	}
+
+	for _, tt := range tests {
+		got, err := Evaluate(ModeInteger, tt.op, tt.args...)
+		if err != nil {
+			t.Errorf("%s %v: %v", tt.op, tt.args, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s %v: got %s, want %s", tt.op, tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestEvaluateIntegerErrors(t *testing.T) {
+	tests := []struct {
+		op   string
+		args []string
+	}{
+		// переполнение int64 у каждого оператора
+		{"+", []string{"9223372036854775807", "1"}},
+		{"-", []string{"-9223372036854775808", "1"}},
+		{"*", []string{"4294967296", "2147483648"}},
+		{"neg", []string{"-9223372036854775808"}},
+		{"abs", []string{"-9223372036854775808"}},
+		{"//", []string{"-9223372036854775808", "-1"}},
+		{"quo", []string{"-9223372036854775808", "-1"}},
+		{"^", []string{"2", "63"}},
+		{"^", []string{"3", "1000"}},
+		// неточное деление и нецелые результаты
+		{"/", []string{"7", "2"}},
+		{"/", []string{"1", "0"}},
+		{"quo", []string{"1", "0"}},
+		{"%", []string{"1", "0"}},
+		{"^", []string{"2", "-1"}},
+		{"sqrt", []string{"2"}},
+		{"log", []string{"8"}},
+		// аргументы должны быть целыми и помещаться в int64
+		{"+", []string{"1.5", "1"}},
+		{"+", []string{"9223372036854775808", "0"}},
+	}
+
+	for _, tt := range tests {
+		if got, err := Evaluate(ModeInteger, tt.op, tt.args...); err == nil {
+			t.Errorf("%s %v: got %s, want an error", tt.op, tt.args, got)
+		}
+	}
+}
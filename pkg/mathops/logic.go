@@ -0,0 +1,134 @@
+package mathops
+
+import (
+	"cmp"
+	"fmt"
+	"math/big"
+	"strconv"
+)
+
+// Results of comparisons and logical operators: 1 — истина, 0 — ложь
+const (
+	True  = "1"
+	False = "0"
+)
+
+// IsTrue reports whether a canonical number counts as true: any number except zero
+func IsTrue(value string) bool {
+	if r, ok := new(big.Rat).SetString(value); ok {
+		return r.Sign() != 0
+	}
+	return ToFloat(value) != 0
+}
+
+// IsComparison reports whether op compares its operands
+func IsComparison(op string) bool {
+	switch op {
+	case "<", "<=", ">", ">=", "==", "!=":
+		return true
+	}
+	return false
+}
+
+// IsLogical reports whether op is a logical operator
+func IsLogical(op string) bool {
+	return op == "&&" || op == "||" || op == "not"
+}
+
+// isConditional reports whether op is evaluated by applyConditional in every mode
+func isConditional(op string) bool {
+	return IsComparison(op) || IsLogical(op) || op == "if"
+}
+
+// applyConditional evaluates comparisons, logical operators and if(cond, a, b)
+// over canonical numbers of the mode; they don't depend on the arithmetic of the mode
+func applyConditional(mode, op string, args []string) (string, error) {
+	values := make([]string, len(args))
+	for i, arg := range args {
+		v, err := Normalize(mode, arg)
+		if err != nil {
+			return "", err
+		}
+		values[i] = v
+	}
+
+	switch {
+	case op == "if":
+		if err := CheckArity(op, len(values)); err != nil {
+			return "", err
+		}
+		if IsTrue(values[0]) {
+			return values[1], nil
+		}
+		return values[2], nil
+	case op == "not":
+		if len(values) != 1 {
+			return "", fmt.Errorf("operator %s expects 1 argument, got %d", op, len(values))
+		}
+		return boolean(!IsTrue(values[0])), nil
+	}
+
+	if len(values) != 2 {
+		return "", fmt.Errorf("operator %s expects 2 arguments, got %d", op, len(values))
+	}
+	a, b := values[0], values[1]
+	switch op {
+	case "&&":
+		return boolean(IsTrue(a) && IsTrue(b)), nil
+	case "||":
+		return boolean(IsTrue(a) || IsTrue(b)), nil
+	}
+
+	c, err := compare(mode, a, b)
+	if err != nil {
+		return "", err
+	}
+	switch op {
+	case "<":
+		return boolean(c < 0), nil
+	case "<=":
+		return boolean(c <= 0), nil
+	case ">":
+		return boolean(c > 0), nil
+	case ">=":
+		return boolean(c >= 0), nil
+	case "==":
+		return boolean(c == 0), nil
+	case "!=":
+		return boolean(c != 0), nil
+	default:
+		return "", fmt.Errorf("unknown operator: %s", op)
+	}
+}
+
+// compare compares two canonical numbers of the mode: exactly in the decimal
+// and integer modes, as float64 in the float mode
+func compare(mode, a, b string) (int, error) {
+	if mode == ModeFloat || mode == "" {
+		x, err := strconv.ParseFloat(a, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid number: %s", a)
+		}
+		y, err := strconv.ParseFloat(b, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid number: %s", b)
+		}
+		return cmp.Compare(x, y), nil
+	}
+	x, err := ParseDecimal(a)
+	if err != nil {
+		return 0, err
+	}
+	y, err := ParseDecimal(b)
+	if err != nil {
+		return 0, err
+	}
+	return x.Cmp(y), nil
+}
+
+func boolean(v bool) string {
+	if v {
+		return True
+	}
+	return False
+}
@@ -0,0 +1,208 @@
+// Package mathops содержит семантику операторов и встроенных функций,
+// общую для оркестратора (локальная свёртка результатов) и агентов.
+package mathops
+
+import (
+	"fmt"
+	"math"
+)
+
+// function describes a built-in function: its arity and implementation
+type function struct {
+	minArgs int
+	maxArgs int // -1 — произвольное число аргументов
+	apply   func(args []float64) (float64, error)
+}
+
+var functions = map[string]function{
+	"sqrt": {1, 1, func(a []float64) (float64, error) {
+		if a[0] < 0 {
+			return 0, fmt.Errorf("sqrt of negative number %g", a[0])
+		}
+		return math.Sqrt(a[0]), nil
+	}},
+	"abs": {1, 1, func(a []float64) (float64, error) {
+		return math.Abs(a[0]), nil
+	}},
+	"min": {1, -1, func(a []float64) (float64, error) {
+		res := a[0]
+		for _, v := range a[1:] {
+			res = math.Min(res, v)
+		}
+		return res, nil
+	}},
+	"max": {1, -1, func(a []float64) (float64, error) {
+		res := a[0]
+		for _, v := range a[1:] {
+			res = math.Max(res, v)
+		}
+		return res, nil
+	}},
+	// log(x) — натуральный логарифм, log(x, base) — логарифм по основанию
+	"log": {1, 2, func(a []float64) (float64, error) {
+		if a[0] <= 0 {
+			return 0, fmt.Errorf("log of non-positive number %g", a[0])
+		}
+		if len(a) == 1 {
+			return math.Log(a[0]), nil
+		}
+		if a[1] <= 0 || a[1] == 1 {
+			return 0, fmt.Errorf("invalid log base %g", a[1])
+		}
+		return math.Log(a[0]) / math.Log(a[1]), nil
+	}},
+	"sin": {1, 1, func(a []float64) (float64, error) {
+		return math.Sin(a[0]), nil
+	}},
+	"cos": {1, 1, func(a []float64) (float64, error) {
+		return math.Cos(a[0]), nil
+	}},
+	// round(x) — до целого, round(x, n) — до n знаков после запятой
+	"round": {1, 2, func(a []float64) (float64, error) {
+		if len(a) == 1 {
+			return math.Round(a[0]), nil
+		}
+		if a[1] != math.Trunc(a[1]) {
+			return 0, fmt.Errorf("round precision must be an integer, got %g", a[1])
+		}
+		scale := math.Pow(10, a[1])
+		if math.IsInf(a[0]*scale, 0) {
+			// у такого большого числа нет знаков после запятой
+			return a[0], nil
+		}
+		return math.Round(a[0]*scale) / scale, nil
+	}},
+	// агрегаты по любому числу значений; оркестратор раскладывает их на задачи "+" и "*"
+	"sum": {1, -1, func(a []float64) (float64, error) {
+		return sumFloat(a), nil
+	}},
+	"product": {1, -1, func(a []float64) (float64, error) {
+		res := 1.0
+		for _, v := range a {
+			res *= v
+		}
+		return res, nil
+	}},
+	"avg": {1, -1, func(a []float64) (float64, error) {
+		return sumFloat(a) / float64(len(a)), nil
+	}},
+	"median": {1, -1, func(a []float64) (float64, error) {
+		return medianFloat(a), nil
+	}},
+	// if(cond, a, b) — a, если cond не ноль, иначе b; оркестратор вычисляет его сам и только выбранную ветвь
+	"if": {3, 3, func(a []float64) (float64, error) {
+		if a[0] != 0 {
+			return a[1], nil
+		}
+		return a[2], nil
+	}},
+}
+
+// IsFunction reports whether name is a built-in function
+func IsFunction(name string) bool {
+	_, ok := functions[name]
+	return ok
+}
+
+// CheckArity validates the number of arguments passed to a built-in function
+func CheckArity(name string, n int) error {
+	fn, ok := functions[name]
+	if !ok {
+		return fmt.Errorf("unknown function %s", name)
+	}
+	if n < fn.minArgs || (fn.maxArgs >= 0 && n > fn.maxArgs) {
+		switch {
+		case fn.maxArgs < 0:
+			return fmt.Errorf("%s expects at least %d argument(s), got %d", name, fn.minArgs, n)
+		case fn.minArgs == fn.maxArgs:
+			return fmt.Errorf("%s expects %d argument(s), got %d", name, fn.minArgs, n)
+		default:
+			return fmt.Errorf("%s expects %d to %d arguments, got %d", name, fn.minArgs, fn.maxArgs, n)
+		}
+	}
+	return nil
+}
+
+// Apply evaluates an operator or a built-in function over resolved arguments.
+// A result that is not a finite number (an overflow like 1e308*10) is an error:
+// the infinity would spread through the expression and can't be stored as a
+// number of any mode
+func Apply(op string, args ...float64) (float64, error) {
+	res, err := apply(op, args...)
+	if err != nil {
+		return 0, err
+	}
+	if math.IsNaN(res) || math.IsInf(res, 0) {
+		return 0, fmt.Errorf("%s: result is not a finite number", op)
+	}
+	return res, nil
+}
+
+func apply(op string, args ...float64) (float64, error) {
+	if fn, ok := functions[op]; ok {
+		if err := CheckArity(op, len(args)); err != nil {
+			return 0, err
+		}
+		return fn.apply(args)
+	}
+
+	if op == "neg" {
+		if len(args) != 1 {
+			return 0, fmt.Errorf("operator %s expects 1 argument, got %d", op, len(args))
+		}
+		return -args[0], nil
+	}
+
+	if len(args) != 2 {
+		return 0, fmt.Errorf("operator %s expects 2 arguments, got %d", op, len(args))
+	}
+	a, b := args[0], args[1]
+	switch op {
+	case "+":
+		return a + b, nil
+	case "-":
+		return a - b, nil
+	case "*":
+		return a * b, nil
+	case "/":
+		if b == 0 {
+			return 0, fmt.Errorf("division by zero")
+		}
+		return a / b, nil
+	case "//":
+		if b == 0 {
+			return 0, fmt.Errorf("division by zero")
+		}
+		return math.Floor(a / b), nil
+	case "quo":
+		// деление с отбрасыванием дробной части (для "/" в целочисленном режиме с division=truncate)
+		if b == 0 {
+			return 0, fmt.Errorf("division by zero")
+		}
+		return math.Trunc(a / b), nil
+	case "mean":
+		// среднее: сумма значений и их число, завершает avg
+		if b <= 0 {
+			return 0, fmt.Errorf("average of %g values", b)
+		}
+		return a / b, nil
+	case "%":
+		if b == 0 {
+			return 0, fmt.Errorf("modulo by zero")
+		}
+		// остаток со знаком делителя, чтобы a == (a//b)*b + a%b
+		r := math.Mod(a, b)
+		if r != 0 && (r < 0) != (b < 0) {
+			r += b
+		}
+		return r, nil
+	case "^":
+		res := math.Pow(a, b)
+		if math.IsNaN(res) || math.IsInf(res, 0) {
+			return 0, fmt.Errorf("invalid power %g^%g", a, b)
+		}
+		return res, nil
+	default:
+		return 0, fmt.Errorf("unknown operator: %s", op)
+	}
+}
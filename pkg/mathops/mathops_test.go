@@ -0,0 +1,34 @@
+package mathops
+
+import "testing"
+
+func TestApplyNonFinite(t *testing.T) {
+	tests := []struct {
+		op   string
+		args []float64
+	}{
+		{"+", []float64{1e308, 1e308}},
+		{"-", []float64{-1e308, 1e308}},
+		{"*", []float64{1e308, 10}},
+		{"/", []float64{1e308, 1e-10}},
+		{"//", []float64{1e308, 1e-10}},
+		{"^", []float64{10, 400}},
+		{"sum", []float64{1e308, 1e308}},
+		{"product", []float64{1e200, 1e200}},
+		{"avg", []float64{1e308, 1e308}},
+	}
+
+	for _, tt := range tests {
+		if res, err := Apply(tt.op, tt.args...); err == nil {
+			t.Errorf("%s%v: got %g, want an error", tt.op, tt.args, res)
+		}
+	}
+}
+
+func TestApplyRoundLarge(t *testing.T) {
+	// x*10^n переполняется, но у такого числа и нет дробной части
+	res, err := Apply("round", 1e308, 10)
+	if err != nil || res != 1e308 {
+		t.Errorf("got %g, %v, want 1e308", res, err)
+	}
+}
@@ -0,0 +1,112 @@
+package mathops
+
+import (
+	"fmt"
+	"math/big"
+	"strconv"
+)
+
+// Numeric modes of an expression
+const (
+	ModeFloat   = "float"
+	ModeDecimal = "decimal"
+	ModeInteger = "integer"
+)
+
+// IsMode reports whether mode is a supported numeric mode
+func IsMode(mode string) bool {
+	return mode == ModeFloat || mode == ModeDecimal || mode == ModeInteger
+}
+
+// Evaluate applies op to arguments given as canonical number strings and
+// returns the canonical string of the result in the given numeric mode
+func Evaluate(mode, op string, args ...string) (string, error) {
+	if isConditional(op) {
+		return applyConditional(mode, op, args)
+	}
+
+	switch mode {
+	case ModeFloat, "":
+		vals := make([]float64, len(args))
+		for i, arg := range args {
+			v, err := strconv.ParseFloat(arg, 64)
+			if err != nil {
+				return "", fmt.Errorf("invalid number: %s", arg)
+			}
+			vals[i] = v
+		}
+		res, err := Apply(op, vals...)
+		if err != nil {
+			return "", err
+		}
+		return strconv.FormatFloat(res, 'g', -1, 64), nil
+	case ModeDecimal:
+		vals := make([]*big.Rat, len(args))
+		for i, arg := range args {
+			v, err := ParseDecimal(arg)
+			if err != nil {
+				return "", err
+			}
+			vals[i] = v
+		}
+		res, err := applyDecimal(op, vals)
+		if err != nil {
+			return "", err
+		}
+		return FormatDecimal(res), nil
+	case ModeInteger:
+		vals := make([]*big.Int, len(args))
+		for i, arg := range args {
+			v, err := ParseInteger(arg)
+			if err != nil {
+				return "", err
+			}
+			vals[i] = v
+		}
+		res, err := applyInteger(op, vals)
+		if err != nil {
+			return "", err
+		}
+		return res.String(), nil
+	default:
+		return "", fmt.Errorf("unknown numeric mode: %s", mode)
+	}
+}
+
+// Normalize converts a literal into the canonical string of the given numeric mode
+func Normalize(mode, value string) (string, error) {
+	switch mode {
+	case ModeFloat, "":
+		v, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return "", fmt.Errorf("invalid number: %s", value)
+		}
+		return strconv.FormatFloat(v, 'g', -1, 64), nil
+	case ModeDecimal:
+		v, err := ParseDecimal(value)
+		if err != nil {
+			return "", err
+		}
+		return FormatDecimal(v), nil
+	case ModeInteger:
+		v, err := ParseInteger(value)
+		if err != nil {
+			return "", err
+		}
+		return v.String(), nil
+	default:
+		return "", fmt.Errorf("unknown numeric mode: %s", mode)
+	}
+}
+
+// ToFloat returns the float64 approximation of a canonical number string
+func ToFloat(value string) float64 {
+	if v, err := strconv.ParseFloat(value, 64); err == nil {
+		return v
+	}
+	if r, ok := new(big.Rat).SetString(value); ok {
+		v, _ := r.Float64()
+		return v
+	}
+	return 0
+}
@@ -0,0 +1,107 @@
+package mathops
+
+import (
+	"math/big"
+	"testing"
+)
+
+func TestEvaluateDecimal(t *testing.T) {
+	tests := []struct {
+		op   string
+		args []string
+		want string
+	}{
+		// точные десятичные дроби, без ошибки двоичного представления
+		{"+", []string{"0.1", "0.2"}, "0.3"},
+		{"-", []string{"0.3", "0.1"}, "0.2"},
+		{"*", []string{"1.1", "1.1"}, "1.21"},
+		{"/", []string{"1", "8"}, "0.125"},
+		// непериодическая дробь невозможна — результат остается точной дробью
+		{"/", []string{"1", "3"}, "1/3"},
+		{"+", []string{"1/3", "1/3"}, "2/3"},
+		{"*", []string{"1/3", "3"}, "1"},
+		{"//", []string{"-7", "2"}, "-4"},
+		{"%", []string{"-7", "2"}, "1"},
+		{"^", []string{"0.1", "3"}, "0.001"},
+		{"^", []string{"2", "-2"}, "0.25"},
+		{"neg", []string{"1/3"}, "-1/3"},
+		{"round", []string{"2/3", "2"}, "0.67"},
+		{"max", []string{"1/3", "0.3"}, "1/3"},
+		{"sqrt", []string{"2.25"}, "1.5"},
+	}
+
+	for _, tt := range tests {
+		got, err := Evaluate(ModeDecimal, tt.op, tt.args...)
+		if err != nil {
+			t.Errorf("%s %v: %v", tt.op, tt.args, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s %v: got %s, want %s", tt.op, tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestEvaluateDecimalErrors(t *testing.T) {
+	tests := []struct {
+		op   string
+		args []string
+	}{
+		{"/", []string{"1", "0"}},
+		{"//", []string{"1", "0"}},
+		{"%", []string{"1", "0"}},
+		{"sqrt", []string{"-1"}},
+		{"^", []string{"10", "1000000"}},
+		{"+", []string{"0.1", "abc"}},
+	}
+
+	for _, tt := range tests {
+		if got, err := Evaluate(ModeDecimal, tt.op, tt.args...); err == nil {
+			t.Errorf("%s %v: got %s, want an error", tt.op, tt.args, got)
+		}
+	}
+}
+
+func TestFormatDecimal(t *testing.T) {
+	tests := []struct {
+		num, den int64
+		want     string
+	}{
+		{3, 1, "3"},
+		{-1, 2, "-0.5"},
+		{3, 40, "0.075"},
+		{1, 3, "1/3"},
+		{-2, 6, "-1/3"},
+		{1, 6, "1/6"},
+	}
+
+	for _, tt := range tests {
+		if got := FormatDecimal(big.NewRat(tt.num, tt.den)); got != tt.want {
+			t.Errorf("%d/%d: got %s, want %s", tt.num, tt.den, got, tt.want)
+		}
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	tests := []struct {
+		mode, value string
+		want        string
+	}{
+		{ModeDecimal, "0.10", "0.1"},
+		{ModeDecimal, "2/6", "1/3"},
+		{ModeDecimal, "1e-3", "0.001"},
+		{ModeFloat, "0.10", "0.1"},
+		{ModeFloat, "1e3", "1000"},
+	}
+
+	for _, tt := range tests {
+		got, err := Normalize(tt.mode, tt.value)
+		if err != nil {
+			t.Errorf("%s %s: %v", tt.mode, tt.value, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s %s: got %s, want %s", tt.mode, tt.value, got, tt.want)
+		}
+	}
+}